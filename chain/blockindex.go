@@ -0,0 +1,230 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+//besides the current chain, the node keeps an index of all blocks it has accepted by hash, forming a tree from the genesis block.
+//each node in the tree has the total work of the branch up to it, and the current chain is the branch to the node with most work.
+//blocks whose parent is not known yet wait in the orphan pool, and are added to the tree when the parent arrives.
+//the header rules are checked when a block is added to the tree, but the transactions only when its branch becomes the
+//current chain. if that fails, the block and everything built on it is marked invalid, and the next best branch is tried
+
+var MAX_ORPHAN_BLOCKS = 100 //max number of blocks kept waiting for their parent
+
+//ErrOrphanBlock is returned when the parent of a block is not known. the block is kept in the orphan pool
+var ErrOrphanBlock = errors.New("parent block not known")
+
+//ErrInvalidBranch is returned for a block building on a block found invalid before
+var ErrInvalidBranch = errors.New("block builds on an invalid block")
+
+//blockNode is a block in the block index tree
+type blockNode struct {
+	block   Block
+	parent  *blockNode //nil for genesis
+	work    *big.Int   //total work of the branch from genesis up to and including this block
+	invalid bool       //true if this block or one before it failed validation
+}
+
+//indexBlock adds the block to the block index, unless already there, and returns its node.
+//the best node is updated if the new one has more work, so on equal work the one indexed first stays best
+func (bc *Blockchain) indexBlock(block Block) *blockNode {
+	if bc.index == nil {
+		bc.index = make(map[string]*blockNode)
+		bc.best = nil
+	}
+	if node, found := bc.index[block.Hash]; found {
+		return node
+	}
+	work := blockWork(block.Bits)
+	parent := bc.index[block.PreviousHash]
+	if parent != nil {
+		work.Add(work, parent.work)
+	}
+	node := &blockNode{block, parent, work, parent != nil && parent.invalid}
+	bc.index[block.Hash] = node
+	if !node.invalid && (bc.best == nil || node.work.Cmp(bc.best.work) > 0) {
+		bc.best = node
+	}
+	return node
+}
+
+//isAncestor checks if the given ancestor is the node itself or a block before it on its branch
+func isAncestor(ancestor *blockNode, node *blockNode) bool {
+	for ; node != nil; node = node.parent {
+		if node == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+//branchTo gives the blocks from genesis to the given node
+func branchTo(node *blockNode) []Block {
+	branch := []Block{}
+	for ; node != nil; node = node.parent {
+		branch = append(branch, node.block)
+	}
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+	return branch
+}
+
+//HasBlock tells if the block with given hash is known, on the current chain, a side branch or in the orphan pool
+func (bc *Blockchain) HasBlock(hash string) bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	_, indexed := bc.index[hash]
+	_, orphan := bc.orphans[hash]
+	return indexed || orphan
+}
+
+//ProcessBlock handles a single block received from elsewhere, e.g. announced by a peer.
+//the block can extend the current chain, a side branch, or be an orphan waiting for its parent.
+//if its branch ends up with more work than the current chain, the chain is reorganized to it.
+//returns ErrOrphanBlock (wrapped in a BlockValidationError) if the parent is not known, or the error from validating the block
+func (bc *Blockchain) ProcessBlock(block Block) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	err := bc.acceptBlock(block)
+	if err != nil {
+		return err
+	}
+	bc.acceptOrphans(block.Hash)
+	return bc.selectBestTip()
+}
+
+//acceptBlock checks the block has the work its own target asks for and follows its parent, and adds it to the block index.
+//a block with enough work but an unknown parent goes to the orphan pool instead
+func (bc *Blockchain) acceptBlock(block Block) error {
+	if _, known := bc.index[block.Hash]; known {
+		log.Println("Block already known:", block.Hash)
+		return nil
+	}
+	if hash(&block) != block.Hash {
+		return &BlockValidationError{block.Index, block.Hash, ErrBadHash}
+	}
+	if !verifyHashVsTarget(block.Hash, block.Bits) {
+		return &BlockValidationError{block.Index, block.Hash, fmt.Errorf("%w: %08x", ErrInsufficientWork, block.Bits)}
+	}
+	parent, found := bc.index[block.PreviousHash]
+	if !found {
+		//the target of an orphan cannot be checked without its parent, and it could claim any target up to MAX_TARGET_BITS.
+		//so it has to meet the target of the current tip, to cost about as much work as a real block to send
+		tipBits := bc.blocks[len(bc.blocks)-1].Bits
+		if !verifyHashVsTarget(block.Hash, tipBits) {
+			return &BlockValidationError{block.Index, block.Hash, fmt.Errorf("%w: orphan does not meet tip target %08x", ErrInsufficientWork, tipBits)}
+		}
+		//the orphan is kept with its transactions, so they have to be the ones its header commits to
+		err := checkMerkleRoot(block)
+		if err != nil {
+			return err
+		}
+		bc.addOrphan(block)
+		return &BlockValidationError{block.Index, block.Hash, ErrOrphanBlock}
+	}
+	if parent.invalid {
+		return &BlockValidationError{block.Index, block.Hash, ErrInvalidBranch}
+	}
+	err := validateNextBlock(branchTo(parent), block, bc.clock.Now())
+	if err != nil {
+		return err
+	}
+	bc.indexBlock(block)
+	log.Println("Accepted block", block.Index, block.Hash, "to block index")
+	return nil
+}
+
+//addOrphan keeps the block until its parent arrives. if the pool is full, a random orphan is dropped to make room, like bitcoin does
+func (bc *Blockchain) addOrphan(block Block) {
+	if bc.orphans == nil {
+		bc.orphans = make(map[string]Block)
+	}
+	if len(bc.orphans) >= MAX_ORPHAN_BLOCKS {
+		for hash := range bc.orphans {
+			log.Println("Orphan pool full, dropping", hash)
+			delete(bc.orphans, hash)
+			break
+		}
+	}
+	log.Println("Keeping orphan block", block.Index, block.Hash, "waiting for parent", block.PreviousHash)
+	bc.orphans[block.Hash] = block
+}
+
+//acceptOrphans adds the orphans waiting for the given block to the block index, and the orphans waiting for those, and so on
+func (bc *Blockchain) acceptOrphans(parentHash string) {
+	parents := []string{parentHash}
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+		for hash, orphan := range bc.orphans {
+			if orphan.PreviousHash != parent {
+				continue
+			}
+			delete(bc.orphans, hash)
+			err := bc.acceptBlock(orphan)
+			if err != nil {
+				log.Println("Dropping invalid orphan:", err)
+				continue
+			}
+			parents = append(parents, hash)
+		}
+	}
+}
+
+//selectBestTip switches the current chain to the valid branch with most work in the block index (see Blockchain.best).
+//on equal work the current chain is kept. if switching fails on an invalid block of the new branch, that block and its
+//descendants are marked invalid and the next best is tried. returns the error for the last invalid block found, if any.
+//other errors, e.g. from the storage, or failing to restore the old chain after a failed switch (ErrRestoreFailed),
+//are returned as is without marking anything invalid
+func (bc *Blockchain) selectBestTip() error {
+	var lastErr error
+	for {
+		tip := bc.index[bc.blocks[len(bc.blocks)-1].Hash]
+		best := bc.best
+		if best == nil || best == tip || best.work.Cmp(tip.work) <= 0 {
+			return lastErr
+		}
+		log.Println("Switching to branch with more work, tip", best.block.Index, best.block.Hash)
+		err := bc.reorganize(branchTo(best))
+		if err == nil {
+			return lastErr
+		}
+		var blockErr *BlockValidationError
+		if !errors.As(err, &blockErr) {
+			return err
+		}
+		//only blocks after the fork point were validated for the switch, the ones before are on the old chain too
+		invalid := bc.index[blockErr.Hash]
+		if invalid == nil || !isAncestor(invalid, best) || isAncestor(invalid, tip) {
+			return err
+		}
+		bc.markInvalid(invalid)
+		if errors.Is(err, ErrRestoreFailed) {
+			//the chain is not at any tip that was chosen, leave it for the caller to deal with
+			return err
+		}
+		lastErr = err
+	}
+}
+
+//markInvalid marks the node and all nodes descending from it as invalid, and finds the best node again from the valid ones.
+//the current tip is best on equal work
+func (bc *Blockchain) markInvalid(invalid *blockNode) {
+	log.Println("Marking block invalid:", invalid.block.Hash)
+	for _, node := range bc.index {
+		if isAncestor(invalid, node) {
+			node.invalid = true
+		}
+	}
+	bc.best = bc.index[bc.blocks[len(bc.blocks)-1].Hash]
+	for _, node := range bc.index {
+		if !node.invalid && node.work.Cmp(bc.best.work) > 0 {
+			bc.best = node
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package chain
+
+import (
+	"errors"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//feed single blocks of competing branches, out of order, and check the chain follows the valid branch with most work
+func TestProcessBlock(t *testing.T) {
+	privKey, _, address := cryptoff.CreateAddress()
+	bc := newTestChain()
+	base := bc.CreateTestChain(address, 2)
+
+	//two blocks on the same parent: the first one seen stays the tip on equal work
+	branchA := appendTestBlock(base, nil)
+	branchB := appendTestBlock(base, nil)
+	assert.NoError(t, bc.ProcessBlock(branchA[3]))
+	assert.NoError(t, bc.ProcessBlock(branchB[3]))
+	assert.Equal(t, branchA, bc.Blocks())
+	assert.True(t, bc.HasBlock(branchB[3].Hash))
+
+	//b gets ahead with blocks arriving in reverse order: they wait as orphans until the parent arrives
+	for i := 0; i < 3; i++ {
+		branchB = appendTestBlock(branchB, nil)
+	}
+	err := bc.ProcessBlock(branchB[6])
+	assert.True(t, errors.Is(err, ErrOrphanBlock))
+	assert.True(t, bc.HasBlock(branchB[6].Hash))
+	assert.True(t, errors.Is(bc.ProcessBlock(branchB[5]), ErrOrphanBlock))
+	assert.Equal(t, branchA, bc.Blocks())
+	assert.NoError(t, bc.ProcessBlock(branchB[4]))
+	assert.Equal(t, branchB, bc.Blocks())
+	assert.Empty(t, bc.orphans)
+
+	//a branch with more work but a double spend is rejected when it would become the chain, and stays invalid
+	spend, err := bc.SendCoins(privKey, "double", 10, 0)
+	assert.NoError(t, err)
+	branchC := appendTestBlock(base, []Transaction{spend, spend})
+	for i := 0; i < 4; i++ {
+		branchC = appendTestBlock(branchC, nil)
+	}
+	for _, block := range branchC[3:7] {
+		assert.NoError(t, bc.ProcessBlock(block))
+	}
+	err = bc.ProcessBlock(branchC[7])
+	var blockErr *BlockValidationError
+	assert.True(t, errors.As(err, &blockErr))
+	assert.Equal(t, branchC[3].Hash, blockErr.Hash)
+	assert.Equal(t, branchB, bc.Blocks())
+	assert.Equal(t, []Transaction{spend}, bc.Mempool())
+	branchC = appendTestBlock(branchC, nil)
+	assert.True(t, errors.Is(bc.ProcessBlock(branchC[8]), ErrInvalidBranch))
+
+	//blocks with a broken header are not taken to the index at all
+	broken := appendTestBlock(branchB, nil)
+	broken[7].Data = "changed"
+	assert.True(t, errors.Is(bc.ProcessBlock(broken[7]), ErrBadHash))
+	assert.False(t, bc.HasBlock(broken[7].Hash))
+}
+
+//blocks without the work for their target, or with a target easier than allowed, are rejected and not kept as orphans
+func TestOrphanNeedsWork(t *testing.T) {
+	bc := newTestChain()
+	base := bc.CreateTestChain(GenesisAddress, 1)
+	orphan := appendTestBlock(appendTestBlock(base, nil), nil)[3]
+	tests := []struct {
+		name string
+		bits uint32
+	}{
+		{"hard target", 0x03000001},
+		{"target over max", 0x2200ffff},
+	}
+	for _, test := range tests {
+		block := orphan
+		block.Bits = test.bits
+		block.Hash = hash(&block)
+		err := bc.ProcessBlock(block)
+		assert.True(t, errors.Is(err, ErrInsufficientWork), "%s: got %v", test.name, err)
+		assert.False(t, bc.HasBlock(block.Hash), test.name)
+	}
+	assert.Empty(t, bc.orphans)
+
+	//a mined block with an unknown parent is kept as an orphan
+	assert.True(t, errors.Is(bc.ProcessBlock(orphan), ErrOrphanBlock))
+	assert.True(t, bc.HasBlock(orphan.Hash))
+
+	//an orphan has to meet the target of the tip, even if it claims an easier one
+	bc.blocks[len(bc.blocks)-1].Bits = 0x1f00ffff
+	easy := appendTestBlock(appendTestBlock(base, nil), nil)[3]
+	for verifyHashVsTarget(easy.Hash, 0x1f00ffff) {
+		easy = appendTestBlock(appendTestBlock(base, nil), nil)[3]
+	}
+	err := bc.ProcessBlock(easy)
+	assert.True(t, errors.Is(err, ErrInsufficientWork), "got %v", err)
+	assert.False(t, bc.HasBlock(easy.Hash))
+	hard := Block{4, "", "unknown", time.Now().UTC(), "hard orphan", []Transaction{CreateCoinbaseTx("appended", 4, 0)}, "", 0x1f00ffff, 0}
+	hard = mineBlock(hard)
+	assert.True(t, errors.Is(bc.ProcessBlock(hard), ErrOrphanBlock))
+	assert.True(t, bc.HasBlock(hard.Hash))
+}
+
+//a switch failing on a storage error returns the error, without marking the branch invalid
+func TestProcessBlockStorageError(t *testing.T) {
+	bc := newTestChain()
+	base := bc.CreateTestChain(GenesisAddress, 2)
+	store := &failingUtxoStore{UtxoStore: bc.utxos}
+	bc.utxos = store
+	_, err := bc.CreateBlock(GenesisAddress, nil, "old branch")
+	assert.NoError(t, err)
+	oldChain := bc.Blocks()
+
+	branch := appendTestBlock(appendTestBlock(base, nil), nil)
+	store.failConnect = branch[3].Hash
+	assert.NoError(t, bc.ProcessBlock(branch[3]))
+	err = bc.ProcessBlock(branch[4])
+	assert.Error(t, err)
+	var blockErr *BlockValidationError
+	assert.False(t, errors.As(err, &blockErr))
+	assert.Equal(t, oldChain, bc.Blocks())
+	assert.False(t, bc.index[branch[3].Hash].invalid)
+	assert.False(t, bc.index[branch[4].Hash].invalid)
+
+	//once the storage works again, the branch is taken with the next block on it
+	store.failConnect = ""
+	branch = appendTestBlock(branch, nil)
+	assert.NoError(t, bc.ProcessBlock(branch[5]))
+	assert.Equal(t, branch, bc.Blocks())
+}
@@ -0,0 +1,541 @@
+package chain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//BlockStore keeps blocks on disk similar to bitcoin: the blocks are appended as binary records to block files
+//(blk00000.dat, blk00001.dat, ..), and a leveldb database indexes where each block is by hash, and which block is at each height.
+//a block is written only once, writing the chain again only appends the blocks not stored yet and updates the height index.
+//the chain appends each block as it is connected with AppendBlock, WriteBlocks stores a whole chain at once.
+//blocks from branches no longer on the chain stay in the files and can still be found by hash.
+//
+//each write first appends and fsyncs the blocks, then writes the index changes as one synced leveldb batch.
+//the index records where the last write ended, so anything after that in the block files is from a write that did not finish,
+//and it is cut off when the store is opened again. so after a crash the store has either all or none of the last write
+//
+//the index also records the encoding version of the blocks. a store written with another version fails to open with ErrResyncRequired
+//
+//the unspent txouts are kept in a UtxoDB in the "chainstate" directory under the block store
+//
+//a block record is: magic (4 bytes), payload length (4 bytes), crc32 of payload (4 bytes), payload (block in its canonical encoding)
+
+var MAX_BLOCK_FILE_SIZE int64 = 128 * 1024 * 1024 //a new block file is started when a block would not fit in the current one
+var BLOCK_INDEX_CACHE_SIZE = 8 * opt.MiB          //memory for leveldb to cache index blocks in
+
+const blockRecordMagic uint32 = 0x6e626c6b //"nblk", marks the start of each block record
+const blockRecordHeaderSize = 12
+
+//keys in the index database
+var (
+	tipKey          = []byte("tip")      //height of the stored chain
+	versionKey      = []byte("version")  //ENCODING_VERSION of the stored blocks
+	lastFileKey     = []byte("lastfile") //number and size of the block file written last
+	blockKeyPrefix  = []byte("b")        //"b" + block hash -> location of the block
+	heightKeyPrefix = []byte("h")        //"h" + height -> hash of the block at that height
+)
+
+//ErrBlockNotStored is returned when reading a block that is not in the store
+var ErrBlockNotStored = errors.New("block not found in block store")
+
+//ErrResyncRequired is returned when opening a block store written with another encoding version.
+//the block hashes commit to the encoding version, so the stored chain can not be used and has to be synced again
+var ErrResyncRequired = errors.New("block store has another encoding version, re-sync required")
+
+//ErrCorruptBlockRecord is returned when a block record in a block file does not match its header or checksum
+var ErrCorruptBlockRecord = errors.New("corrupt block record")
+
+//blockLocation tells where a block record is in the block files
+type blockLocation struct {
+	File   uint32 //number of the block file
+	Offset uint32 //position of the record in the file
+	Size   uint32 //length of the record payload
+}
+
+func (l blockLocation) bytes() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:], l.File)
+	binary.BigEndian.PutUint32(b[4:], l.Offset)
+	binary.BigEndian.PutUint32(b[8:], l.Size)
+	return b
+}
+
+func parseBlockLocation(b []byte) (blockLocation, error) {
+	if len(b) != 12 {
+		return blockLocation{}, fmt.Errorf("invalid block location of %d bytes", len(b))
+	}
+	return blockLocation{binary.BigEndian.Uint32(b[0:]), binary.BigEndian.Uint32(b[4:]), binary.BigEndian.Uint32(b[8:])}, nil
+}
+
+func blockKey(hash string) []byte {
+	return append(append([]byte{}, blockKeyPrefix...), hash...)
+}
+
+//heightKey uses big endian so the heights are in order in the database
+func heightKey(height int) []byte {
+	key := append([]byte{}, heightKeyPrefix...)
+	return binary.BigEndian.AppendUint32(key, uint32(height))
+}
+
+//BlockStore is a Storage writing blocks into append-only block files, with an index database to find them
+type BlockStore struct {
+	lock     sync.Mutex  //guards the files and the index, so writes and reads from different goroutines do not mix
+	Path     string      //directory for the block files and the index database
+	db       *leveldb.DB //the index
+	utxos    *UtxoDB     //the unspent txouts of the chain
+	lastFile uint32      //number of the block file to append to
+	lastSize int64       //size of the last block file after the last finished write
+}
+
+//NewBlockStore opens the block store in the given directory, creating it if needed.
+//unfinished writes from a crash are cut off from the block files
+func NewBlockStore(path string) (*BlockStore, error) {
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(filepath.Join(path, "index"), &opt.Options{BlockCacheCapacity: BLOCK_INDEX_CACHE_SIZE})
+	if err != nil {
+		return nil, err
+	}
+	utxos, err := NewUtxoDB(filepath.Join(path, "chainstate"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	bs := &BlockStore{Path: path, db: db, utxos: utxos}
+	err = bs.recover()
+	if err == nil {
+		err = bs.checkVersion()
+	}
+	if err != nil {
+		bs.Close()
+		return nil, err
+	}
+	log.Println("Opened block store at", path, ", last block file", bs.lastFile, "size", bs.lastSize)
+	return bs, nil
+}
+
+func (bs *BlockStore) fileName(file uint32) string {
+	return filepath.Join(bs.Path, fmt.Sprintf("blk%05d.dat", file))
+}
+
+//recover reads from the index where the last finished write ended, and removes anything written to the block files after it
+func (bs *BlockStore) recover() error {
+	bs.lastFile = 0
+	bs.lastSize = 0
+	value, err := bs.db.Get(lastFileKey, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		if len(value) != 12 {
+			return fmt.Errorf("invalid last file record of %d bytes", len(value))
+		}
+		bs.lastFile = binary.BigEndian.Uint32(value[0:])
+		bs.lastSize = int64(binary.BigEndian.Uint64(value[4:]))
+	}
+	fileName := bs.fileName(bs.lastFile)
+	info, err := os.Stat(fileName)
+	switch {
+	case os.IsNotExist(err):
+		if bs.lastSize > 0 {
+			return fmt.Errorf("block file %s missing", fileName)
+		}
+	case err != nil:
+		return err
+	case info.Size() < bs.lastSize:
+		return fmt.Errorf("block file %s is %d bytes, index expects %d", fileName, info.Size(), bs.lastSize)
+	case info.Size() > bs.lastSize:
+		log.Println("Removing", info.Size()-bs.lastSize, "bytes of unfinished write from", fileName)
+		err = os.Truncate(fileName, bs.lastSize)
+		if err != nil {
+			return err
+		}
+	}
+	//an unfinished write may also have started a new file
+	next := bs.fileName(bs.lastFile + 1)
+	if _, err := os.Stat(next); err == nil {
+		log.Println("Removing unfinished block file", next)
+		return os.Remove(next)
+	}
+	return nil
+}
+
+//checkVersion checks the stored blocks have the encoding version of this node, and records the version for a new store.
+//stores from before the version was recorded are checked from the version byte of their genesis block
+func (bs *BlockStore) checkVersion() error {
+	value, err := bs.db.Get(versionKey, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if err == nil {
+		if len(value) != 1 {
+			return fmt.Errorf("invalid version record of %d bytes", len(value))
+		}
+		return bs.versionMatches(value[0])
+	}
+	height, err := bs.tipHeight()
+	if err != nil {
+		return err
+	}
+	if height > 0 {
+		version, err := bs.genesisVersion()
+		if err != nil {
+			return err
+		}
+		err = bs.versionMatches(version)
+		if err != nil {
+			return err
+		}
+	}
+	return bs.db.Put(versionKey, []byte{ENCODING_VERSION}, &opt.WriteOptions{Sync: true})
+}
+
+func (bs *BlockStore) versionMatches(version byte) error {
+	if version != ENCODING_VERSION {
+		return fmt.Errorf("%w: blocks in %s are version %d, this node uses version %d. remove the directory to sync the chain again from peers",
+			ErrResyncRequired, bs.Path, version, ENCODING_VERSION)
+	}
+	return nil
+}
+
+//genesisVersion reads the encoding version byte of the stored genesis block, without decoding the rest of the block
+func (bs *BlockStore) genesisVersion() (byte, error) {
+	hash, err := bs.db.Get(heightKey(1), nil)
+	if err != nil {
+		return 0, fmt.Errorf("reading genesis hash: %w", err)
+	}
+	value, err := bs.db.Get(blockKey(string(hash)), nil)
+	if err != nil {
+		return 0, fmt.Errorf("reading genesis location: %w", err)
+	}
+	location, err := parseBlockLocation(value)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Open(bs.fileName(location.File))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	version := make([]byte, 1)
+	_, err = file.ReadAt(version, int64(location.Offset)+blockRecordHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	return version[0], nil
+}
+
+//tipHeight gives the height of the stored chain, 0 if nothing is stored
+func (bs *BlockStore) tipHeight() (int, error) {
+	value, err := bs.db.Get(tipKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(value)), nil
+}
+
+func (bs *BlockStore) Exists() bool {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	height, err := bs.tipHeight()
+	if err != nil {
+		log.Println("Failed to read block store tip:", err)
+	}
+	return height > 0
+}
+
+//ReadBlocks reads the blocks of the stored chain, following the height index from genesis up to the tip
+func (bs *BlockStore) ReadBlocks() ([]Block, error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	height, err := bs.tipHeight()
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Reading", height, "blocks from block store", bs.Path)
+	files := make(map[uint32]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	blocks := make([]Block, 0, height)
+	for h := 1; h <= height; h++ {
+		hash, err := bs.db.Get(heightKey(h), nil)
+		if err != nil {
+			return nil, fmt.Errorf("reading hash for height %d: %w", h, err)
+		}
+		block, err := bs.readBlock(string(hash), files)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+//ReadBlock reads the block with the given hash, whether on the stored chain or a branch stored before
+func (bs *BlockStore) ReadBlock(hash string) (Block, error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	files := make(map[uint32]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	return bs.readBlock(hash, files)
+}
+
+//readBlock reads a block record from the block files, opening files as needed into the given map for the caller to close
+func (bs *BlockStore) readBlock(hash string, files map[uint32]*os.File) (Block, error) {
+	value, err := bs.db.Get(blockKey(hash), nil)
+	if err == leveldb.ErrNotFound {
+		return Block{}, fmt.Errorf("%w: %s", ErrBlockNotStored, hash)
+	}
+	if err != nil {
+		return Block{}, err
+	}
+	location, err := parseBlockLocation(value)
+	if err != nil {
+		return Block{}, err
+	}
+	file, found := files[location.File]
+	if !found {
+		file, err = os.Open(bs.fileName(location.File))
+		if err != nil {
+			return Block{}, err
+		}
+		files[location.File] = file
+	}
+	record := make([]byte, blockRecordHeaderSize+int(location.Size))
+	_, err = file.ReadAt(record, int64(location.Offset))
+	if err != nil {
+		return Block{}, err
+	}
+	payload := record[blockRecordHeaderSize:]
+	if binary.BigEndian.Uint32(record[0:]) != blockRecordMagic ||
+		binary.BigEndian.Uint32(record[4:]) != location.Size ||
+		binary.BigEndian.Uint32(record[8:]) != crc32.ChecksumIEEE(payload) {
+		return Block{}, fmt.Errorf("%w: block %s in file %d at %d", ErrCorruptBlockRecord, hash, location.File, location.Offset)
+	}
+	block, err := DecodeBlock(payload)
+	if err != nil {
+		return Block{}, err
+	}
+	if block.Hash != hash {
+		return Block{}, fmt.Errorf("%w: expected block %s, found %s", ErrCorruptBlockRecord, hash, block.Hash)
+	}
+	return block, nil
+}
+
+//WriteBlocks stores the given chain. blocks already stored are not written again, only the height index is updated for them.
+//usually this only appends the blocks after the stored tip, after a reorg the heights from the fork up are pointed to the new blocks
+func (bs *BlockStore) WriteBlocks(blocks []Block) error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	stored, err := bs.tipHeight()
+	if err != nil {
+		return err
+	}
+	//find the highest block on both chains, walking down from the stored tip
+	fork := stored
+	if fork > len(blocks) {
+		fork = len(blocks)
+	}
+	for ; fork > 0; fork-- {
+		hash, err := bs.db.Get(heightKey(fork), nil)
+		if err != nil {
+			return err
+		}
+		if string(hash) == blocks[fork-1].Hash {
+			break
+		}
+	}
+	batch := new(leveldb.Batch)
+	var file *os.File
+	appended := 0
+	for i := fork; i < len(blocks); i++ {
+		block := blocks[i]
+		known, err := bs.db.Has(blockKey(block.Hash), nil)
+		if err != nil {
+			return bs.abortWrite(file, err)
+		}
+		if !known {
+			location, err := bs.appendBlock(&file, block)
+			if err != nil {
+				return bs.abortWrite(file, err)
+			}
+			batch.Put(blockKey(block.Hash), location.bytes())
+			appended++
+		}
+		batch.Put(heightKey(i+1), []byte(block.Hash))
+	}
+	err = bs.finishWrite(file, batch, len(blocks), stored)
+	if err != nil {
+		return err
+	}
+	log.Println("Stored chain of", len(blocks), "blocks, appended", appended, "blocks, kept", fork, "from before")
+	return nil
+}
+
+//AppendBlock stores the block as the tip of the stored chain, at the height of its index.
+//the heights above it are dropped, so connecting the blocks of a fork one by one moves the stored chain to the fork
+func (bs *BlockStore) AppendBlock(block Block) error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	stored, err := bs.tipHeight()
+	if err != nil {
+		return err
+	}
+	if block.Index > stored+1 {
+		return fmt.Errorf("block %d would leave a gap after stored tip %d", block.Index, stored)
+	}
+	batch := new(leveldb.Batch)
+	var file *os.File
+	known, err := bs.db.Has(blockKey(block.Hash), nil)
+	if err != nil {
+		return err
+	}
+	if !known {
+		location, err := bs.appendBlock(&file, block)
+		if err != nil {
+			return bs.abortWrite(file, err)
+		}
+		batch.Put(blockKey(block.Hash), location.bytes())
+	}
+	batch.Put(heightKey(block.Index), []byte(block.Hash))
+	return bs.finishWrite(file, batch, block.Index, stored)
+}
+
+//finishWrite syncs the blocks appended to the file, and writes the index changes in the batch with the new tip height.
+//heights above the new tip up to the previously stored tip are removed from the index
+func (bs *BlockStore) finishWrite(file *os.File, batch *leveldb.Batch, height int, stored int) error {
+	for h := height + 1; h <= stored; h++ {
+		batch.Delete(heightKey(h))
+	}
+	if file != nil {
+		err := syncAndClose(file)
+		if err != nil {
+			return bs.abortWrite(nil, err)
+		}
+	}
+	tip := make([]byte, 4)
+	binary.BigEndian.PutUint32(tip, uint32(height))
+	batch.Put(tipKey, tip)
+	last := make([]byte, 12)
+	binary.BigEndian.PutUint32(last[0:], bs.lastFile)
+	binary.BigEndian.PutUint64(last[4:], uint64(bs.lastSize))
+	batch.Put(lastFileKey, last)
+	err := bs.db.Write(batch, &opt.WriteOptions{Sync: true})
+	if err != nil {
+		return bs.abortWrite(nil, err)
+	}
+	return nil
+}
+
+//appendBlock appends the block record to the last block file, opening it into file if not open yet.
+//starts a new block file when the record does not fit in the current one
+func (bs *BlockStore) appendBlock(file **os.File, block Block) (blockLocation, error) {
+	var err error
+	payload := EncodeBlock(block)
+	recordSize := int64(blockRecordHeaderSize + len(payload))
+	if bs.lastSize > 0 && bs.lastSize+recordSize > MAX_BLOCK_FILE_SIZE {
+		if *file != nil {
+			err = syncAndClose(*file)
+			*file = nil
+			if err != nil {
+				return blockLocation{}, err
+			}
+		}
+		bs.lastFile++
+		bs.lastSize = 0
+		log.Println("Starting new block file", bs.fileName(bs.lastFile))
+	}
+	if *file == nil {
+		*file, err = os.OpenFile(bs.fileName(bs.lastFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return blockLocation{}, err
+		}
+		if bs.lastSize == 0 {
+			//a new file needs its directory entry synced as well to survive a crash
+			err = syncDir(bs.Path)
+			if err != nil {
+				return blockLocation{}, err
+			}
+		}
+	}
+	record := make([]byte, blockRecordHeaderSize, recordSize)
+	binary.BigEndian.PutUint32(record[0:], blockRecordMagic)
+	binary.BigEndian.PutUint32(record[4:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[8:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	_, err = (*file).Write(record)
+	if err != nil {
+		return blockLocation{}, err
+	}
+	location := blockLocation{bs.lastFile, uint32(bs.lastSize), uint32(len(payload))}
+	bs.lastSize += recordSize
+	return location, nil
+}
+
+//abortWrite closes the file being written and cuts off what was appended to the block files, then returns the given error
+func (bs *BlockStore) abortWrite(file *os.File, err error) error {
+	log.Println("Failed to write blocks:", err)
+	if file != nil {
+		file.Close()
+	}
+	recoverErr := bs.recover()
+	if recoverErr != nil {
+		log.Println("Failed to clean up after failed write:", recoverErr)
+	}
+	return err
+}
+
+func syncAndClose(file *os.File) error {
+	err := file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (bs *BlockStore) Utxos() UtxoStore {
+	return bs.utxos
+}
+
+//Close closes the index and unspent txout databases. the block files are only open during reads and writes
+func (bs *BlockStore) Close() error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	utxoErr := bs.utxos.Close()
+	err := bs.db.Close()
+	if err != nil {
+		return err
+	}
+	return utxoErr
+}
@@ -0,0 +1,176 @@
+package chain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func openTestStore(t *testing.T, path string) *BlockStore {
+	bs, err := NewBlockStore(path)
+	assert.NoError(t, err)
+	return bs
+}
+
+//write a chain, extend it and switch it to a fork, and check each write only appends the new blocks
+func TestBlockStoreWriteAndRead(t *testing.T) {
+	path := t.TempDir()
+	bs := openTestStore(t, path)
+	assert.False(t, bs.Exists())
+	bc := NewBlockchain(DefaultGenesis, bs)
+	blocks := bc.CreateTestChain("address1", 3)
+	assert.NoError(t, bc.WriteBlockChain())
+	assert.True(t, bs.Exists())
+	read, err := bs.ReadBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, blocks, read)
+
+	fileName := bs.fileName(0)
+	info, _ := os.Stat(fileName)
+	sizeBefore := info.Size()
+	longer := appendTestBlock(blocks, nil)
+	assert.NoError(t, bs.WriteBlocks(longer))
+	info, _ = os.Stat(fileName)
+	sizeAfter := info.Size()
+	assert.True(t, sizeAfter > sizeBefore)
+	assert.Equal(t, bs.lastSize, sizeAfter)
+	//writing the same chain again writes no blocks
+	assert.NoError(t, bs.WriteBlocks(longer))
+	info, _ = os.Stat(fileName)
+	assert.Equal(t, sizeAfter, info.Size())
+
+	//a shorter fork replaces the heights from the fork point, and the old tip is still found by hash
+	fork := appendTestBlock(blocks[:2], nil)
+	assert.NoError(t, bs.WriteBlocks(fork))
+	read, err = bs.ReadBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, fork, read)
+	oldTip, err := bs.ReadBlock(longer[4].Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, longer[4], oldTip)
+	_, err = bs.ReadBlock("unknown")
+	assert.ErrorIs(t, err, ErrBlockNotStored)
+	assert.NoError(t, bs.Close())
+
+	//a restarted chain gets the stored fork
+	bs = openTestStore(t, path)
+	defer bs.Close()
+	restarted := NewBlockchain(DefaultGenesis, bs)
+	assert.True(t, restarted.InitBlockChain())
+	assert.Equal(t, fork, restarted.Blocks())
+	assert.Equal(t, INITIAL_SUBSIDY, restarted.BalanceFor("address1"))
+}
+
+//data appended to a block file without its index update, as if the node crashed in the middle of a write, is removed on open
+func TestBlockStoreRecoversUnfinishedWrite(t *testing.T) {
+	defer func(size int64) { MAX_BLOCK_FILE_SIZE = size }(MAX_BLOCK_FILE_SIZE)
+	MAX_BLOCK_FILE_SIZE = 600
+	path := t.TempDir()
+	bs := openTestStore(t, path)
+	bc := NewBlockchain(DefaultGenesis, bs)
+	blocks := bc.CreateTestChain("address1", 5)
+	assert.NoError(t, bc.WriteBlockChain())
+	assert.True(t, bs.lastFile > 0, "small max file size should spread blocks over several files")
+	lastFile := bs.fileName(bs.lastFile)
+	lastSize := bs.lastSize
+	assert.NoError(t, bs.Close())
+
+	file, err := os.OpenFile(lastFile, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	file.Write([]byte("half a block"))
+	file.Close()
+	nextFile := bs.fileName(bs.lastFile + 1)
+	assert.NoError(t, os.WriteFile(nextFile, []byte("another half"), 0644))
+
+	bs = openTestStore(t, path)
+	defer bs.Close()
+	info, err := os.Stat(lastFile)
+	assert.NoError(t, err)
+	assert.Equal(t, lastSize, info.Size())
+	assert.NoFileExists(t, nextFile)
+	read, err := bs.ReadBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, blocks, read)
+	longer := appendTestBlock(blocks, nil)
+	assert.NoError(t, bs.WriteBlocks(longer))
+	read, err = bs.ReadBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, longer, read)
+}
+
+//a block record changed on disk is found by its checksum
+func TestBlockStoreDetectsCorruption(t *testing.T) {
+	path := t.TempDir()
+	bs := openTestStore(t, path)
+	defer bs.Close()
+	bc := NewBlockchain(DefaultGenesis, bs)
+	bc.CreateTestChain("address1", 1)
+	assert.NoError(t, bc.WriteBlockChain())
+	data, err := os.ReadFile(bs.fileName(0))
+	assert.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(bs.fileName(0), data, 0644))
+	_, err = bs.ReadBlocks()
+	assert.ErrorIs(t, err, ErrCorruptBlockRecord)
+}
+
+//blocks are stored as they are connected, without writing the chain, also when switching to a fork
+func TestBlockStoreAppendsConnectedBlocks(t *testing.T) {
+	path := t.TempDir()
+	bs := openTestStore(t, path)
+	bc := NewBlockchain(DefaultGenesis, bs)
+	blocks := bc.CreateTestChain("address1", 3)
+	read, err := bs.ReadBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, blocks, read)
+
+	fork := appendTestBlock(appendTestBlock(appendTestBlock(blocks[:2], nil), nil), nil)
+	assert.True(t, bc.TakeMostDifficultChain(fork))
+	read, err = bs.ReadBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, fork, read)
+
+	//a block not on the stored tip would leave a gap
+	longer := appendTestBlock(appendTestBlock(fork, nil), nil)
+	assert.Error(t, bs.AppendBlock(longer[6]))
+	assert.NoError(t, bs.Close())
+
+	bs = openTestStore(t, path)
+	defer bs.Close()
+	restarted := NewBlockchain(DefaultGenesis, bs)
+	assert.True(t, restarted.InitBlockChain())
+	assert.Equal(t, fork, restarted.Blocks())
+	assert.Equal(t, INITIAL_SUBSIDY, restarted.BalanceFor("address1"))
+}
+
+//a store with blocks in another encoding version fails to open, whether the version is recorded or only in the blocks
+func TestBlockStoreVersionMismatch(t *testing.T) {
+	path := t.TempDir()
+	bs := openTestStore(t, path)
+	bc := NewBlockchain(DefaultGenesis, bs)
+	bc.CreateTestChain("address1", 1)
+	assert.NoError(t, bs.db.Put(versionKey, []byte{ENCODING_VERSION - 1}, nil))
+	assert.NoError(t, bs.Close())
+	_, err := NewBlockStore(path)
+	assert.ErrorIs(t, err, ErrResyncRequired)
+
+	//a store from before the version was recorded
+	bs = openTestStore(t, path+"/old")
+	bc = NewBlockchain(DefaultGenesis, bs)
+	bc.CreateTestChain("address1", 1)
+	assert.NoError(t, bs.db.Delete(versionKey, nil))
+	assert.NoError(t, bs.Close())
+	//opening records the version found in the genesis block
+	bs = openTestStore(t, path+"/old")
+	version, err := bs.db.Get(versionKey, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{ENCODING_VERSION}, version)
+	assert.NoError(t, bs.db.Delete(versionKey, nil))
+	assert.NoError(t, bs.Close())
+	data, err := os.ReadFile(bs.fileName(0))
+	assert.NoError(t, err)
+	data[blockRecordHeaderSize] = ENCODING_VERSION - 1
+	assert.NoError(t, os.WriteFile(bs.fileName(0), data, 0644))
+	_, err = NewBlockStore(path + "/old")
+	assert.ErrorIs(t, err, ErrResyncRequired)
+}
@@ -6,27 +6,33 @@ package chain
 //https://stackoverflow.com/questions/16900938/how-to-place-golang-project-a-set-of-packages-to-github
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math"
-	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
-var chainPath = "node/blocks/"
-var chainFileName = "blocks.json"
-
-//this is the current chain this node is on
-var GlobalChain []Block
 var GenesisTime, _ = time.Parse("Jan 2 15:04 2006", "Mar 15 19:00 2018")
 var GenesisAddress = "3uGQcE7wPMYoJDGStgWMkm6qj7u83TDmcvXUYVoVeDq4sYRMZXisB6vxMwQWCMPe1eX5rGPgoJ9oyYoFNGwpqNcPU"
 
+//GenesisParams holds the values used to build the genesis block of a chain.
+//all nodes on the same network need to use the same values
+type GenesisParams struct {
+	Time    time.Time //timestamp of the genesis block
+	Address string    //address receiving the genesis coinbase
+	Data    string    //data stored in the genesis block
+}
+
+//DefaultGenesis is the genesis block setup for the main chain
+var DefaultGenesis = GenesisParams{GenesisTime, GenesisAddress, "Teemu oli täällä"}
+
 type Block struct {
 	Index        int           //the block index in the chain
 	Hash         string        //hash for this block
@@ -34,40 +40,108 @@ type Block struct {
 	Timestamp    time.Time     //time when this block was created
 	Data         string        //the data in this block. could be anything. not really needed since real data is transaction but for fun..
 	Transactions []Transaction //the transactions in this block
-	Difficulty   int           //block difficulty when created
+	MerkleRoot   string        //merkle root over the ids of the transactions, set when mining the block (see MerkleRoot)
+	Bits         uint32        //proof of work target for this block, in compact form (see miner.go)
 	Nonce        int           //nonce used to find the hash for this block
 }
 
-//list of all transactions in the blockchain
-var allTransactions []Transaction
+//Blockchain holds the state of a single chain: the blocks, the transactions and unspent tx-outs they produce,
+//and the pool of transactions waiting to be mined.
+//several can exist side by side, e.g. to simulate multiple nodes in one process.
+//exported methods are safe to call from multiple goroutines, they take the lock as needed.
+//unexported methods expect the caller to hold the lock, unless their comment says otherwise
+type Blockchain struct {
+	lock             sync.RWMutex          //guards the blocks, unspent tx-outs and mempool below
+	genesis          GenesisParams         //parameters for building the genesis block
+	storage          Storage               //where the chain is written to and read from
+	blocks           []Block               //this is the current chain this node is on
+	index            map[string]*blockNode //all accepted blocks by hash, on the current chain and side branches
+	best             *blockNode            //node with most work in the index not marked invalid, the tip the chain should be at
+	orphans          map[string]Block      //blocks waiting for their parent, by hash
+	utxos            UtxoStore             //unspent tx-outs of the current chain and undo data for its blocks, from the storage
+	mempool          []Transaction         //transactions waiting to be included in a block
+	tipChanged       chan struct{}         //closed and replaced when the last block of the chain changes
+	mempoolChanged   chan struct{}         //closed and replaced when a transaction is added to the mempool
+	reorgSubscribers []chan ReorgEvent     //channels to send reorg events to
+	clock            *NetworkClock         //network-adjusted time for checking block timestamps, has its own lock
+}
+
+//NewBlockchain creates an empty chain using the given genesis parameters, persisted to the given storage.
+//use InitBlockChain() to load an existing chain from the storage
+func NewBlockchain(genesis GenesisParams, storage Storage) *Blockchain {
+	return &Blockchain{genesis: genesis, storage: storage, utxos: storage.Utxos(), tipChanged: make(chan struct{}), mempoolChanged: make(chan struct{}), clock: NewNetworkClock()}
+}
 
-//list of all unspent tx-outs in the blockchain
-var unspentTxOuts []UnspentTxOut
+//BlockValidationError is returned when a block is rejected, wrapping the error that caused it
+type BlockValidationError struct {
+	Index int    //index of the rejected block
+	Hash  string //hash of the rejected block
+	Err   error  //the reason for rejecting the block
+}
+
+func (e *BlockValidationError) Error() string {
+	return fmt.Sprintf("invalid block %d (%s): %v", e.Index, e.Hash, e.Err)
+}
 
-func addTransaction(tx Transaction) {
-	log.Println("Adding transaction:", tx)
-	oldTx := findUnspentTransaction(tx.Sender, tx.Id)
-	if oldTx >= 0 {
-		log.Println("transaction already exists, not adding: ", tx.Id)
-		return
+func (e *BlockValidationError) Unwrap() error {
+	return e.Err
+}
+
+//Blocks returns a copy of the blocks in the current chain
+func (bc *Blockchain) Blocks() []Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return append([]Block{}, bc.blocks...)
+}
+
+//Height returns the number of blocks in the current chain
+func (bc *Blockchain) Height() int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return len(bc.blocks)
+}
+
+//GenesisHash returns the hash of the genesis block of the chain, or empty if the chain has no blocks yet
+func (bc *Blockchain) GenesisHash() string {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	if len(bc.blocks) == 0 {
+		return ""
 	}
-	allTransactions = append(allTransactions, tx)
-	for _, txIn := range tx.TxIns {
-		log.Println("Deleteing tx output: ", txIn.TxId)
-		deleteUnspentTransaction(tx.Sender, txIn.TxId)
+	return bc.blocks[0].Hash
+}
+
+//Tip returns the last block of the current chain, or an empty block if the chain has no blocks yet
+func (bc *Blockchain) Tip() Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	if len(bc.blocks) == 0 {
+		return Block{}
 	}
-	for idx, txOut := range tx.TxOuts {
-		utx := UnspentTxOut{tx.Id, idx, txOut.Address, txOut.Amount}
-		log.Println("Created unspent tx out:", utx)
-		unspentTxOuts = append(unspentTxOuts, utx)
+	return bc.blocks[len(bc.blocks)-1]
+}
+
+//nextIndex gives the index of the next block on the current chain, expects caller to hold the lock
+func (bc *Blockchain) nextIndex() int {
+	return len(bc.blocks) + 1
+}
+
+//BlockByHash looks for the block with given hash in the current chain. returns false if not found
+func (bc *Blockchain) BlockByHash(hash string) (Block, bool) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	for _, block := range bc.blocks {
+		if block.Hash == hash {
+			return block, true
+		}
 	}
+	return Block{}, false
 }
 
 //check that the blockchain has a transaction with the given id
 //returns the index of matching (block, transaction) in the blockchain or -1, -1 if not found
-func findTransaction(txId string) (int, int) {
-	print("looking for txid:", txId)
-	for bIdx, block := range GlobalChain {
+func (bc *Blockchain) findTransaction(txId string) (int, int) {
+	for bIdx, block := range bc.blocks {
 		for tIdx, tx := range block.Transactions {
 			if tx.Id == txId {
 				return bIdx, tIdx
@@ -77,39 +151,6 @@ func findTransaction(txId string) (int, int) {
 	return -1, -1
 }
 
-//check that the blockchain has a given unspent transaction for the given public key (user)
-//returns the index of matching transaction in the list of that users unspent transactions or -1 if not found
-func findUnspentTransaction(pubKey string, txId string) int {
-	log.Println("Looking to find unspent tx, pubkey=:", pubKey, ", txid=", txId)
-	for idx, utx := range unspentTxOuts {
-		if utx.TxId == txId && utx.Address == pubKey {
-			log.Println("tx found at index:", idx)
-			return idx
-		}
-	}
-	log.Println("no matching tx found, returning -1")
-	return -1
-}
-
-//remove a transaction from the list of unspent transactions
-func deleteUnspentTransaction(pubKey string, txId string) bool {
-	log.Println("deleting tx, pubkey=", pubKey, ", txid=", txId)
-	idx := findUnspentTransaction(pubKey, txId)
-	if idx < 0 {
-		log.Println("no matching tx found")
-		return false
-	}
-	log.Println("matching tx found, removing it")
-
-	//val, _ := userTxMap[pubKey] //this would test for existtence of key
-	//https://stackoverflow.com/questions/21326109/why-are-lists-used-infrequently-in-go
-	//http://yourbasic.org/golang/three-dots-ellipsis/
-	//it seems "..." stands for "unpacking the slice", which is needed since append 2nd argument is varargs, not slice
-	unspentTxOuts = append(unspentTxOuts[:idx], unspentTxOuts[idx+1:]...)
-
-	return true
-}
-
 //https://stackoverflow.com/questions/15323767/does-golang-have-if-x-in-construct-similar-to-python#15323988
 func stringInSlice(a string, list []string) int {
 	for idx, b := range list {
@@ -120,37 +161,45 @@ func stringInSlice(a string, list []string) int {
 	return -1
 }
 
-//calculate hash string for the given block
+//calculate hash string for the given block. the hash is over the block header, see headerHash
 func hash(block *Block) string {
-	log.Println("hashing block:", block)
-	indexStr := strconv.Itoa(block.Index)
-	timeStr := strconv.FormatUint(uint64(block.Timestamp.Unix()), 16) //base 16 output
-	nonceStr := strconv.Itoa(block.Nonce)
-	diffStr := strconv.Itoa(block.Difficulty)
-	txBytes, _ := json.Marshal(block.Transactions)
-	txStr := string(txBytes)
-	//this joins all the block elements to one long string with all elements appended after another, to produce the hash
-	blockStr := strings.Join([]string{indexStr, block.PreviousHash, timeStr, diffStr, block.Data, txStr, nonceStr}, " ")
-	//	print(data)
-	bytes := []byte(blockStr)
-	hash := sha256.Sum256(bytes)
-	s := hex.EncodeToString(hash[:]) //encode the Hash as a hex-string. the [:] is slicing to match datatypes in args
-	log.Println("Created hash:", s)
-	return s
+	header := block.Header()
+	return headerHash(&header)
+}
+
+//headerHash calculates the hash string for the given block header
+func headerHash(header *BlockHeader) string {
+	return hashWithNonce(appendHeaderContent(nil, header), header.Nonce)
+}
+
+//hashPrefix gives the encoded header elements that go into the hash except the nonce, so mining only has to build this once
+func hashPrefix(block *Block) []byte {
+	header := block.Header()
+	return appendHeaderContent(nil, &header)
+}
+
+//hashWithNonce appends the nonce to given prefix from hashPrefix, and hashes the result
+func hashWithNonce(prefix []byte, nonce int) string {
+	hasher := sha256.New()
+	hasher.Write(prefix)
+	hasher.Write(binary.BigEndian.AppendUint64(nil, uint64(nonce)))
+	return hex.EncodeToString(hasher.Sum(nil)) //encode the Hash as a hex-string
 }
 
 //create genesis block, the first one on the chain to bootstrap the chain
-func createGenesisBlock(addToChain bool) Block {
+func (bc *Blockchain) createGenesisBlock(addToChain bool) Block {
 	log.Println("Creating genesis block")
-	cbTx := CreateCoinbaseTx(GenesisAddress)
+	cbTx := CreateCoinbaseTx(bc.genesis.Address, 1, 0)
 	txs := []Transaction{cbTx}
-	block := Block{1, "", "0", GenesisTime, "Teemu oli täällä", txs, 1, 1}
+	block := Block{1, "", "0", bc.genesis.Time, bc.genesis.Data, txs, MerkleRoot(txs), MAX_TARGET_BITS, 1}
 	hash := hash(&block)
 	block.Hash = hash
 	if addToChain {
 		log.Println("Adding genesis block to chain")
-		GlobalChain = append(GlobalChain, block)
-		addTransaction(cbTx)
+		err := bc.resetChain(block)
+		if err != nil {
+			log.Println("Failed to add genesis block:", err)
+		}
 	}
 	log.Println("Genesis block creation finished:", block)
 	return block
@@ -158,8 +207,8 @@ func createGenesisBlock(addToChain bool) Block {
 
 //check if the given block matches the genesis block.
 //since the genesis block has no previous block to compare, need to do separate check
-func checkGenesisBlock(block Block) bool {
-	genesis := createGenesisBlock(false)
+func (bc *Blockchain) checkGenesisBlock(block Block) bool {
+	genesis := bc.createGenesisBlock(false)
 	if block.Hash != genesis.Hash {
 		return false
 	}
@@ -179,92 +228,318 @@ func checkGenesisBlock(block Block) bool {
 	return true
 }
 
-//validate the overall chain, starting from genesis block all the way through the whole chain until the last block
-func validateChain(chain []Block) bool {
-	checkGenesisBlock(chain[0])
+//errors for the consensus rules a block can break. these are wrapped in a BlockValidationError with the details
+var (
+	ErrBadGenesis        = errors.New("genesis block does not match")
+	ErrBadIndex          = errors.New("index not in sequence")
+	ErrBadPreviousHash   = errors.New("previous hash does not match previous block")
+	ErrBadHash           = errors.New("hash does not match block content")
+	ErrBadMerkleRoot     = errors.New("merkle root does not match block transactions")
+	ErrBadTarget         = errors.New("target is not the expected one for this height")
+	ErrInsufficientWork  = errors.New("hash does not meet target")
+	ErrTimestampTooEarly = errors.New("timestamp not after median time past")
+	ErrTimestampTooLate  = errors.New("timestamp too far in the future")
+	ErrCoinbaseTooLarge  = errors.New("coinbase pays more than subsidy and fees")
+	ErrBadCoinbase       = errors.New("invalid coinbase")
+	ErrDuplicateTx       = errors.New("duplicate transaction")
+	ErrDoubleSpend       = errors.New("txout spent twice in block")
+	ErrMissingInput      = errors.New("txin does not refer to an unspent txout")
+)
+
+//validate the overall chain, starting from genesis block all the way through the whole chain until the last block.
+//returns a BlockValidationError for the first block that breaks a rule, wrapping the error for that rule
+func (bc *Blockchain) validateChain(chain []Block) error {
+	if len(chain) == 0 || !bc.checkGenesisBlock(chain[0]) {
+		return &BlockValidationError{1, "", ErrBadGenesis}
+	}
+	now := bc.clock.Now()
 	for i := 1; i < len(chain); i++ {
-		//validate index is in sequence and is +1 from previous block
-		thisIndex := chain[i].Index
-		prevIndex := chain[i-1].Index + 1
-		if thisIndex != prevIndex {
-			log.Println("Index issue at " + strconv.Itoa(i) + " - " + strconv.Itoa(thisIndex) + " vs " + strconv.Itoa(prevIndex))
-			return false
+		err := validateNextBlock(chain[:i], chain[i], now)
+		if err != nil {
+			log.Println("chain validation failed:", err)
+			return err
 		}
-		//validate that previous hash stored in this block matches the hash stored for previous block in chain
-		prevHash1 := chain[i].PreviousHash
-		prevHash2 := chain[i-1].Hash
-		if prevHash1 != prevHash2 {
-			log.Println("Hash mismatch at " + strconv.Itoa(i) + " - " + prevHash1 + " vs " + prevHash2)
-			return false
+	}
+	log.Println("chain validated")
+	return nil
+}
+
+//validateNextBlock checks that the given block is valid to be added after the last block of the given chain:
+//the header follows the chain (see validateNextHeader), and the merkle root in the header matches the block transactions,
+//so the header hash covers the transactions
+func validateNextBlock(chain []Block, block Block, now time.Time) error {
+	err := checkMerkleRoot(block)
+	if err != nil {
+		return err
+	}
+	return validateNextHeader(chain, block.Header(), now)
+}
+
+//checkMerkleRoot checks the merkle root of the block is calculated from its transactions
+func checkMerkleRoot(block Block) error {
+	if MerkleRoot(block.Transactions) != block.MerkleRoot {
+		return &BlockValidationError{block.Index, block.Hash, ErrBadMerkleRoot}
+	}
+	return nil
+}
+
+//create a block from the given parameters, and find a nonce to produce a hash matching the target for the next block
+//finally, append new block to current chain. returns an error if the block is not accepted to the chain.
+//uses a miner with a worker for each cpu, see MineBlock() for more control
+func (bc *Blockchain) CreateBlock(cbAddr string, newTxs []Transaction, blockData string) (Block, error) {
+	return bc.MineBlock(context.Background(), NewMiner(0), cbAddr, newTxs, blockData)
+}
+
+//MineBlock creates a block from the given parameters, uses the given miner to find the nonce, and adds the block to the chain.
+//the chain is not locked while mining. if another block is added to the chain meanwhile, mining stops with ErrTipChanged.
+//if the given context is cancelled, mining stops with the context error
+func (bc *Blockchain) MineBlock(ctx context.Context, miner *Miner, cbAddr string, newTxs []Transaction, blockData string) (Block, error) {
+	template, tipChanged := bc.newBlockTemplate(cbAddr, newTxs, blockData)
+	return bc.mineOnTip(ctx, miner, template, tipChanged)
+}
+
+//mineOnTip mines the given template and adds it to the chain, unless given tip channel is closed first
+func (bc *Blockchain) mineOnTip(ctx context.Context, miner *Miner, template Block, tipChanged <-chan struct{}) (Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-tipChanged:
+			cancel()
+		case <-ctx.Done():
 		}
-		//validate the hash stored in this block is a valid hash for this block
-		hash := hash(&chain[i])
-		if hash != chain[i].Hash {
-			log.Println("Hash mismatch with itself at index", i)
-			return false
+	}()
+	newBlock, err := miner.Mine(ctx, template)
+	if err != nil {
+		select {
+		case <-tipChanged:
+			return template, ErrTipChanged
+		default:
+			return template, err
 		}
 	}
-	log.Println("chain validated")
-	return true
+	bc.lock.Lock()
+	err = bc.addBlock(newBlock)
+	bc.lock.Unlock()
+	//			globalChain = append(globalChain, newBlock)
+	return newBlock, err
 }
 
-//create a block from the given parameters, and find a nonce to produce a hash matching the difficulty
-//finally, append new block to current chain
-func CreateBlock(cbAddr string, newTxs []Transaction, blockData string, difficulty int) Block {
-	cbTx := CreateCoinbaseTx(cbAddr)
-	txs := []Transaction{cbTx}
-	txs = append(txs, newTxs...)
-	log.Println("Creating new block, tx count = ", len(txs), "difficult=", difficulty, "block-data=", blockData)
-	chainLength := len(GlobalChain)
+//AddBlock adds a block received from elsewhere (e.g., a peer) on top of the current chain, if it is valid to follow the current last block
+func (bc *Blockchain) AddBlock(block Block) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.addBlock(block)
+}
+
+//TipChanged gives a channel that is closed when the next block is added to the chain, or the chain is replaced
+func (bc *Blockchain) TipChanged() <-chan struct{} {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.tipChanged
+}
+
+//notifyTipChanged wakes up everyone waiting on TipChanged, and creates a new channel for the next change
+func (bc *Blockchain) notifyTipChanged() {
+	close(bc.tipChanged)
+	bc.tipChanged = make(chan struct{})
+}
+
+//newBlockTemplate creates a block on top of the current chain with the given transactions, and the coinbase as first transaction.
+//the coinbase claims the fees of the transactions on top of the subsidy.
+//the merkle root, nonce and hash are left for mining to fill in. also gives the channel that is closed when the tip this template is on changes
+func (bc *Blockchain) newBlockTemplate(cbAddr string, newTxs []Transaction, blockData string) (Block, <-chan struct{}) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	chainLength := len(bc.blocks)
 	log.Println("current chain len:", chainLength)
-	previous := GlobalChain[chainLength-1]
+	previous := bc.blocks[chainLength-1]
 	index := previous.Index + 1
-	timestamp := time.Now().UTC()
-	nonce := 0
-	newBlock := Block{index, "", previous.Hash, timestamp, blockData, txs, difficulty, nonce}
-	log.Println("starting pow for block template:", newBlock)
-	for {
-		hash := hash(&newBlock)
-		newBlock.Hash = hash
-		//TODO: exit/update if peer finds hash
-		if verifyHashVsDifficulty(hash, difficulty) {
-			addBlock(newBlock)
-			log.Println("found pow hash:", hash)
-			//			globalChain = append(globalChain, newBlock)
-			return newBlock
-		}
-		nonce++
-		newBlock.Nonce = nonce
+	fees := 0
+	view := newUtxoView(bc.utxos, index)
+	for _, tx := range newTxs {
+		fees += txFee(tx, view)
+		view.apply(tx)
 	}
+	cbTx := CreateCoinbaseTx(cbAddr, index, fees)
+	txs := []Transaction{cbTx}
+	txs = append(txs, newTxs...)
+	//the timestamp has to be after the median time past, even if the clock is behind the previous blocks
+	timestamp := bc.clock.Now().UTC()
+	if medianTime := medianTimePast(bc.blocks); !timestamp.After(medianTime) {
+		timestamp = medianTime.Add(time.Nanosecond)
+	}
+	bits := bc.getNextBits()
+	log.Printf("Creating new block, tx count = %d, bits = %08x, block-data = %s", len(txs), bits, blockData)
+	return Block{index, "", previous.Hash, timestamp, blockData, txs, "", bits, 0}, bc.tipChanged
 }
 
-//add a new block to the existing chain
-func addBlock(block Block) {
-	chainLength := len(GlobalChain)
+//add a new block to the existing chain, if it is valid to follow the current last block and all the transactions in it are valid
+func (bc *Blockchain) addBlock(block Block) error {
+	chainLength := len(bc.blocks)
 	log.Println("adding block to chain. current height=", chainLength, ", block=", block)
-	previousBlock := GlobalChain[chainLength-1]
-	block.PreviousHash = previousBlock.Hash
-	GlobalChain = append(GlobalChain, block)
+	err := validateNextBlock(bc.blocks, block, bc.clock.Now())
+	if err != nil {
+		log.Println("rejecting block:", err)
+		return err
+	}
+	err = bc.verifyBlockTransactions(block)
+	if err != nil {
+		log.Println("rejecting block:", err)
+		return err
+	}
+	return bc.connectBlock(block)
+}
+
+//connectBlock appends the block to the chain and applies its transactions to the unspent txouts, without checking them.
+//used by addBlock after validation, and when rebuilding the unspent txouts from blocks validated before.
+//the block is stored before the unspent txouts are updated, so a crash between the two only means rebuilding the unspent txouts on restart
+func (bc *Blockchain) connectBlock(block Block) error {
+	err := bc.storage.AppendBlock(block)
+	if err != nil {
+		log.Println("failed to store block:", err)
+		return err
+	}
 	log.Println("Adding " + strconv.Itoa(len(block.Transactions)) + " transactions from block.")
+	err = applyBlockUtxos(bc.utxos, block)
+	if err != nil {
+		log.Println("failed to update unspent txouts:", err)
+		return err
+	}
+	bc.blocks = append(bc.blocks, block)
+	bc.notifyTipChanged()
+	bc.indexBlock(block)
+	bc.updateMempool(block)
+	return nil
+}
+
+//applyBlockUtxos applies the transactions of the block to the unspent txouts in the store, with the undo record for the block.
+//the block is applied all or nothing: if any transaction cannot be applied, the store is not changed
+func applyBlockUtxos(store UtxoStore, block Block) error {
+	view := newUtxoView(store, block.Index)
+	undo := BlockUndo{}
 	for _, tx := range block.Transactions {
-		addTransaction(tx)
+		spent, err := view.apply(tx)
+		if err != nil {
+			log.Println("Cannot apply block", block.Index, "to unspent txouts:", err)
+			return err
+		}
+		undo.Spent = append(undo.Spent, spent)
+	}
+	return store.Apply(UtxoUpdate{block.Hash, view.removed, view.added, block.Hash, &undo})
+}
+
+//verifyBlockTransactions checks all transactions in the block against the current unspent txouts.
+//the first transaction must be the coinbase for the block (see verifyCoinbase), all others must pass VerifyTransaction
+//and be final for the block (see checkFinal).
+//transactions are checked in order, so a transaction may spend txouts created earlier in the same block.
+//no txout may be spent twice and no transaction id repeated in the block, see checkBlockTx.
+//the coinbase may pay at most the subsidy and the fees of the other transactions
+func (bc *Blockchain) verifyBlockTransactions(block Block) error {
+	err := verifyCoinbase(block)
+	if err != nil {
+		return &BlockValidationError{block.Index, block.Hash, err}
+	}
+	view := newUtxoView(bc.utxos, block.Index)
+	txIds := make(map[string]bool)
+	spentBy := make(map[outPoint]string)
+	coinbase := block.Transactions[0]
+	fees := 0
+	for i, tx := range block.Transactions {
+		err := checkBlockTx(tx, view, txIds, spentBy)
+		if err == nil && i > 0 {
+			err = verifyTransaction(tx, view)
+		}
+		if err == nil {
+			err = checkFinal(tx, block.Index, bc.blocks, view)
+		}
+		if err != nil {
+			return &BlockValidationError{block.Index, block.Hash, err}
+		}
+		if i > 0 {
+			fees += txFee(tx, view)
+		}
+		view.apply(tx)
+	}
+	coinbaseOut := 0
+	for _, txOut := range coinbase.TxOuts {
+		coinbaseOut += txOut.Amount
+	}
+	subsidy := BlockSubsidy(block.Index)
+	if coinbaseOut > subsidy+fees {
+		err := fmt.Errorf("%w: %d, subsidy %d and fees %d", ErrCoinbaseTooLarge, coinbaseOut, subsidy, fees)
+		return &BlockValidationError{block.Index, block.Hash, err}
+	}
+	return nil
+}
+
+//checkBlockTx checks the transaction does not repeat the id of an earlier transaction in the block, or of one
+//with txouts still unspent in the chain, and that each of its txins spends an existing unspent txout not already
+//spent by an earlier transaction in the block. the ids and spent txouts of the block so far are kept in the given maps
+func checkBlockTx(tx Transaction, view *utxoView, txIds map[string]bool, spentBy map[outPoint]string) error {
+	if txIds[tx.Id] {
+		return fmt.Errorf("%w: %s appears twice in block", ErrDuplicateTx, tx.Id)
+	}
+	txIds[tx.Id] = true
+	for idx := range tx.TxOuts {
+		if _, found := view.get(tx.Id, idx); found {
+			return fmt.Errorf("%w: %s already has unspent txouts", ErrDuplicateTx, tx.Id)
+		}
+	}
+	if !isCoinbase(tx) {
+		for _, txIn := range tx.TxIns {
+			point := outPoint{txIn.TxId, txIn.TxIdx}
+			if other, found := spentBy[point]; found {
+				return fmt.Errorf("%w: (%s, %d) by %s and %s", ErrDoubleSpend, txIn.TxId, txIn.TxIdx, other, tx.Id)
+			}
+			if _, found := view.get(txIn.TxId, txIn.TxIdx); !found {
+				return fmt.Errorf("%w: (%s, %d) in %s", ErrMissingInput, txIn.TxId, txIn.TxIdx, tx.Id)
+			}
+			spentBy[point] = tx.Id
+		}
+	}
+	return nil
+}
+
+//verifyCoinbase checks the block has exactly one coinbase, as the first transaction, with the block index in its txin
+//so that its id is unique, and only valid txouts
+func verifyCoinbase(block Block) error {
+	if len(block.Transactions) == 0 || !isCoinbase(block.Transactions[0]) {
+		return fmt.Errorf("%w: first transaction is not a coinbase", ErrBadCoinbase)
+	}
+	coinbase := block.Transactions[0]
+	if coinbase.TxIns[0].TxIdx != block.Index {
+		return fmt.Errorf("%w: index %d in block %d", ErrBadCoinbase, coinbase.TxIns[0].TxIdx, block.Index)
+	}
+	if calculateTxId(coinbase) != coinbase.Id {
+		return fmt.Errorf("%w: id does not match content", ErrBadCoinbase)
+	}
+	for _, txOut := range coinbase.TxOuts {
+		err := checkTxOut(txOut)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadCoinbase, err)
+		}
+	}
+	for _, tx := range block.Transactions[1:] {
+		if isCoinbase(tx) {
+			return fmt.Errorf("%w: second coinbase %s", ErrBadCoinbase, tx.Id)
+		}
 	}
-	//todo: check block hash matches difficulty
+	return nil
 }
 
-func printBlock(block Block) {
-	fmt.Printf("block %d:%s %s %d %s\n", block.Index, block.Hash, block.Timestamp.String(), block.Difficulty, block.Data)
+func (bc *Blockchain) printBlock(block Block) {
+	fmt.Printf("block %d:%s %s %08x %s\n", block.Index, block.Hash, block.Timestamp.String(), block.Bits, block.Data)
 	//txStrs := make(map[string]int)
 	for txIdx, tx := range block.Transactions {
 		fmt.Printf("-tx: %d\n", txIdx)
-		if len(tx.TxIns) == 0 {
-			fmt.Print("--No txIn found, assuming coinbase tx.\n")
+		if isCoinbase(tx) {
+			fmt.Print("--Coinbase tx.\n")
 		} else {
 			for _, txIn := range tx.TxIns {
-				blockIdx, txIdx := findTransaction(txIn.TxId)
+				blockIdx, txIdx := bc.findTransaction(txIn.TxId)
 				fmt.Printf("--txin: block id = %d, txid = %d\n", blockIdx, txIdx)
-				txOut := GlobalChain[blockIdx].Transactions[txIdx]
-				fmt.Printf("---in from %s: (%s, %d)\n", txOut.Sender, txIn.TxId, txIn.TxIdx)
+				fmt.Printf("---in: (%s, %d) unlocked with %s\n", txIn.TxId, txIn.TxIdx, txIn.Script)
 			}
 		}
 		for _, txOut := range tx.TxOuts {
@@ -274,9 +549,11 @@ func printBlock(block Block) {
 	//	println()
 }
 
-func PrintChain(chain []Block) {
-	for _, block := range chain {
-		printBlock(block)
+func (bc *Blockchain) PrintChain() {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	for _, block := range bc.blocks {
+		bc.printBlock(block)
 	}
 }
 
@@ -313,166 +590,264 @@ func marshallDemarshallChain(chain []Block) {
 }
 
 //validate given chain, compare to current, and if new is longer replace current chain with new
-//returns true if new chain is selected
+//returns true if new chain is selected. takes the chain lock
 //matches the first version of blockchain from naivecoin tutorial:
 //https://lhartikk.github.io/jekyll/update/2017/07/14/chapter1.html
-func takeLongestChain(newChain []Block) bool {
+func (bc *Blockchain) takeLongestChain(newChain []Block) bool {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 	newLength := len(newChain)
-	oldLength := len(GlobalChain)
+	oldLength := len(bc.blocks)
 	log.Println("Comparing new chain vs old chain length:", newLength, " vs. ", oldLength)
-	fine := validateChain(newChain)
-	if !fine {
-		log.Println("New chain failed to validate, dropping it.")
+	err := bc.validateChain(newChain)
+	if err != nil {
+		log.Println("New chain failed to validate, dropping it:", err)
 		return false
 	}
 	if newLength > oldLength {
 		log.Println("New chain longer, replacing old.")
-		GlobalChain = newChain
+		return bc.reorganize(newChain) == nil
 	} else {
 		log.Println("New chain not longer, keeping old.")
 	}
 	return true
 }
 
-//replaces current global chain with new if new is valid and has higher diff
-//return true if new chain has higher difficulty than current global chain
+//TakeMostDifficultChain replaces current chain with new if new is valid and has more work (see calculateChainWork)
+//return true if the chain was switched. on equal work the current chain is kept. takes the chain lock
 //matches second version of blockchain from naivecoin tutorial:
 //https://lhartikk.github.io/jekyll/update/2017/07/13/chapter2.html
-func takeMostDifficultChain(newChain []Block) bool {
-	fine := validateChain(newChain)
-	if !fine {
-		log.Println("New chain validation failed, dropping it.")
+func (bc *Blockchain) TakeMostDifficultChain(newChain []Block) bool {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	err := bc.validateChain(newChain)
+	if err != nil {
+		log.Println("New chain validation failed, dropping it:", err)
 		return false
 	}
 
-	totalDiff1 := calculateChainDifficulty(GlobalChain)
-	totalDiff2 := calculateChainDifficulty(newChain)
+	totalWork1 := calculateChainWork(bc.blocks)
+	totalWork2 := calculateChainWork(newChain)
 
-	if totalDiff2 < totalDiff1 {
+	if totalWork2.Cmp(totalWork1) <= 0 {
 		log.Println("not switching chain")
 		return false
 	}
 	log.Println("switching chain to more difficult")
-	GlobalChain = newChain
-	return true
+	return bc.reorganize(newChain) == nil
 }
 
-func calculateChainDifficulty(chain []Block) float64 {
-	totalDiff := 0.0
-	for i := 0; i < len(chain); i++ {
-		totalDiff += math.Pow((float64(chain[i].Difficulty)), 2)
+//replaceChain resets the chain state and adds the given blocks one by one, so each block is verified against the previous ones.
+//transactions in the mempool are re-submitted after, keeping the ones still valid on the new chain
+func (bc *Blockchain) replaceChain(newChain []Block) error {
+	pending := bc.mempool
+	bc.mempool = nil
+	defer func() {
+		for _, tx := range pending {
+			if bc.addToMempool(tx) != nil {
+				log.Println("Dropped transaction after chain change:", tx.Id)
+			}
+		}
+	}()
+	//the genesis block has only the coinbase, rest are added one by one
+	err := bc.resetChain(newChain[0])
+	if err != nil {
+		return err
 	}
-	log.Println("Calculated chain difficulty:", totalDiff)
-	return totalDiff
+	for _, block := range newChain[1:] {
+		err := bc.addBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//resetChain clears the chain state and starts it over from the given genesis block
+func (bc *Blockchain) resetChain(genesis Block) error {
+	err := bc.storage.AppendBlock(genesis)
+	if err != nil {
+		return err
+	}
+	err = rebuildUtxos(bc.utxos, []Block{genesis})
+	if err != nil {
+		return err
+	}
+	bc.blocks = []Block{genesis}
+	bc.index = nil
+	bc.indexBlock(genesis)
+	bc.notifyTipChanged()
+	return nil
 }
 
 //create a test chain of given length (genesis + length)
-func CreateTestChain(cbAddr string, size int) []Block {
-	createGenesisBlock(true)
+func (bc *Blockchain) CreateTestChain(cbAddr string, size int) []Block {
+	bc.lock.Lock()
+	bc.createGenesisBlock(true)
+	bc.lock.Unlock()
 	for i := 0; i < size; i++ {
 		data := fmt.Sprintf("Test%d", i+2) //+1 for coinbase, +1 for start at 1 vs 0
-		CreateBlock(cbAddr, nil, data, 0)
+		bc.CreateBlock(cbAddr, nil, data)
 	}
-	return GlobalChain
+	return bc.Blocks()
 }
 
-func WriteBlockChain() {
-	log.Println("Starting to write blockchain to disk")
-	chainJson := JsonChain(GlobalChain)
-	err := os.MkdirAll(chainPath, os.ModePerm)
-	log.Println("File path created/found, " + chainPath)
-	f, err := os.Create(chainPath + chainFileName)
-	log.Println("Done OK, now to write.., " + chainPath)
+//WriteBlockChain writes the current chain to the storage.
+//blocks are stored as they are connected, so this only rewrites what is there already
+func (bc *Blockchain) WriteBlockChain() error {
+	log.Println("Starting to write blockchain to storage")
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	err := bc.storage.WriteBlocks(bc.blocks)
 	if err != nil {
-		fmt.Println("error", err)
-		return
+		log.Println("error writing blockchain:", err)
 	}
-	defer f.Close()
-
-	f.WriteString(chainJson)
+	return err
 }
 
-func InitBlockChain() bool {
-	err := os.MkdirAll(chainPath, os.ModePerm)
-	_, err = os.Stat(chainPath + chainFileName)
+//InitBlockChain loads the chain from storage if one is found there.
+//returns true if a chain was loaded
+func (bc *Blockchain) InitBlockChain() bool {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 	loaded := false
-	if os.IsNotExist(err) {
-		log.Println("No blockchain file found.")
-		//TODO: start downloading chain
+	if !bc.storage.Exists() {
+		//nothing to resume from, the chain is built or synced from peers (see net/peersync.go) from the genesis block
+		log.Println("No stored blockchain found.")
 	} else {
-		// file/dir with chain path already exists
-		readBlockChain()
+		err := bc.readBlockChain()
+		if err != nil {
+			log.Println(err)
+			panic("Invalid chain loaded, exit")
+		}
 		loaded = true
 	}
 	return loaded
 }
 
-//TODO: test to read and write blockchain, validate balance and unspent-tx etc counts after
-//readBlockChain() reads the chain from disk.
-func readBlockChain() {
-	fullPath := chainPath + chainFileName
-	log.Println("Reading blockchain from disk, path = " + fullPath)
-	bytes, err := ioutil.ReadFile(fullPath)
+//readBlockChain() reads the chain from storage.
+//the blocks were validated before they were stored, so the proof of work and signatures are not checked again.
+//only the genesis block and the links between the blocks are checked, to catch a storage from another chain or a broken index.
+//if the stored unspent txouts are for the last stored block, they are used as they are. otherwise, e.g. if the node stopped
+//after storing a block but before updating the unspent txouts for it, they are rebuilt from the blocks
+func (bc *Blockchain) readBlockChain() error {
+	log.Println("Reading blockchain from storage")
+	loadedChain, err := bc.storage.ReadBlocks()
 	if err != nil {
-		fmt.Println(err)
-		//TODO: panic?
-	}
-	//convert bytes in file to golang objecs in the chain
-	json.Unmarshal(bytes, &GlobalChain)
-	//a slice is passed as copy of header, so this does not copy the whole array
-	//https://stackoverflow.com/questions/39993688/are-golang-slices-pass-by-value#39993797
-	valid := validateChain(GlobalChain)
-	if !valid {
-		panic("Invalid chain loaded, exit")
-	}
-	for _, block := range GlobalChain {
-		for _, tx := range block.Transactions {
-			addTransaction(tx)
+		return err
+	}
+	if len(loadedChain) == 0 {
+		return fmt.Errorf("no blocks found in storage")
+	}
+	if !bc.checkGenesisBlock(loadedChain[0]) {
+		return &BlockValidationError{1, loadedChain[0].Hash, ErrBadGenesis}
+	}
+	for i := 1; i < len(loadedChain); i++ {
+		block := loadedChain[i]
+		prevBlock := loadedChain[i-1]
+		if block.Index != prevBlock.Index+1 {
+			return &BlockValidationError{block.Index, block.Hash, ErrBadIndex}
 		}
+		if block.PreviousHash != prevBlock.Hash {
+			return &BlockValidationError{block.Index, block.Hash, ErrBadPreviousHash}
+		}
+	}
+	tip := loadedChain[len(loadedChain)-1]
+	utxoTip, err := bc.utxos.Tip()
+	if err != nil {
+		return err
+	}
+	if utxoTip != tip.Hash {
+		log.Println("Unspent txouts are for block", utxoTip, "instead of", tip.Hash, ", rebuilding them from blocks")
+		err = rebuildUtxos(bc.utxos, loadedChain)
+		if err != nil {
+			return err
+		}
+	}
+	bc.blocks = loadedChain
+	bc.index = nil
+	for _, block := range loadedChain {
+		bc.indexBlock(block)
 	}
+	bc.notifyTipChanged()
+	log.Println("Loaded chain with tip", tip.Index, tip.Hash)
+	return nil
+}
+
+//Close closes the storage of the chain
+func (bc *Blockchain) Close() error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.storage.Close()
 }
 
 //findTxInsFor looks for unspent txouts for the given address to match the amount wanting to spend
-func findTxInsFor(address string, amount int) ([]TxIn, int) {
+//txouts spent by transactions in the mempool are skipped, and txouts created by them can be used.
+//coinbase txouts not mature for the next block are skipped as well.
+//if the address does not have enough, gives all the txouts found and their total, which is less than the amount
+func (bc *Blockchain) findTxInsFor(address string, amount int) ([]TxIn, int) {
 	log.Print("Searching for unspent txOuts for " + address + ", to amount of " + strconv.Itoa(amount))
 	balance := 0
 	var unspents []TxIn
-	for _, val := range unspentTxOuts {
-		if val.Address == address {
-			balance += val.Amount
-			txIn := TxIn{val.TxId, val.TxIdx}
-			unspents = append(unspents, txIn)
+	view := bc.mempoolView()
+	for _, val := range view.forAddress(address) {
+		if !view.mature(val) {
+			log.Println("Skipping immature coinbase txout:", val.TxId, val.TxIdx)
+			continue
 		}
+		balance += val.Amount
+		txIn := TxIn{TxId: val.TxId, TxIdx: val.TxIdx}
+		unspents = append(unspents, txIn)
 		if balance >= amount {
 			log.Print("Found unspent txOuts: ", unspents, ", total funds = "+strconv.Itoa(balance))
 			return unspents, balance
 		}
 	}
 	log.Print("Did not find suffient funds for " + address + ", requested " + strconv.Itoa(amount) + ", found " + strconv.Itoa(balance))
-	return nil, -1
+	return unspents, balance
 }
 
 //balanceFor counts the unspent balance for given address (as count of unspent txouts)
 //address parameter given is the base58 encoded public key
-func BalanceFor(address string) int {
+func (bc *Blockchain) BalanceFor(address string) int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
 	log.Print("Calculating balance for address:" + address)
-	log.Printf("Number of unspent tx-out: %d", len(unspentTxOuts))
+	utxos, err := bc.utxos.ForAddress(address)
+	if err != nil {
+		log.Println("Failed to read unspent txouts:", err)
+	}
+	log.Printf("Number of unspent tx-out: %d", len(utxos))
 	balance := 0
-	for _, val := range unspentTxOuts {
-		if val.Address == address {
-			balance += val.Amount
-		}
+	for _, val := range utxos {
+		balance += val.Amount
 	}
 	log.Print("Balance for " + address + " = " + strconv.Itoa(balance))
 	return balance
 }
 
+//ImmatureBalanceFor counts the part of the balance for given address that is in coinbase txouts not mature yet.
+//these are included in BalanceFor, but can not be spent before enough blocks are added on top (see COINBASE_MATURITY)
+func (bc *Blockchain) ImmatureBalanceFor(address string) int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	view := newUtxoView(bc.utxos, bc.nextIndex())
+	immature := 0
+	for _, utxo := range view.forAddress(address) {
+		if !view.mature(utxo) {
+			immature += utxo.Amount
+		}
+	}
+	return immature
+}
+
 //splitTxIns produces two txouts, by taking the total sum of txins and the amount to send
-//and splitting this to one txout for the coins to send, and another for the remains to send back to self
-func SplitTxIns(from string, to string, toSend int, total int) []TxOut {
+//and splitting this to one txout for the coins to send, and another for the remains to send back to self.
+//the fee is left out of the txouts, so the miner can claim it
+func SplitTxIns(from string, to string, toSend int, fee int, total int) []TxOut {
 	log.Print("Creating txIn splits for transaction from " + from + " to " + to)
-	diff := total - toSend
-	txOut := TxOut{to, toSend}
+	diff := total - toSend - fee
+	txOut := TxOutTo(to, toSend)
 	var txOuts []TxOut
 	txOuts = append(txOuts, txOut)
 	if diff == 0 {
@@ -480,7 +855,7 @@ func SplitTxIns(from string, to string, toSend int, total int) []TxOut {
 		return txOuts
 	}
 	log.Print("created sending txout and change txout:", txOuts)
-	txOut2 := TxOut{from, diff}
+	txOut2 := TxOutTo(from, diff)
 	txOuts = append(txOuts, txOut2)
 	return txOuts
 }
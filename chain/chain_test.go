@@ -1,70 +1,229 @@
 package chain
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/mukatee/go-naive/cryptoff"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 //https://stackoverflow.com/questions/22811138/print-the-address-of-slice-in-golang
 
+//most tests spend coinbases right after mining them, the tests for the maturity set COINBASE_MATURITY themselves
+func TestMain(m *testing.M) {
+	COINBASE_MATURITY = 0
+	os.Exit(m.Run())
+}
+
+//newTestChain creates an empty in-memory chain with the default genesis parameters
+func newTestChain() *Blockchain {
+	return NewBlockchain(DefaultGenesis, NewMemoryStorage())
+}
+
 func TestTakeLongest(t *testing.T) {
 	//create test chains, check if it changes to longest, ...
-	GlobalChain = nil
-	chain1 := CreateTestChain(10)
-	GlobalChain = nil
-	chain2 := CreateTestChain(16)
+	chain1 := newTestChain().CreateTestChain(GenesisAddress, 10)
+	chain2 := newTestChain().CreateTestChain(GenesisAddress, 16)
 	assert.Equal(t, 11, len(chain1))
 	assert.Equal(t, 17, len(chain2))
-	GlobalChain = chain1
-	assert.Equal(t, 11, len(GlobalChain))
-	takeLongestChain(chain2)
-	assert.Equal(t, 17, len(GlobalChain))
+	bc := newTestChain()
+	setTestChain(t, bc, chain1)
+	assert.Equal(t, 11, len(bc.blocks))
+	bc.takeLongestChain(chain2)
+	assert.Equal(t, 17, len(bc.blocks))
 }
 
 func TestTakeMostDifficult(t *testing.T) {
-	//create test chains, check that it changes to the one with the highest difficulty
-	GlobalChain = nil
-	chain1 := createTestDiffChain(10, 1, 1, 1)
-	GlobalChain = nil
-	chain2 := createTestDiffChain(10, 1, 2, 3)
-	diff1 := calculateChainDifficulty(chain1)
-	diff2 := calculateChainDifficulty(chain2)
-	GlobalChain = chain1
-	println("diffs:", diff1, " ", diff2)
-	takeMostDifficultChain(chain2)
-	gDiff := calculateChainDifficulty(GlobalChain)
-	println("diffs:", diff1, " ", diff2, " ", gDiff)
-	if diff1 > diff2 {
-		assert.Equal(t, diff1, gDiff)
-	} else {
-		assert.Equal(t, diff2, gDiff)
+	//create test chains, check that it changes to the one with the most work even if it is shorter.
+	//blocks in the fast chain are found quicker than expected, so its target gets smaller (harder) after first adjustment
+	fastChain := createTestTimedChain(t, 12, time.Second)
+	slowChain := createTestTimedChain(t, 13, 100*time.Second)
+	assert.True(t, fastChain[12].Bits < slowChain[12].Bits, "Fast chain should have a harder target after adjustment")
+	work1 := calculateChainWork(fastChain)
+	work2 := calculateChainWork(slowChain)
+	assert.Equal(t, 1, work1.Cmp(work2), "Fast chain should have more work")
+
+	bc := newTestChain()
+	setTestChain(t, bc, slowChain)
+	assert.True(t, bc.TakeMostDifficultChain(fastChain))
+	assert.Equal(t, fastChain, bc.blocks)
+	assert.False(t, bc.TakeMostDifficultChain(slowChain))
+	assert.Equal(t, fastChain, bc.blocks)
+
+	//but the longest chain is still the slow one
+	bc.takeLongestChain(slowChain)
+	assert.Equal(t, slowChain, bc.blocks)
+}
+
+//createTestTimedChain creates a chain of genesis + size blocks, with the block timestamps the given interval apart
+func createTestTimedChain(t *testing.T, size int, interval time.Duration) []Block {
+	bc := newTestChain()
+	bc.CreateTestChain(GenesisAddress, 0)
+	timestamp := GenesisTime
+	for i := 0; i < size; i++ {
+		timestamp = timestamp.Add(interval)
+		addTestBlockAt(t, bc, timestamp)
 	}
-	//	diff1Str := strconv.FormatFloat(diff1, 'f', 2, 64)
-	//	println("diff1: ", diff1Str)
-	//	diff2Str := strconv.FormatFloat(diff2, 'f', 2, 64)
-	//	println("diff2: ", diff2Str)
+	return bc.blocks
+}
+
+//setTestChain loads the given blocks as the chain, with the unspent txouts and undo data built from them
+func setTestChain(t *testing.T, bc *Blockchain, blocks []Block) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	assert.NoError(t, bc.replaceChain(blocks))
+}
+
+//allUtxos gives all unspent txouts in the store of the chain
+func allUtxos(t *testing.T, bc *Blockchain) []UnspentTxOut {
+	utxos, err := bc.utxos.All()
+	assert.NoError(t, err)
+	return utxos
+}
+
+//mineBlock finds the nonce for given block with a single worker
+func mineBlock(block Block) Block {
+	mined, _ := NewMiner(1).Mine(context.Background(), block)
+	return mined
+}
+
+//addTestBlockAt mines a block with the given timestamp on top of given chain, to simulate blocks found at different speeds
+func addTestBlockAt(t *testing.T, bc *Blockchain, timestamp time.Time) Block {
+	block, _ := bc.newBlockTemplate(GenesisAddress, nil, fmt.Sprintf("Test%d", bc.Height()+1))
+	block.Timestamp = timestamp
+	block = mineBlock(block)
+	bc.lock.Lock()
+	err := bc.addBlock(block)
+	bc.lock.Unlock()
+	assert.NoError(t, err)
+	return block
+}
+
+//two chains in the same process should not see each others blocks or balances
+func TestSeparateChains(t *testing.T) {
+	bc1 := newTestChain()
+	bc2 := newTestChain()
+	bc1.CreateTestChain("address1", 3)
+	bc2.CreateTestChain("address2", 1)
+	assert.Equal(t, 4, bc1.Height())
+	assert.Equal(t, 2, bc2.Height())
+	assert.Equal(t, 3*INITIAL_SUBSIDY, bc1.BalanceFor("address1"))
+	assert.Equal(t, 0, bc1.BalanceFor("address2"))
+	assert.Equal(t, INITIAL_SUBSIDY, bc2.BalanceFor("address2"))
+	assert.Equal(t, 0, bc2.BalanceFor("address1"))
+}
+
+//write a chain to storage, read it into a new chain, and check the blocks and balances match
+func TestWriteAndReadChain(t *testing.T) {
+	storage := NewMemoryStorage()
+	bc1 := NewBlockchain(DefaultGenesis, storage)
+	assert.False(t, bc1.InitBlockChain())
+	bc1.CreateTestChain("address1", 3)
+	assert.NoError(t, bc1.WriteBlockChain())
+
+	bc2 := NewBlockchain(DefaultGenesis, storage)
+	assert.True(t, bc2.InitBlockChain())
+	assert.Equal(t, bc1.Blocks(), bc2.Blocks())
+	assert.Equal(t, allUtxos(t, bc1), allUtxos(t, bc2))
+	assert.Equal(t, bc1.BalanceFor("address1"), bc2.BalanceFor("address1"))
 }
 
-func createTestDiffChain(size int, diffs ...int) []Block {
-	CreateTestChain(size)
-	for i := 1; i <= size; i++ {
-		GlobalChain[i].Difficulty = 10
-		//previous hash is also used for block hash so have to re-set it before calculating hash
-		GlobalChain[i].PreviousHash = GlobalChain[i-1].Hash
-		hash := hash(&GlobalChain[i])
-		GlobalChain[i].Hash = hash
+//mine, send and query in parallel, to check with "go test -race" that chain access is guarded
+func TestParallelMineAndQuery(t *testing.T) {
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 2)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			_, err := bc.CreateBlock(address, nil, "parallel")
+			assert.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			assert.True(t, bc.BalanceFor(address) >= 2*INITIAL_SUBSIDY)
+			blocks := bc.Blocks()
+			assert.NoError(t, bc.validateChain(blocks))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			_, err := bc.SendCoins(privKey, "receiver", 10, 0)
+			assert.NoError(t, err)
+			bc.Mempool()
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, 8, bc.Height())
+	assert.Equal(t, 7*INITIAL_SUBSIDY, bc.BalanceFor(address))
+}
+
+//break each consensus rule in a copy of a valid chain, and check validation fails for that rule
+func TestValidateChainRules(t *testing.T) {
+	//a chain long enough to have one difficulty adjustment
+	valid := createTestTimedChain(t, 12, time.Second)
+	bc := newTestChain()
+	assert.NoError(t, bc.validateChain(valid))
+
+	//rebuild returns a copy of the valid chain, with block at idx changed by given function and re-mined.
+	//blocks with no valid target cannot be mined, so those just get their hash re-calculated
+	rebuild := func(idx int, change func(block *Block)) []Block {
+		chain := append([]Block{}, valid[:idx+1]...)
+		change(&chain[idx])
+		if chain[idx].Bits == 0 {
+			chain[idx].Hash = hash(&chain[idx])
+		} else {
+			chain[idx] = mineBlock(chain[idx])
+		}
+		return chain
 	}
-	println()
-	for x := 0; x < len(diffs); x++ {
-		idx := size + x + 1
-		data := fmt.Sprintf("Test%d", x)
-		CreateBlock(nil, data, 0)
-		GlobalChain[idx].Difficulty = diffs[x]
-		GlobalChain[idx].PreviousHash = GlobalChain[idx-1].Hash
-		hash := hash(&GlobalChain[idx])
-		GlobalChain[idx].Hash = hash
+	tests := []struct {
+		name  string
+		chain []Block
+		rule  error
+	}{
+		{"genesis", rebuild(0, func(b *Block) { b.Data = "other genesis" }), ErrBadGenesis},
+		{"index", rebuild(5, func(b *Block) { b.Index = 7 }), ErrBadIndex},
+		{"previous hash", rebuild(5, func(b *Block) { b.PreviousHash = valid[3].Hash }), ErrBadPreviousHash},
+		{"easier target", rebuild(11, func(b *Block) { b.Bits = MAX_TARGET_BITS }), ErrBadTarget},
+		{"zero target", rebuild(5, func(b *Block) { b.Bits = 0 }), ErrBadTarget},
+		{"too early", rebuild(5, func(b *Block) { b.Timestamp = valid[4].Timestamp.Add(-2 * time.Minute) }), ErrTimestampTooEarly},
+		{"at median time", rebuild(5, func(b *Block) { b.Timestamp = valid[2].Timestamp }), ErrTimestampTooEarly},
+		{"too late", rebuild(5, func(b *Block) { b.Timestamp = time.Now().Add(time.Hour) }), ErrTimestampTooLate},
 	}
-	println()
-	return GlobalChain
+	for _, test := range tests {
+		err := bc.validateChain(test.chain)
+		assert.True(t, errors.Is(err, test.rule), "%s: expected %v, got %v", test.name, test.rule, err)
+		var blockErr *BlockValidationError
+		assert.True(t, errors.As(err, &blockErr), test.name)
+	}
+
+	//content changed after mining
+	changed := append([]Block{}, valid...)
+	changed[5].Data = "changed"
+	assert.True(t, errors.Is(bc.validateChain(changed), ErrBadHash))
+
+	//hash not meeting the target. the harder blocks after adjustment need a few tries, so look for a nonce that fails
+	weak := append([]Block{}, valid...)
+	for weak[12].Nonce = 0; verifyHashVsTarget(hash(&weak[12]), weak[12].Bits); weak[12].Nonce++ {
+	}
+	weak[12].Hash = hash(&weak[12])
+	assert.True(t, errors.Is(bc.validateChain(weak), ErrInsufficientWork))
+
+	//invalid chains from peers should not replace the current one
+	setTestChain(t, bc, valid[:5])
+	assert.False(t, bc.TakeMostDifficultChain(changed))
+	assert.False(t, bc.takeLongestChain(weak))
+	assert.Equal(t, valid[:5], bc.blocks)
 }
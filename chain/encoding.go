@@ -0,0 +1,266 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//blocks and transactions have a canonical binary encoding, used for block hashes, transaction ids, the block files
+//and sending them to peers. the same content always encodes to the same bytes, and every variable length field is
+//length-prefixed, so two different contents never encode to the same bytes.
+//
+//integers are big-endian: lengths, counts and block bits are 4 bytes, other integers 8 bytes signed.
+//a string is its length followed by its bytes. a timestamp is the unix time in nanoseconds.
+//
+//transaction: version (1 byte), txin count, txins (txid, txidx, unlocking script, relative lock), txout count,
+//txouts (amount, locking script), lock time, id.
+//a script is encoded as a string of its bytes, and the address of a txout is not encoded as it comes from its script
+//block: version (1 byte), index, previous hash, timestamp, bits, data, merkle root, transaction count, transactions, nonce, hash
+//header: version (1 byte), index, previous hash, timestamp, bits, data, merkle root, nonce
+//
+//the transaction id is the sha256 of the encoding up to the id, and the block hash the sha256 of the header
+//encoding. so both commit to the encoding version and all the content. the block carries the merkle root of its header,
+//so it is calculated only when the block is mined or received. headers are sent to peers with their hash after the nonce.
+//
+//version 2 moved the signature from the transaction to each txin, with the public key of the owner of the spent txout.
+//version 3 replaced those with the unlocking script of the txin, and the txout address with its locking script.
+//version 4 added the lock time of the transaction and the relative lock of each txin.
+//version 5 added the merkle root to the block
+
+const ENCODING_VERSION byte = 5 //version written at the start of each encoded block and transaction
+
+//ErrBadEncoding is returned when decoding bytes that are not a valid encoding
+var ErrBadEncoding = errors.New("invalid encoding")
+
+//ErrUnknownVersion is returned when decoding bytes encoded with a version this node does not know
+var ErrUnknownVersion = errors.New("unknown encoding version")
+
+func appendUint32(buf []byte, value int) []byte {
+	return binary.BigEndian.AppendUint32(buf, uint32(value))
+}
+
+func appendInt64(buf []byte, value int64) []byte {
+	return binary.BigEndian.AppendUint64(buf, uint64(value))
+}
+
+func appendString(buf []byte, value string) []byte {
+	return append(appendUint32(buf, len(value)), value...)
+}
+
+func appendBytes(buf []byte, value []byte) []byte {
+	return append(appendUint32(buf, len(value)), value...)
+}
+
+//appendTxContent encodes the part of the transaction the id is calculated from, everything except the id
+func appendTxContent(buf []byte, tx Transaction) []byte {
+	buf = append(buf, ENCODING_VERSION)
+	buf = appendUint32(buf, len(tx.TxIns))
+	for _, txIn := range tx.TxIns {
+		buf = appendString(buf, txIn.TxId)
+		buf = appendInt64(buf, int64(txIn.TxIdx))
+		buf = appendBytes(buf, txIn.Script)
+		buf = appendUint32(buf, txIn.RelativeLock)
+	}
+	buf = appendUint32(buf, len(tx.TxOuts))
+	for _, txOut := range tx.TxOuts {
+		buf = appendInt64(buf, int64(txOut.Amount))
+		buf = appendBytes(buf, txOut.Script)
+	}
+	return appendInt64(buf, int64(tx.LockTime))
+}
+
+func appendTransaction(buf []byte, tx Transaction) []byte {
+	buf = appendTxContent(buf, tx)
+	return appendString(buf, tx.Id)
+}
+
+//EncodeTransaction gives the canonical binary encoding of the transaction
+func EncodeTransaction(tx Transaction) []byte {
+	return appendTransaction(nil, tx)
+}
+
+//appendHeaderContent encodes the header for the block hash, except the nonce
+func appendHeaderContent(buf []byte, header *BlockHeader) []byte {
+	buf = append(buf, ENCODING_VERSION)
+	buf = appendInt64(buf, int64(header.Index))
+	buf = appendString(buf, header.PreviousHash)
+	buf = appendInt64(buf, header.Timestamp.UnixNano())
+	buf = binary.BigEndian.AppendUint32(buf, header.Bits)
+	buf = appendString(buf, header.Data)
+	return appendString(buf, header.MerkleRoot)
+}
+
+//EncodeHeader gives the canonical binary encoding of the header: the encoding the block hash is calculated from, and the hash
+func EncodeHeader(header BlockHeader) []byte {
+	buf := appendHeaderContent(nil, &header)
+	buf = appendInt64(buf, int64(header.Nonce))
+	return appendString(buf, header.Hash)
+}
+
+//EncodeBlock gives the canonical binary encoding of the block
+func EncodeBlock(block Block) []byte {
+	buf := append([]byte{}, ENCODING_VERSION)
+	buf = appendInt64(buf, int64(block.Index))
+	buf = appendString(buf, block.PreviousHash)
+	buf = appendInt64(buf, block.Timestamp.UnixNano())
+	buf = binary.BigEndian.AppendUint32(buf, block.Bits)
+	buf = appendString(buf, block.Data)
+	buf = appendString(buf, block.MerkleRoot)
+	buf = appendUint32(buf, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		buf = appendTransaction(buf, tx)
+	}
+	buf = appendInt64(buf, int64(block.Nonce))
+	return appendString(buf, block.Hash)
+}
+
+//decoder reads the fields of an encoding in order. the first error is kept and later reads do nothing
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *decoder) next(size int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < size {
+		d.fail("need %d bytes, %d left", size, len(d.data))
+		return nil
+	}
+	bytes := d.data[:size]
+	d.data = d.data[size:]
+	return bytes
+}
+
+func (d *decoder) version() {
+	bytes := d.next(1)
+	if d.err == nil && bytes[0] != ENCODING_VERSION {
+		d.err = fmt.Errorf("%w: %d", ErrUnknownVersion, bytes[0])
+	}
+}
+
+func (d *decoder) uint32() uint32 {
+	bytes := d.next(4)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(bytes)
+}
+
+func (d *decoder) int64() int64 {
+	bytes := d.next(8)
+	if d.err != nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(bytes))
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint32())))
+}
+
+//script reads a script as written by appendBytes. an empty one is nil, as in a transaction created in memory
+func (d *decoder) script() Script {
+	bytes := d.next(int(d.uint32()))
+	if len(bytes) == 0 {
+		return nil
+	}
+	return append(Script{}, bytes...)
+}
+
+//count reads the number of items that follow. each item takes at least minSize bytes,
+//so a count that could not fit in the bytes left is an error instead of a huge allocation
+func (d *decoder) count(minSize int) int {
+	count := int(d.uint32())
+	if d.err == nil && count*minSize > len(d.data) {
+		d.fail("count %d does not fit in %d bytes", count, len(d.data))
+		return 0
+	}
+	return count
+}
+
+//end checks all bytes were read
+func (d *decoder) end() {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d extra bytes", len(d.data))
+	}
+}
+
+func (d *decoder) transaction() Transaction {
+	var tx Transaction
+	d.version()
+	//nil instead of empty slices, as decoding the json of a transaction gives
+	for i, count := 0, d.count(20); i < count; i++ {
+		tx.TxIns = append(tx.TxIns, TxIn{d.string(), int(d.int64()), d.script(), int(d.uint32())})
+	}
+	for i, count := 0, d.count(12); i < count; i++ {
+		amount := int(d.int64())
+		script := d.script()
+		tx.TxOuts = append(tx.TxOuts, TxOut{ScriptAddress(script), amount, script})
+	}
+	tx.LockTime = int(d.int64())
+	tx.Id = d.string()
+	return tx
+}
+
+//DecodeTransaction reads a transaction from its canonical binary encoding
+func DecodeTransaction(data []byte) (Transaction, error) {
+	d := decoder{data: data}
+	tx := d.transaction()
+	d.end()
+	return tx, d.err
+}
+
+//DecodeBlock reads a block from its canonical binary encoding
+func DecodeBlock(data []byte) (Block, error) {
+	var block Block
+	d := decoder{data: data}
+	d.version()
+	block.Index = int(d.int64())
+	block.PreviousHash = d.string()
+	block.Timestamp = time.Unix(0, d.int64()).UTC()
+	block.Bits = d.uint32()
+	block.Data = d.string()
+	block.MerkleRoot = d.string()
+	for i, count := 0, d.count(1); i < count; i++ {
+		block.Transactions = append(block.Transactions, d.transaction())
+	}
+	block.Nonce = int(d.int64())
+	block.Hash = d.string()
+	d.end()
+	return block, d.err
+}
+
+//DecodeHeader reads a block header from its canonical binary encoding
+func DecodeHeader(data []byte) (BlockHeader, error) {
+	var header BlockHeader
+	d := decoder{data: data}
+	d.version()
+	header.Index = int(d.int64())
+	header.PreviousHash = d.string()
+	header.Timestamp = time.Unix(0, d.int64()).UTC()
+	header.Bits = d.uint32()
+	header.Data = d.string()
+	header.MerkleRoot = d.string()
+	header.Nonce = int(d.int64())
+	header.Hash = d.string()
+	d.end()
+	return header, d.err
+}
+
+//calculateTxId hashes the encoded transaction content, and encodes the hash into a hex-string
+func calculateTxId(tx Transaction) string {
+	hash := sha256.Sum256(appendTxContent(nil, tx))
+	return hex.EncodeToString(hash[:])
+}
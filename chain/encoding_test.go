@@ -0,0 +1,130 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//testEncodingTx and testEncodingBlock are fixed content for the golden encodings below
+func testEncodingTx() Transaction {
+	tx := Transaction{"", []TxIn{{"prevtx", 1, Script("sig"), 5}}, []TxOut{TxOutTo("receiver", 300), TxOutTo("sender", 700)}, 150}
+	tx.Id = calculateTxId(tx)
+	return tx
+}
+
+func testEncodingBlock() Block {
+	txs := []Transaction{testEncodingTx()}
+	block := Block{2, "", "prevhash", time.Date(2018, 10, 1, 12, 0, 0, 5, time.UTC), "data", txs, MerkleRoot(txs), 0x1f00ffff, 42}
+	block.Hash = hash(&block)
+	return block
+}
+
+//the encodings, ids and hashes must never change for the same version, or nodes would no longer agree on them
+const (
+	goldenTxId  = "42114aa50d51991abff0343b8bebaae5f5451182f08474ce9ab314017ec5519d"
+	goldenTxHex = "05" + //version
+		"00000001" + "00000006707265767478" + "0000000000000001" + "00000003736967" + "00000005" + //txins
+		"00000002" + "000000000000012c" + "0000000a087265636569766572ac" + "00000000000002bc" + "000000080673656e646572ac" + //txouts
+		"0000000000000096" + //lock time
+		"00000040" + "34323131346161353064353139393161626666303334336238626562616165356635343531313832663038343734636539616233313430313765633535313964" //id
+	goldenBlockHash     = "2ccd26dee7c28f43c5d78999dca0b13e5cce2ddf8d45065e7d8b60ec4b49103f"
+	goldenMerkleRootHex = "00000040" + "64316233386538376134363963383231313730336166646534663038643634633362396631346235633366303066383938636134393964383333393430393263"
+	goldenBlockHex      = "05" + "0000000000000002" + "000000087072657668617368" + //version, index, previous hash
+		"15597a489c2a8005" + "1f00ffff" + "0000000464617461" + //timestamp, bits, data
+		goldenMerkleRootHex + //merkle root
+		"00000001" + goldenTxHex + //transactions
+		"000000000000002a" + //nonce
+		"00000040" + "32636364323664656537633238663433633564373839393964636130623133653563636532646466386434353036356537643862363065633462343931303366" //hash
+	goldenHeaderHex = "05" + "0000000000000002" + "000000087072657668617368" + //version, index, previous hash
+		"15597a489c2a8005" + "1f00ffff" + "0000000464617461" + //timestamp, bits, data
+		goldenMerkleRootHex + //merkle root
+		"000000000000002a" + //nonce
+		"00000040" + "32636364323664656537633238663433633564373839393964636130623133653563636532646466386434353036356537643862363065633462343931303366" //hash
+)
+
+func TestEncodingGolden(t *testing.T) {
+	tx := testEncodingTx()
+	assert.Equal(t, goldenTxId, tx.Id)
+	assert.Equal(t, goldenTxHex, hex.EncodeToString(EncodeTransaction(tx)))
+	block := testEncodingBlock()
+	assert.Equal(t, goldenBlockHash, block.Hash)
+	assert.Equal(t, goldenBlockHex, hex.EncodeToString(EncodeBlock(block)))
+	header := EncodeHeader(block.Header())
+	assert.Equal(t, goldenHeaderHex, hex.EncodeToString(header))
+	//the hash is the sha256 of the header encoding before it, so it can be checked from the header alone
+	hash := sha256.Sum256(header[:len(header)-4-len(block.Hash)])
+	assert.Equal(t, goldenBlockHash, hex.EncodeToString(hash[:]))
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	tx := testEncodingTx()
+	decodedTx, err := DecodeTransaction(EncodeTransaction(tx))
+	assert.NoError(t, err)
+	assert.Equal(t, tx, decodedTx)
+
+	block := testEncodingBlock()
+	decoded, err := DecodeBlock(EncodeBlock(block))
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+	assert.Equal(t, block.Hash, hash(&decoded))
+
+	//a real chain, with coinbase transactions and no txins
+	bc := NewBlockchain(DefaultGenesis, NewMemoryStorage())
+	for _, block := range bc.CreateTestChain("address1", 2) {
+		decoded, err := DecodeBlock(EncodeBlock(block))
+		assert.NoError(t, err)
+		assert.Equal(t, block, decoded)
+		header, err := DecodeHeader(EncodeHeader(block.Header()))
+		assert.NoError(t, err)
+		assert.Equal(t, block.Header(), header)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	encoded := EncodeBlock(testEncodingBlock())
+	_, err := DecodeBlock(encoded[:len(encoded)-1])
+	assert.ErrorIs(t, err, ErrBadEncoding)
+	_, err = DecodeBlock(append(encoded, 0))
+	assert.ErrorIs(t, err, ErrBadEncoding)
+	_, err = DecodeBlock(nil)
+	assert.ErrorIs(t, err, ErrBadEncoding)
+
+	newer := append([]byte{ENCODING_VERSION + 1}, encoded[1:]...)
+	_, err = DecodeBlock(newer)
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+
+	//a transaction count far beyond the data is rejected before allocating anything
+	huge := append([]byte{}, encoded[:1+8+12+8+4+8+68]...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff)
+	_, err = DecodeBlock(huge)
+	assert.ErrorIs(t, err, ErrBadEncoding)
+}
+
+//changing any field changes the transaction id, including the txin txid which the old id left out
+func TestTxIdCoversContent(t *testing.T) {
+	tx := testEncodingTx()
+	changed := tx
+	changed.TxIns = []TxIn{{"othertx", 1, Script("sig"), 5}}
+	assert.NotEqual(t, tx.Id, calculateTxId(changed))
+	assert.NotEqual(t, sigHash(tx), sigHash(changed))
+	changed = tx
+	changed.TxOuts = []TxOut{TxOutTo("receiver", 301), TxOutTo("sender", 699)}
+	assert.NotEqual(t, tx.Id, calculateTxId(changed))
+	assert.NotEqual(t, sigHash(tx), sigHash(changed))
+	changed = tx
+	changed.LockTime++
+	assert.NotEqual(t, tx.Id, calculateTxId(changed))
+	assert.NotEqual(t, sigHash(tx), sigHash(changed))
+	changed = tx
+	changed.TxIns = []TxIn{{"prevtx", 1, Script("sig"), 6}}
+	assert.NotEqual(t, tx.Id, calculateTxId(changed))
+	assert.NotEqual(t, sigHash(tx), sigHash(changed))
+	//the unlocking scripts are part of the id, but not of the sighash they sign
+	changed = tx
+	changed.TxIns = []TxIn{{"prevtx", 1, Script("other"), 5}}
+	assert.NotEqual(t, tx.Id, calculateTxId(changed))
+	assert.Equal(t, sigHash(tx), sigHash(changed))
+}
@@ -0,0 +1,127 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+//BlockHeader is the part of a block needed to check the chain of blocks and its proof of work, without the transactions.
+//peers exchange headers first when syncing, so a bad chain is found before downloading the full blocks.
+//the block hash is calculated over the header only, and covers the transactions through the merkle root (see merkle.go)
+type BlockHeader struct {
+	Index        int       //the block index in the chain
+	Hash         string    //hash for the block
+	PreviousHash string    //hash for previous block
+	Timestamp    time.Time //time when the block was created
+	Data         string    //the data in the block
+	MerkleRoot   string    //merkle root over the ids of the block transactions
+	Bits         uint32    //proof of work target for the block, in compact form (see miner.go)
+	Nonce        int       //nonce used to find the hash for the block
+}
+
+//ErrUnknownAncestor is returned when headers do not start from a block in the current chain
+var ErrUnknownAncestor = errors.New("headers do not start from a block in the chain")
+
+//Header gives the header part of the block
+func (block *Block) Header() BlockHeader {
+	return BlockHeader{block.Index, block.Hash, block.PreviousHash, block.Timestamp, block.Data, block.MerkleRoot, block.Bits, block.Nonce}
+}
+
+//headerBlock gives a block with only the header fields set, to use headers where the difficulty and timestamp rules expect blocks.
+//the block has no transactions, so its hash can not be calculated from it
+func headerBlock(header BlockHeader) Block {
+	return Block{Index: header.Index, Hash: header.Hash, PreviousHash: header.PreviousHash, Timestamp: header.Timestamp, Data: header.Data, MerkleRoot: header.MerkleRoot, Bits: header.Bits, Nonce: header.Nonce}
+}
+
+//Headers gives the headers of up to count blocks in the current chain, starting from block index from
+func (bc *Blockchain) Headers(from int, count int) []BlockHeader {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	headers := []BlockHeader{}
+	for _, block := range bc.blockRange(from, count) {
+		headers = append(headers, block.Header())
+	}
+	return headers
+}
+
+//BlockRange gives up to count blocks of the current chain, starting from block index from
+func (bc *Blockchain) BlockRange(from int, count int) []Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return append([]Block{}, bc.blockRange(from, count)...)
+}
+
+//blockRange slices up to count blocks from the chain starting at block index from. indices start from 1 for genesis
+func (bc *Blockchain) blockRange(from int, count int) []Block {
+	start := from - 1
+	if start < 0 || start >= len(bc.blocks) || count <= 0 {
+		return nil
+	}
+	end := start + count
+	if end > len(bc.blocks) {
+		end = len(bc.blocks)
+	}
+	return bc.blocks[start:end]
+}
+
+//ValidateHeaders checks that the given headers form a valid chain continuing the current chain.
+//the first header must be for a block already in the current chain, and the rest must follow it with
+//the index, previous hash, target, proof of work and timestamp rules (see validateNextBlock).
+//returns ErrUnknownAncestor if the first header is not in the current chain, e.g. if the headers are on another fork
+func (bc *Blockchain) ValidateHeaders(headers []BlockHeader) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	first := headers[0]
+	start := first.Index - 1
+	if start < 0 || start >= len(bc.blocks) || bc.blocks[start].Hash != first.Hash {
+		return &BlockValidationError{first.Index, first.Hash, ErrUnknownAncestor}
+	}
+	chain := append([]Block{}, bc.blocks[:start+1]...)
+	now := bc.clock.Now()
+	for _, header := range headers[1:] {
+		err := validateNextHeader(chain, header, now)
+		if err != nil {
+			log.Println("header validation failed:", err)
+			return err
+		}
+		chain = append(chain, headerBlock(header))
+	}
+	log.Println("validated", len(headers)-1, "headers after block", first.Index)
+	return nil
+}
+
+//validateNextHeader checks the header rules for a block to follow the last block of the given chain:
+//index and previous hash follow the chain, the target is what the difficulty adjustment gives for this height,
+//the hash meets that target and matches the header, and the timestamp is after the median time past of the chain and not too far ahead of the given current time
+func validateNextHeader(chain []Block, header BlockHeader, now time.Time) error {
+	prevBlock := chain[len(chain)-1]
+	//validate index is in sequence and is +1 from previous block
+	if header.Index != prevBlock.Index+1 {
+		return &BlockValidationError{header.Index, header.Hash, fmt.Errorf("%w: %d after %d", ErrBadIndex, header.Index, prevBlock.Index)}
+	}
+	//validate that previous hash stored in this block matches the hash stored for previous block in chain
+	if header.PreviousHash != prevBlock.Hash {
+		return &BlockValidationError{header.Index, header.Hash, fmt.Errorf("%w: %s vs %s", ErrBadPreviousHash, header.PreviousHash, prevBlock.Hash)}
+	}
+	expectedBits := nextBitsFor(chain)
+	if header.Bits != expectedBits {
+		return &BlockValidationError{header.Index, header.Hash, fmt.Errorf("%w: %08x vs expected %08x", ErrBadTarget, header.Bits, expectedBits)}
+	}
+	if !verifyHashVsTarget(header.Hash, header.Bits) {
+		return &BlockValidationError{header.Index, header.Hash, fmt.Errorf("%w: %08x", ErrInsufficientWork, header.Bits)}
+	}
+	//checked after the target, so a header without the work does not even cost us the hashing
+	if headerHash(&header) != header.Hash {
+		return &BlockValidationError{header.Index, header.Hash, ErrBadHash}
+	}
+	err := validateTimestamp(headerBlock(header), chain, now)
+	if err != nil {
+		return &BlockValidationError{header.Index, header.Hash, err}
+	}
+	return nil
+}
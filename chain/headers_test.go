@@ -0,0 +1,49 @@
+package chain
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//headers of a longer chain validate on top of a node that has the start of it, and broken ones are rejected
+func TestValidateHeaders(t *testing.T) {
+	full := createTestTimedChain(t, 12, time.Second)
+	bc := newTestChain()
+	bc.CreateTestChain(GenesisAddress, 0)
+	for _, block := range full[1:4] {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	assert.Equal(t, 4, bc.Height())
+	assert.Equal(t, full[3], bc.Tip())
+
+	source := NewBlockchain(DefaultGenesis, NewMemoryStorage())
+	source.blocks = full
+	headers := source.Headers(4, 100)
+	assert.Equal(t, 10, len(headers))
+	assert.Equal(t, full[3].Header(), headers[0])
+	assert.Equal(t, full[12].Header(), headers[9])
+	assert.NoError(t, bc.ValidateHeaders(headers))
+	assert.Equal(t, full[5:7], source.BlockRange(6, 2))
+	assert.Empty(t, source.Headers(14, 10))
+
+	//not starting from a block we have
+	err := bc.ValidateHeaders(source.Headers(6, 100))
+	assert.True(t, errors.Is(err, ErrUnknownAncestor))
+
+	//header changed to an easier target, after the adjustment at index 11
+	easier := append([]BlockHeader{}, headers...)
+	easier[8].Bits = MAX_TARGET_BITS
+	assert.True(t, errors.Is(bc.ValidateHeaders(easier), ErrBadTarget))
+
+	//header claiming a hash that does not meet the target
+	weak := append([]BlockHeader{}, headers...)
+	weak[9].Hash = "ff" + weak[9].Hash[2:]
+	assert.True(t, errors.Is(bc.ValidateHeaders(weak), ErrInsufficientWork))
+
+	//headers out of order
+	swapped := append([]BlockHeader{}, headers...)
+	swapped[2], swapped[3] = swapped[3], swapped[2]
+	assert.True(t, errors.Is(bc.ValidateHeaders(swapped), ErrBadIndex))
+}
@@ -0,0 +1,136 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+//a transaction can be locked so it is only valid in a block after a given point, e.g. to pay someone only from a later date.
+//the lock time of the transaction locks it until the block at the given index, or until the given unix time.
+//the relative lock of a txin locks it until the txout it spends has been in the chain for the given number of blocks,
+//or the given number of seconds. a transaction with all its locks passed is final, and only final transactions
+//are valid in a block.
+//
+//times are compared to the median time past of the chain (see medianTimePast) instead of the block timestamp,
+//as miners can set the timestamp some way into the future. the median of the previous blocks only moves forward.
+//
+//the mempool keeps transactions that are not final yet, and miners only pick them once they are (see MempoolFinal).
+//the locking script of a txout can also check the block index with OP_CHECKLOCKTIMEVERIFY, see TimeLockScript
+//
+//https://en.bitcoin.it/wiki/NLockTime
+//https://github.com/bitcoin/bips/blob/master/bip-0068.mediawiki
+
+const LOCKTIME_THRESHOLD = 500000000                   //lock times below this are block indices, from this up unix times in seconds
+const RELATIVE_LOCK_TIME_FLAG = 1 << 22                //set in the relative lock of a txin for a lock in seconds instead of blocks
+const RELATIVE_LOCK_MASK = RELATIVE_LOCK_TIME_FLAG - 1 //bits of the relative lock holding the blocks or seconds
+const MEDIAN_TIME_SPAN = 11                            //number of previous blocks the median time past is taken over
+
+//ErrNotFinal is returned for a transaction in a block before its lock time or relative locks are passed
+var ErrNotFinal = errors.New("transaction not final")
+
+//medianTimePast gives the median of the timestamps of the last MEDIAN_TIME_SPAN blocks of the chain,
+//or of all of them if the chain is shorter
+func medianTimePast(chain []Block) time.Time {
+	start := len(chain) - MEDIAN_TIME_SPAN
+	if start < 0 {
+		start = 0
+	}
+	times := []time.Time{}
+	for _, block := range chain[start:] {
+		times = append(times, block.Timestamp)
+	}
+	if len(times) == 0 {
+		return time.Time{}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times[len(times)/2]
+}
+
+//MedianTimePast gives the median time past of the current chain, what the time locks of the next block are compared to
+func (bc *Blockchain) MedianTimePast() time.Time {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return medianTimePast(bc.blocks)
+}
+
+//checkLocks checks the lock time and the relative locks have valid values
+func checkLocks(tx Transaction) error {
+	if tx.LockTime < 0 {
+		return fmt.Errorf("negative lock time %d", tx.LockTime)
+	}
+	for _, txIn := range tx.TxIns {
+		if txIn.RelativeLock < 0 || txIn.RelativeLock > RELATIVE_LOCK_TIME_FLAG|RELATIVE_LOCK_MASK {
+			return fmt.Errorf("invalid relative lock %d in txin (%s, %d)", txIn.RelativeLock, txIn.TxId, txIn.TxIdx)
+		}
+	}
+	return nil
+}
+
+//checkFinal checks the transaction can go in the block at given index, on top of the given chain.
+//the lock time must be at most the block index, or the median time past of the chain for a time.
+//each txin with a relative lock needs the txout it spends (found in the given view) to be old enough:
+//the block index is compared to the index of the block with the txout, or the median time past to the one before that block
+func checkFinal(tx Transaction, index int, chain []Block, utxos *utxoView) error {
+	if isCoinbase(tx) {
+		return nil
+	}
+	medianTime := medianTimePast(chain)
+	if tx.LockTime >= LOCKTIME_THRESHOLD {
+		if medianTime.Unix() < int64(tx.LockTime) {
+			return fmt.Errorf("%w: %s locked until time %d, median time past is %d", ErrNotFinal, tx.Id, tx.LockTime, medianTime.Unix())
+		}
+	} else if index < tx.LockTime {
+		return fmt.Errorf("%w: %s locked until block %d", ErrNotFinal, tx.Id, tx.LockTime)
+	}
+	for _, txIn := range tx.TxIns {
+		if txIn.RelativeLock == 0 {
+			continue
+		}
+		utxo, found := utxos.get(txIn.TxId, txIn.TxIdx)
+		if !found {
+			return fmt.Errorf("%w: (%s, %d) in %s", ErrMissingInput, txIn.TxId, txIn.TxIdx, tx.Id)
+		}
+		lock := txIn.RelativeLock & RELATIVE_LOCK_MASK
+		if txIn.RelativeLock&RELATIVE_LOCK_TIME_FLAG == 0 {
+			if index-utxo.Height < lock {
+				return fmt.Errorf("%w: txin (%s, %d) locked for %d blocks after block %d", ErrNotFinal, txIn.TxId, txIn.TxIdx, lock, utxo.Height)
+			}
+			continue
+		}
+		//the txout may be from a transaction in the same block or the mempool, with the chain not that long yet
+		before := utxo.Height - 1
+		if before > len(chain) {
+			before = len(chain)
+		}
+		since := medianTimePast(chain[:before])
+		if medianTime.Sub(since) < time.Duration(lock)*time.Second {
+			return fmt.Errorf("%w: txin (%s, %d) locked for %d seconds after %v", ErrNotFinal, txIn.TxId, txIn.TxIdx, lock, since)
+		}
+	}
+	return nil
+}
+
+//MempoolFinal gives the transactions of the pool that are final for the next block, ordered by fee rate as in Mempool.
+//transactions spending the txouts of ones not final yet are left out too, so all the ones given can go in the next block
+func (bc *Blockchain) MempoolFinal() []Transaction {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	index := bc.nextIndex()
+	view := newUtxoView(bc.utxos, index)
+	final := []Transaction{}
+	for _, tx := range bc.mempoolByFeeRate() {
+		err := checkFinal(tx, index, bc.blocks, view)
+		if err == nil {
+			_, err = view.apply(tx)
+		}
+		if err != nil {
+			log.Println("Leaving transaction out of next block:", err)
+			continue
+		}
+		final = append(final, tx)
+	}
+	return final
+}
@@ -0,0 +1,114 @@
+package chain
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMedianTimePast(t *testing.T) {
+	assert.Equal(t, time.Time{}, medianTimePast(nil))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	chain := []Block{}
+	//timestamps going back and forth, the median only takes the last MEDIAN_TIME_SPAN into account
+	for _, minutes := range []int{10, 1, 2, 30, 3, 4, 5, 6, 7, 8, 9, 10, 11} {
+		chain = append(chain, Block{Timestamp: start.Add(time.Duration(minutes) * time.Minute)})
+	}
+	assert.Equal(t, start.Add(2*time.Minute), medianTimePast(chain[:3]))
+	assert.Equal(t, start.Add(7*time.Minute), medianTimePast(chain))
+}
+
+//a transaction locked until a later block waits in the mempool, and is not accepted in a block before that
+func TestLockTimeInMempool(t *testing.T) {
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 2)
+	lockIndex := bc.Height() + 3
+	locked, err := bc.SendCoinsAfter([]*ecdsa.PrivateKey{privKey}, "receiver", 100, 5, lockIndex)
+	assert.NoError(t, err)
+	child := bc.createTx(privKey, []TxIn{{TxId: locked.Id, TxIdx: 1}}, []TxOut{TxOutTo("other", 10)})
+	assert.NoError(t, bc.SubmitTransaction(child))
+	assert.Equal(t, 2, len(bc.Mempool()))
+	assert.Empty(t, bc.MempoolFinal())
+
+	//the coins spent by the locked transaction cannot be sent again
+	_, err = bc.SendCoins(privKey, "receiver", 2*INITIAL_SUBSIDY-50, 0)
+	assert.True(t, errors.Is(err, ErrInsufficientFunds))
+
+	_, err = bc.CreateBlock("miner", []Transaction{locked}, "too early")
+	assert.True(t, errors.Is(err, ErrNotFinal))
+	//the lock time is signed, so it cannot be removed without breaking the signatures
+	changed := locked
+	changed.LockTime = 0
+	changed.Id = calculateTxId(changed)
+	assert.Error(t, bc.VerifyTransaction(changed))
+	assert.NoError(t, bc.VerifyTransaction(locked))
+	for bc.Height()+1 < lockIndex {
+		block, err := bc.MinePending("miner", "waiting")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(block.Transactions))
+	}
+	assert.Equal(t, []Transaction{locked, child}, bc.MempoolFinal())
+	block, err := bc.MinePending("miner", "unlocked")
+	assert.NoError(t, err)
+	assert.Equal(t, lockIndex, block.Index)
+	assert.Equal(t, 3, len(block.Transactions))
+	assert.Equal(t, 100, bc.BalanceFor("receiver"))
+	assert.Empty(t, bc.Mempool())
+}
+
+func TestCheckFinal(t *testing.T) {
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 0)
+	coins, _ := bc.newBlockTemplate(address, nil, "coins")
+	coins.Timestamp = GenesisTime.Add(time.Minute)
+	coins = mineBlock(coins)
+	assert.NoError(t, bc.AddBlock(coins))
+	cbTx := coins.Transactions[0]
+	for i := 2; i <= 6; i++ {
+		addTestBlockAt(t, bc, GenesisTime.Add(time.Duration(i)*time.Minute))
+	}
+	view := newUtxoView(bc.utxos, bc.nextIndex())
+	medianTime := medianTimePast(bc.blocks)
+	assert.Equal(t, GenesisTime.Add(3*time.Minute), medianTime)
+
+	spend := func(lockTime int, relativeLock int) Transaction {
+		tx := Transaction{"", []TxIn{{cbTx.Id, 0, nil, relativeLock}}, []TxOut{TxOutTo("receiver", 10)}, lockTime}
+		return signTx(tx, []*ecdsa.PrivateKey{privKey})
+	}
+	tests := []struct {
+		name         string
+		lockTime     int
+		relativeLock int
+		final        bool
+	}{
+		{"no locks", 0, 0, true},
+		{"next block", bc.nextIndex(), 0, true},
+		{"later block", bc.nextIndex() + 1, 0, false},
+		{"median time reached", int(medianTime.Unix()), 0, true},
+		{"median time not reached", int(medianTime.Unix()) + 1, 0, false},
+		//the coinbase is in block 2, and the next block is 8
+		{"txout deep enough", 0, 6, true},
+		{"txout not deep enough", 0, 7, false},
+		//the median time before block 2 is the genesis time
+		{"txout old enough", 0, RELATIVE_LOCK_TIME_FLAG | 180, true},
+		{"txout not old enough", 0, RELATIVE_LOCK_TIME_FLAG | 181, false},
+	}
+	for _, test := range tests {
+		tx := spend(test.lockTime, test.relativeLock)
+		assert.NoError(t, verifyTransaction(tx, view), test.name)
+		err := checkFinal(tx, bc.nextIndex(), bc.blocks, view)
+		if test.final {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.True(t, errors.Is(err, ErrNotFinal), "%s: got %v", test.name, err)
+		}
+	}
+
+	assert.Error(t, verifyTransaction(spend(-1, 0), view))
+	assert.Error(t, verifyTransaction(spend(0, RELATIVE_LOCK_TIME_FLAG<<1), view))
+}
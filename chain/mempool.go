@@ -0,0 +1,165 @@
+package chain
+
+import (
+	"log"
+)
+
+//the mempool holds transactions that are valid but not yet in a block.
+//it is kept in Blockchain.mempool and guarded by the same lock as the rest of the chain.
+//transactions in the pool are in the order they were accepted, so a transaction may spend the txouts of one before it.
+//Mempool() gives them ordered by fee rate instead, for miners to pick the transactions paying most first.
+//transactions with a lock time or relative locks not passed yet are kept in the pool too, miners take the ones
+//final for the next block from MempoolFinal()
+
+//SubmitTransaction verifies the given transaction against the unspent txouts and the transactions already in the pool,
+//and adds it to the pool if valid. a transaction spending a txout already spent by the pool is rejected as a double spend
+func (bc *Blockchain) SubmitTransaction(tx Transaction) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.addToMempool(tx)
+}
+
+//addToMempool does the work for SubmitTransaction, expects caller to hold the lock
+func (bc *Blockchain) addToMempool(tx Transaction) error {
+	log.Println("Adding transaction to mempool:", tx.Id)
+	for _, pooled := range bc.mempool {
+		if pooled.Id == tx.Id {
+			return &TxValidationError{tx.Id, "transaction already in mempool"}
+		}
+	}
+	err := verifyTransaction(tx, bc.mempoolView())
+	if err != nil {
+		log.Println("Rejected transaction from mempool:", err)
+		return err
+	}
+	bc.mempool = append(bc.mempool, tx)
+	log.Println("Transaction added to mempool, pool size:", len(bc.mempool))
+	close(bc.mempoolChanged)
+	bc.mempoolChanged = make(chan struct{})
+	return nil
+}
+
+//MempoolChanged gives a channel that is closed when the next transaction is added to the mempool
+func (bc *Blockchain) MempoolChanged() <-chan struct{} {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.mempoolChanged
+}
+
+//MempoolTransaction looks for the transaction with given id in the mempool. returns false if not found
+func (bc *Blockchain) MempoolTransaction(txId string) (Transaction, bool) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	for _, tx := range bc.mempool {
+		if tx.Id == txId {
+			return tx, true
+		}
+	}
+	return Transaction{}, false
+}
+
+//Mempool returns a copy of the transactions waiting in the pool, ordered by fee rate (see mempoolByFeeRate)
+func (bc *Blockchain) Mempool() []Transaction {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.mempoolByFeeRate()
+}
+
+//mempoolEntry is a transaction in the pool with its fee and encoded size, for ordering by fee rate
+type mempoolEntry struct {
+	tx   Transaction
+	fee  int
+	size int
+}
+
+//higherFeeRate checks if the entry pays more fee per byte than the other one
+func (entry *mempoolEntry) higherFeeRate(other *mempoolEntry) bool {
+	return entry.fee*other.size > other.fee*entry.size
+}
+
+//mempoolByFeeRate orders the pool by fee per byte of the encoded transaction, highest first.
+//a transaction spending the txouts of another in the pool comes after it, whatever their fee rates.
+//equal fee rates keep the order the transactions were accepted in
+func (bc *Blockchain) mempoolByFeeRate() []Transaction {
+	view := newUtxoView(bc.utxos, bc.nextIndex())
+	entries := []*mempoolEntry{}
+	pooled := make(map[string]bool)
+	for _, tx := range bc.mempool {
+		entries = append(entries, &mempoolEntry{tx, txFee(tx, view), len(EncodeTransaction(tx))})
+		view.apply(tx)
+		pooled[tx.Id] = true
+	}
+	ordered := []Transaction{}
+	selected := make(map[string]bool)
+	for len(entries) > 0 {
+		best := -1
+		for i, entry := range entries {
+			if !parentsSelected(entry.tx, pooled, selected) {
+				continue
+			}
+			if best < 0 || entry.higherFeeRate(entries[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			//can not happen as the pool is in accepted order, but do not loop forever if it does
+			log.Println("Mempool has transactions with parents missing from the pool")
+			best = 0
+		}
+		ordered = append(ordered, entries[best].tx)
+		selected[entries[best].tx.Id] = true
+		entries = append(entries[:best], entries[best+1:]...)
+	}
+	return ordered
+}
+
+//parentsSelected checks that the transactions in the pool the given one spends from are already selected
+func parentsSelected(tx Transaction, pooled map[string]bool, selected map[string]bool) bool {
+	for _, txIn := range tx.TxIns {
+		if pooled[txIn.TxId] && !selected[txIn.TxId] {
+			return false
+		}
+	}
+	return true
+}
+
+//MinePending creates a new block with all the final transactions currently in the pool, paying the coinbase to given address
+func (bc *Blockchain) MinePending(cbAddr string, blockData string) (Block, error) {
+	pending := bc.MempoolFinal()
+	log.Println("Mining block with", len(pending), "pending transactions")
+	return bc.CreateBlock(cbAddr, pending, blockData)
+}
+
+//mempoolView gives the unspent txouts as they would be after all the transactions in the pool are applied
+func (bc *Blockchain) mempoolView() *utxoView {
+	view := newUtxoView(bc.utxos, bc.nextIndex())
+	for _, tx := range bc.mempool {
+		view.apply(tx)
+	}
+	return view
+}
+
+//updateMempool is called after a block is added to the chain. it evicts the transactions that were in the block,
+//and re-verifies the rest so any that now conflict with the chain are dropped as well
+func (bc *Blockchain) updateMempool(block Block) {
+	mined := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		mined[tx.Id] = true
+	}
+	old := bc.mempool
+	bc.mempool = nil
+	view := newUtxoView(bc.utxos, bc.nextIndex())
+	for _, tx := range old {
+		if mined[tx.Id] {
+			log.Println("Evicting mined transaction from mempool:", tx.Id)
+			continue
+		}
+		err := verifyTransaction(tx, view)
+		if err != nil {
+			log.Println("Evicting invalid transaction from mempool:", err)
+			continue
+		}
+		view.apply(tx)
+		bc.mempool = append(bc.mempool, tx)
+	}
+}
@@ -0,0 +1,98 @@
+package chain
+
+import (
+	"errors"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMempoolMinedAndEvicted(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	_, _, address2 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+
+	tx1, err := bc.SendCoins(privKey1, address2, 50, 0)
+	assert.NoError(t, err)
+	//second send has to use the change from the first one, since the coinbase is already spent in the pool
+	tx2, err := bc.SendCoins(privKey1, address2, 100, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, tx1.Id, tx2.TxIns[0].TxId)
+	assert.Equal(t, []Transaction{tx1, tx2}, bc.Mempool())
+	//nothing is spent until mined
+	assert.Equal(t, 0, bc.BalanceFor(address2))
+
+	block, err := bc.MinePending(GenesisAddress, "pending")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(block.Transactions))
+	assert.Equal(t, 0, len(bc.Mempool()))
+	assert.Equal(t, 150, bc.BalanceFor(address2))
+	assert.Equal(t, INITIAL_SUBSIDY-150, bc.BalanceFor(address1))
+}
+
+func TestMempoolRejectsDoubleSpend(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	_, _, address2 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+	cbTx := bc.blocks[1].Transactions[0]
+
+	tx1 := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address2, INITIAL_SUBSIDY)})
+	tx2 := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address1, INITIAL_SUBSIDY)})
+	assert.NoError(t, bc.SubmitTransaction(tx1))
+	assert.Error(t, bc.SubmitTransaction(tx1), "Same transaction should not be added twice")
+	var txErr *TxValidationError
+	assert.True(t, errors.As(bc.SubmitTransaction(tx2), &txErr), "Spending same txout as pooled tx should fail")
+	assert.Equal(t, 1, len(bc.Mempool()))
+
+	_, err := bc.SendCoins(privKey1, address2, 1, 0)
+	assert.True(t, errors.Is(err, ErrInsufficientFunds), "All coins of sender already spent in pool")
+}
+
+func TestMempoolEvictsConflicting(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	_, _, address2 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+	cbTx := bc.blocks[1].Transactions[0]
+
+	pooled, err := bc.SendCoins(privKey1, address2, 50, 0)
+	assert.NoError(t, err)
+	//a block from elsewhere spends the same coinbase, so the pooled tx is no longer valid
+	other := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address1, INITIAL_SUBSIDY)})
+	_, err = bc.CreateBlock(GenesisAddress, []Transaction{other}, "conflict")
+	assert.NoError(t, err)
+	assert.NotEqual(t, pooled.Id, other.Id)
+	assert.Equal(t, 0, len(bc.Mempool()))
+}
+
+//the pool is given highest fee rate first, except a transaction comes after the one it spends from
+func TestMempoolOrderedByFeeRate(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	privKey2, _, address2 := cryptoff.CreateAddress()
+	privKey3, _, address3 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+	for _, address := range []string{address2, address3} {
+		_, err := bc.CreateBlock(address, nil, "coins")
+		assert.NoError(t, err)
+	}
+
+	low, err := bc.SendCoins(privKey1, "receiver", 10, 1)
+	assert.NoError(t, err)
+	high, err := bc.SendCoins(privKey2, "receiver", 10, 20)
+	assert.NoError(t, err)
+	middle, err := bc.SendCoins(privKey3, "receiver", 10, 5)
+	assert.NoError(t, err)
+	//spends the change of the low fee one, so has to stay after it despite the highest fee
+	child, err := bc.SendCoins(privKey1, "receiver", 10, 50)
+	assert.NoError(t, err)
+	assert.Equal(t, low.Id, child.TxIns[0].TxId)
+	assert.Equal(t, []Transaction{high, middle, low, child}, bc.Mempool())
+
+	block, err := bc.MinePending("miner", "by fee")
+	assert.NoError(t, err)
+	assert.Equal(t, []Transaction{high, middle, low, child}, block.Transactions[1:])
+	assert.Equal(t, INITIAL_SUBSIDY+76, bc.BalanceFor("miner"))
+}
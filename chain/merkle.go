@@ -0,0 +1,123 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+)
+
+//the block header has a merkle root over the transaction ids, so the block hash covers all transactions through it.
+//a merkle branch from a transaction id to the root proves the transaction is in the block, with only the block header
+//and a hash for each level of the tree, instead of all the transactions of the block.
+//
+//leaves are sha256(0 + txid) and inner nodes sha256(1 + left + right). the different prefixes keep an inner node
+//from being passed off as a leaf. a level with an odd number of nodes moves its last node up as it is, instead of
+//pairing it with itself as bitcoin does, so two different transaction lists can not give the same root
+//
+//https://en.bitcoin.it/wiki/Protocol_documentation#Merkle_Trees
+//https://www.rfc-editor.org/rfc/rfc6962#section-2.1
+
+//MerkleStep is one level of a merkle branch: the hash to combine with to get to the next level
+type MerkleStep struct {
+	Hash string //hash of the sibling node, hex-encoded
+	Left bool   //true if the sibling is on the left side
+}
+
+//MerkleProof proves that a transaction is in the block with the given header
+type MerkleProof struct {
+	TxId   string       //id of the transaction proven
+	Header BlockHeader  //header of the block with the transaction
+	Branch []MerkleStep //steps from the transaction id to the merkle root of the header
+}
+
+func merkleLeaf(txId string) []byte {
+	hash := sha256.Sum256(append([]byte{0}, txId...))
+	return hash[:]
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	data := append(append([]byte{1}, left...), right...)
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+//merkleLevels gives all levels of the merkle tree for the transactions, from the leaves to the root
+func merkleLevels(txs []Transaction) [][][]byte {
+	level := make([][]byte, len(txs))
+	for i, tx := range txs {
+		level[i] = merkleLeaf(tx.Id)
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+//MerkleRoot calculates the merkle root over the ids of the transactions, hex-encoded
+func MerkleRoot(txs []Transaction) string {
+	if len(txs) == 0 {
+		hash := sha256.Sum256(nil)
+		return hex.EncodeToString(hash[:])
+	}
+	levels := merkleLevels(txs)
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
+
+//MerkleBranch builds the merkle branch for the transaction at given position in the list
+func MerkleBranch(txs []Transaction, position int) []MerkleStep {
+	branch := []MerkleStep{}
+	for _, level := range merkleLevels(txs) {
+		sibling := position ^ 1
+		if sibling < len(level) {
+			branch = append(branch, MerkleStep{hex.EncodeToString(level[sibling]), sibling < position})
+		}
+		position /= 2
+	}
+	return branch
+}
+
+//VerifyMerkleBranch checks that the branch leads from the transaction id to the given merkle root
+func VerifyMerkleBranch(txId string, branch []MerkleStep, root string) bool {
+	hash := merkleLeaf(txId)
+	for _, step := range branch {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			hash = merkleNode(sibling, hash)
+		} else {
+			hash = merkleNode(hash, sibling)
+		}
+	}
+	return hex.EncodeToString(hash) == root
+}
+
+//Verify checks the proof: the header hash matches the header content, and the branch leads from the transaction
+//to the merkle root in the header. the caller still has to check the header is in the chain it follows
+func (proof MerkleProof) Verify() bool {
+	return headerHash(&proof.Header) == proof.Header.Hash && VerifyMerkleBranch(proof.TxId, proof.Branch, proof.Header.MerkleRoot)
+}
+
+//TxProof builds the merkle proof for the transaction with given id in the current chain. returns false if not found
+func (bc *Blockchain) TxProof(txId string) (MerkleProof, bool) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	blockIdx, txIdx := bc.findTransaction(txId)
+	if blockIdx < 0 {
+		log.Println("No transaction for proof:", txId)
+		return MerkleProof{}, false
+	}
+	block := bc.blocks[blockIdx]
+	return MerkleProof{txId, block.Header(), MerkleBranch(block.Transactions, txIdx)}, true
+}
@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func merkleTestTxs(count int) []Transaction {
+	txs := []Transaction{}
+	for i := 0; i < count; i++ {
+		txs = append(txs, Transaction{Id: fmt.Sprintf("tx%d", i)})
+	}
+	return txs
+}
+
+//the root of a fixed list must never change, or nodes would no longer agree on block hashes
+func TestMerkleRootGolden(t *testing.T) {
+	assert.Equal(t, "e52026eebb267b65f2d684eb8bea5aefc48d0224008bae3108ff4d29ccdd189e", MerkleRoot(merkleTestTxs(3)))
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", MerkleRoot(nil))
+}
+
+//a branch for each position of trees of different sizes leads to the root, and not from another transaction or to another root
+func TestMerkleBranch(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		txs := merkleTestTxs(count)
+		root := MerkleRoot(txs)
+		for position, tx := range txs {
+			branch := MerkleBranch(txs, position)
+			assert.True(t, VerifyMerkleBranch(tx.Id, branch, root), "count %d position %d", count, position)
+			assert.False(t, VerifyMerkleBranch("other", branch, root), "count %d position %d", count, position)
+			if len(branch) > 0 {
+				branch[0].Left = !branch[0].Left
+				assert.False(t, VerifyMerkleBranch(tx.Id, branch, root), "count %d position %d", count, position)
+			}
+		}
+		//each added transaction changes the root
+		assert.NotEqual(t, root, MerkleRoot(merkleTestTxs(count+1)))
+	}
+	//the last transaction is not paired with itself, so repeating it gives another root
+	txs := merkleTestTxs(3)
+	assert.NotEqual(t, MerkleRoot(txs), MerkleRoot(append(txs, txs[2])))
+}
+
+func TestTxProof(t *testing.T) {
+	bc := newTestChain()
+	bc.CreateTestChain("address1", 2)
+	block, err := bc.CreateBlock("address2", nil, "proof")
+	assert.NoError(t, err)
+
+	proof, found := bc.TxProof(block.Transactions[0].Id)
+	assert.True(t, found)
+	assert.Equal(t, block.Header(), proof.Header)
+	assert.True(t, proof.Verify())
+	_, found = bc.TxProof("unknown")
+	assert.False(t, found)
+
+	//the header has to match its hash, and the branch the header merkle root
+	changed := proof
+	changed.Header.MerkleRoot = MerkleRoot(nil)
+	assert.False(t, changed.Verify())
+	changed = proof
+	changed.TxId = "other"
+	assert.False(t, changed.Verify())
+}
+
+//a block with transactions changed under it no longer matches its merkle root, and a header with another merkle root its hash
+func TestHeaderCoversTransactions(t *testing.T) {
+	bc := newTestChain()
+	blocks := bc.CreateTestChain("address1", 1)
+	header := blocks[1].Header()
+	header.MerkleRoot = MerkleRoot(nil)
+	err := validateNextHeader(blocks[:1], header, blocks[1].Timestamp)
+	assert.True(t, errors.Is(err, ErrBadHash))
+
+	changed := blocks[1]
+	changed.Transactions = []Transaction{CreateCoinbaseTx("address2", 2, 0)}
+	err = validateNextBlock(blocks[:1], changed, changed.Timestamp)
+	assert.True(t, errors.Is(err, ErrBadMerkleRoot))
+	changed.MerkleRoot = MerkleRoot(changed.Transactions)
+	err = validateNextBlock(blocks[:1], changed, changed.Timestamp)
+	assert.True(t, errors.Is(err, ErrBadHash))
+
+	//an orphan with transactions changed under it is not kept
+	other := appendTestBlock(appendTestBlock(blocks, nil), nil)
+	orphan := other[3]
+	orphan.Transactions = []Transaction{CreateCoinbaseTx("address2", 4, 0)}
+	assert.True(t, errors.Is(bc.ProcessBlock(orphan), ErrBadMerkleRoot))
+	assert.False(t, bc.HasBlock(orphan.Hash))
+}
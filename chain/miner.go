@@ -1,55 +1,273 @@
 package chain
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"strings"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var DIFFICULTY_ADJUSTMENT_INTERVAL = 10 //number of blocks between to aim to adjust difficulty
 var BLOCK_GENERATION_INTERVAL = 10      //target seconds to generate a block
+var MAX_TARGET_BITS uint32 = 0x2100ffff //easiest allowed target in compact form, also used for the genesis block
+var MAX_ADJUSTMENT_FACTOR = 4           //target can change at most this many times bigger or smaller in one adjustment
+var MAX_TIMESTAMP_DRIFT = 60            //seconds a block timestamp can be ahead of the network-adjusted time
 
-//verifyHashVsDifficulty checks if given hash string starts with "difficulty" number of zeroes
-//TODO: check against difficulty number so hash < difficulty for much more granularity
-func verifyHashVsDifficulty(hash string, difficulty int) bool {
-	prefix := strings.Repeat("0", difficulty)
-	return strings.HasPrefix(hash, prefix)
+//the proof of work target is a 256 bit number, and a block hash (as a number) must be <= target to be valid.
+//blocks store the target in the compact "bits" form used by bitcoin: the highest byte is the length of the number in bytes,
+//and the lower three bytes are the most significant bytes of the number. so 0x1d00ffff = 0x00ffff * 256^(0x1d-3)
+//https://en.bitcoin.it/wiki/Difficulty
+
+//compactToBig converts a compact "bits" representation into the full target number
+func compactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if negative {
+		target.Neg(target)
+	}
+	return target
 }
 
-//getDifficulty calculates the current difficulty based on timestamps
-func getDifficulty() int {
-	prevBlock := GlobalChain[len(GlobalChain)-1]
-	if prevBlock.Index%DIFFICULTY_ADJUSTMENT_INTERVAL == 0 && prevBlock.Index != 0 {
-		return getAdjustedDifficulty(prevBlock, GlobalChain)
+//bigToCompact converts a target number into the compact "bits" representation, dropping all but the 3 highest bytes
+func bigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+	abs := new(big.Int).Abs(target)
+	exponent := uint(len(abs.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(abs.Uint64()) << (8 * (3 - exponent))
 	} else {
-		return prevBlock.Difficulty
+		mantissa = uint32(abs.Rsh(abs, 8*(exponent-3)).Uint64())
+	}
+	//the 0x00800000 bit is the sign, so if the mantissa would use it, move to a bigger exponent
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
 	}
-	return 0
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+//verifyHashVsTarget checks that the given hex hash string, as a number, is <= the target given in compact form
+func verifyHashVsTarget(hash string, bits uint32) bool {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 || target.Cmp(compactToBig(MAX_TARGET_BITS)) > 0 {
+		return false
+	}
+	hashNum, ok := new(big.Int).SetString(hash, 16)
+	if !ok {
+		return false
+	}
+	return hashNum.Cmp(target) <= 0
 }
 
-//getAdjustedDifficulty increases or decreases difficulty based on time diff in finding new block
-func getAdjustedDifficulty(prevBlock Block, chain []Block) int {
+//getNextBits calculates the target for the next block, based on timestamps of the previous blocks
+func (bc *Blockchain) getNextBits() uint32 {
+	return nextBitsFor(bc.blocks)
+}
+
+//nextBitsFor calculates the target for a block following the given chain.
+//the target changes every DIFFICULTY_ADJUSTMENT_INTERVAL blocks, and stays the same as previous block otherwise
+func nextBitsFor(chain []Block) uint32 {
+	if len(chain) == 0 {
+		return MAX_TARGET_BITS
+	}
+	prevBlock := chain[len(chain)-1]
+	if prevBlock.Index%DIFFICULTY_ADJUSTMENT_INTERVAL == 0 && prevBlock.Index != 0 {
+		return getAdjustedBits(prevBlock, chain)
+	}
+	return prevBlock.Bits
+}
+
+//getAdjustedBits scales the target by how long it took to find the last DIFFICULTY_ADJUSTMENT_INTERVAL blocks vs how long it should take.
+//faster than expected gives a smaller (harder) target, slower a bigger (easier) one.
+//the change is clamped to MAX_ADJUSTMENT_FACTOR in either direction, and never goes above MAX_TARGET_BITS
+func getAdjustedBits(prevBlock Block, chain []Block) uint32 {
 	prevAdjustmentBlock := chain[len(chain)-DIFFICULTY_ADJUSTMENT_INTERVAL]
-	timeExpected := BLOCK_GENERATION_INTERVAL * DIFFICULTY_ADJUSTMENT_INTERVAL
-	timeDelta := prevBlock.Timestamp.Sub(prevAdjustmentBlock.Timestamp)
-	seconds := int(timeDelta.Seconds())
-	if seconds < timeExpected/2 {
-		log.Print("Difficulty less than half of expected: ", seconds, " vs. ", timeExpected, " -> reducing.")
-		//less than half expected time, increase difficulty by one
-		return prevAdjustmentBlock.Difficulty + 1
-	} else if seconds > timeExpected*2 {
-		log.Print("Difficulty twice the expected: ", seconds, " vs. ", timeExpected, " -> increasing.")
-		//more than twice expected time, decrease difficulty by one
-		return prevAdjustmentBlock.Difficulty - 1
-	} else {
-		return prevAdjustmentBlock.Difficulty
+	timeExpected := time.Duration(BLOCK_GENERATION_INTERVAL*DIFFICULTY_ADJUSTMENT_INTERVAL) * time.Second
+	timeTaken := prevBlock.Timestamp.Sub(prevAdjustmentBlock.Timestamp)
+	minTime := timeExpected / time.Duration(MAX_ADJUSTMENT_FACTOR)
+	maxTime := timeExpected * time.Duration(MAX_ADJUSTMENT_FACTOR)
+	if timeTaken < minTime {
+		timeTaken = minTime
+	}
+	if timeTaken > maxTime {
+		timeTaken = maxTime
+	}
+	target := compactToBig(prevBlock.Bits)
+	target.Mul(target, big.NewInt(int64(timeTaken)))
+	target.Div(target, big.NewInt(int64(timeExpected)))
+	maxTarget := compactToBig(MAX_TARGET_BITS)
+	if target.Cmp(maxTarget) > 0 {
+		target = maxTarget
+	}
+	bits := bigToCompact(target)
+	log.Printf("Adjusted target after %v vs expected %v: %08x -> %08x", timeTaken, timeExpected, prevBlock.Bits, bits)
+	return bits
+}
+
+//blockWork gives the expected number of hashes needed to find a block for the given target: 2^256 / (target+1)
+func blockWork(bits uint32) *big.Int {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
 	}
-	return 0
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
 }
 
-//validateTimestamp checks that block timestamp is withing the allowed time interval from previous block
-func validateTimestamp(newBlock Block, prevBlock Block) bool {
-	diff := newBlock.Timestamp.Sub(prevBlock.Timestamp)
-	pastOk := diff > -60
-	futureOk := diff < 60
-	return pastOk && futureOk
+//calculateChainWork sums up the work for all blocks in the chain, to compare which chain has most work put into it
+func calculateChainWork(chain []Block) *big.Int {
+	total := big.NewInt(0)
+	for _, block := range chain {
+		total.Add(total, blockWork(block.Bits))
+	}
+	log.Println("Calculated chain work:", total)
+	return total
+}
+
+//ErrTipChanged is returned from mining when another block was added to the chain before the mined one was found
+var ErrTipChanged = errors.New("chain tip changed while mining")
+
+//MinerStats describes the progress of a Miner
+type MinerStats struct {
+	Mining      bool          //true while a search is running
+	Workers     int           //number of goroutines searching for the nonce
+	Attempts    uint64        //hashes tried in the current (or last) search
+	Elapsed     time.Duration //time spent in the current (or last) search
+	HashRate    float64       //hashes per second in the current (or last) search
+	BlocksFound int           //number of blocks found by this miner
+}
+
+//Miner searches for a nonce that gives a block hash meeting the block target.
+//the nonce space is split between the workers, worker i tries nonces i, i+workers, i+2*workers, ...
+type Miner struct {
+	workers     int
+	attempts    uint64     //hashes tried in current search, updated atomically by the workers
+	lock        sync.Mutex //guards the fields below
+	mining      bool
+	started     time.Time
+	elapsed     time.Duration
+	blocksFound int
+}
+
+//NewMiner creates a miner with the given number of worker goroutines, or one per cpu if workers <= 0
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{workers: workers}
+}
+
+//how many hashes a worker does before adding them to the shared attempt count and checking if it should stop
+const minerBatchSize = 256
+
+//Mine searches for a nonce for the given block template, and returns the block with merkle root, nonce and hash filled in.
+//if the context is cancelled before a nonce is found, returns the context error.
+//only one search should be running at a time for a miner
+func (m *Miner) Mine(ctx context.Context, template Block) (Block, error) {
+	log.Printf("Starting pow for block %d with %d workers, bits = %08x", template.Index, m.workers, template.Bits)
+	m.lock.Lock()
+	m.mining = true
+	m.started = time.Now()
+	atomic.StoreUint64(&m.attempts, 0)
+	m.lock.Unlock()
+
+	template.MerkleRoot = MerkleRoot(template.Transactions)
+	ctx, cancel := context.WithCancel(ctx)
+	prefix := hashPrefix(&template)
+	found := make(chan Block, m.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func(nonce int) {
+			defer wg.Done()
+			count := uint64(0)
+			for {
+				hash := hashWithNonce(prefix, nonce)
+				if verifyHashVsTarget(hash, template.Bits) {
+					atomic.AddUint64(&m.attempts, count+1)
+					block := template
+					block.Nonce = nonce
+					block.Hash = hash
+					found <- block
+					cancel()
+					return
+				}
+				nonce += m.workers
+				count++
+				if count == minerBatchSize {
+					atomic.AddUint64(&m.attempts, count)
+					count = 0
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	cancel()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.mining = false
+	m.elapsed = time.Since(m.started)
+	select {
+	case block := <-found:
+		m.blocksFound++
+		log.Println("found pow hash:", block.Hash, "after", atomic.LoadUint64(&m.attempts), "attempts")
+		return block, nil
+	default:
+		log.Println("mining stopped:", ctx.Err())
+		return template, ctx.Err()
+	}
+}
+
+//Stats gives the current progress of the miner
+func (m *Miner) Stats() MinerStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	elapsed := m.elapsed
+	if m.mining {
+		elapsed = time.Since(m.started)
+	}
+	attempts := atomic.LoadUint64(&m.attempts)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(attempts) / elapsed.Seconds()
+	}
+	return MinerStats{m.mining, m.workers, attempts, elapsed, rate, m.blocksFound}
+}
+
+//validateTimestamp checks that block timestamp is after the median time past of the chain before it (see medianTimePast),
+//and not more than MAX_TIMESTAMP_DRIFT seconds ahead of the given current time, the network-adjusted time (see NetworkClock).
+//a miner can not move the median alone, so timestamps can go back a little but the median only goes forward
+func validateTimestamp(newBlock Block, chain []Block, now time.Time) error {
+	drift := time.Duration(MAX_TIMESTAMP_DRIFT) * time.Second
+	medianTime := medianTimePast(chain)
+	if !newBlock.Timestamp.After(medianTime) {
+		return fmt.Errorf("%w: %v vs median %v", ErrTimestampTooEarly, newBlock.Timestamp, medianTime)
+	}
+	if newBlock.Timestamp.After(now.Add(drift)) {
+		return fmt.Errorf("%w: %v vs current time %v", ErrTimestampTooLate, newBlock.Timestamp, now)
+	}
+	return nil
 }
@@ -0,0 +1,125 @@
+package chain
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCompactConversion(t *testing.T) {
+	//values from bitcoin, 0x1d00ffff is the genesis block target
+	genesisTarget, _ := new(big.Int).SetString("00000000ffff0000000000000000000000000000000000000000000000000000", 16)
+	assert.Equal(t, genesisTarget, compactToBig(0x1d00ffff))
+	assert.Equal(t, uint32(0x1d00ffff), bigToCompact(genesisTarget))
+	assert.Equal(t, big.NewInt(0x12), compactToBig(0x01120000))
+	assert.Equal(t, uint32(0x01120000), bigToCompact(big.NewInt(0x12)))
+	//0x80 would set the sign bit, so the mantissa moves one byte right
+	assert.Equal(t, uint32(0x02008000), bigToCompact(big.NewInt(0x80)))
+	assert.Equal(t, big.NewInt(0x80), compactToBig(0x02008000))
+	assert.Equal(t, big.NewInt(-0x12345600), compactToBig(0x04923456))
+	assert.Equal(t, uint32(0), bigToCompact(big.NewInt(0)))
+	//anything below the top 3 bytes is dropped
+	assert.Equal(t, uint32(0x04123456), bigToCompact(big.NewInt(0x12345678)))
+}
+
+func TestVerifyHashVsTarget(t *testing.T) {
+	bits := uint32(0x1f00ffff) //0x0000ffff00...
+	assert.True(t, verifyHashVsTarget("0000ff0000000000000000000000000000000000000000000000000000000000", bits))
+	assert.True(t, verifyHashVsTarget("0000ffff00000000000000000000000000000000000000000000000000000000", bits))
+	assert.False(t, verifyHashVsTarget("0000ffff00000000000000000000000000000000000000000000000000000001", bits))
+	assert.False(t, verifyHashVsTarget("0001000000000000000000000000000000000000000000000000000000000000", bits))
+	assert.False(t, verifyHashVsTarget("not a hash", bits))
+	assert.False(t, verifyHashVsTarget("00", 0), "Zero target is not valid")
+	assert.False(t, verifyHashVsTarget("00", MAX_TARGET_BITS+1), "Target above max is not valid")
+}
+
+func TestAdjustedBits(t *testing.T) {
+	bits := uint32(0x1f00ffff)
+	expected := time.Duration(BLOCK_GENERATION_INTERVAL*DIFFICULTY_ADJUSTMENT_INTERVAL) * time.Second
+	adjust := func(timeTaken time.Duration) uint32 {
+		chain := make([]Block, DIFFICULTY_ADJUSTMENT_INTERVAL)
+		for i := range chain {
+			chain[i] = Block{Index: i + 1, Timestamp: GenesisTime, Bits: bits}
+		}
+		last := &chain[len(chain)-1]
+		last.Timestamp = last.Timestamp.Add(timeTaken)
+		return getAdjustedBits(*last, chain)
+	}
+	//on time keeps the target, double time doubles the target, half time halves it
+	assert.Equal(t, bits, adjust(expected))
+	assert.Equal(t, uint32(0x1f01fffe), adjust(expected*2))
+	assert.Equal(t, uint32(0x1e7fff80), adjust(expected/2))
+	//changes are clamped to MAX_ADJUSTMENT_FACTOR
+	assert.Equal(t, adjust(expected/4), adjust(time.Second))
+	assert.Equal(t, adjust(expected*4), adjust(expected*100))
+	//never easier than the max target
+	bits = MAX_TARGET_BITS
+	assert.Equal(t, MAX_TARGET_BITS, adjust(expected*4))
+}
+
+func TestBlockWork(t *testing.T) {
+	//a 4x smaller target should take 4x more work to find
+	target := compactToBig(0x1f00ffff)
+	smaller := bigToCompact(target.Div(target, big.NewInt(4)))
+	work := blockWork(0x1f00ffff)
+	assert.Equal(t, work.Mul(work, big.NewInt(4)), blockWork(smaller))
+	assert.Equal(t, big.NewInt(0), blockWork(0))
+}
+
+func TestMinerFindsBlock(t *testing.T) {
+	bc := newTestChain()
+	bc.CreateTestChain(GenesisAddress, 1)
+	template, _ := bc.newBlockTemplate(GenesisAddress, nil, "miner test")
+	//1 in 256 hashes should meet this target
+	template.Bits = 0x2000ffff
+	miner := NewMiner(4)
+	block, err := miner.Mine(context.Background(), template)
+	assert.NoError(t, err)
+	assert.Equal(t, hash(&block), block.Hash)
+	assert.True(t, verifyHashVsTarget(block.Hash, block.Bits))
+
+	stats := miner.Stats()
+	assert.False(t, stats.Mining)
+	assert.Equal(t, 4, stats.Workers)
+	assert.Equal(t, 1, stats.BlocksFound)
+	assert.True(t, stats.Attempts > 0)
+	assert.True(t, stats.HashRate > 0)
+}
+
+func TestMinerCancel(t *testing.T) {
+	template := Block{Index: 2, Timestamp: GenesisTime, Bits: 0x03000001} //target of 1, practically impossible
+	miner := NewMiner(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := miner.Mine(ctx, template)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	stats := miner.Stats()
+	assert.False(t, stats.Mining)
+	assert.Equal(t, 0, stats.BlocksFound)
+	assert.True(t, stats.Attempts > 0)
+	assert.True(t, stats.Elapsed >= 100*time.Millisecond)
+}
+
+//mining should stop when another block is added to the chain, and not leave the chain locked during search
+func TestMiningStopsOnNewTip(t *testing.T) {
+	bc := newTestChain()
+	bc.CreateTestChain(GenesisAddress, 1)
+	template, tipChanged := bc.newBlockTemplate(GenesisAddress, nil, "never found")
+	template.Bits = 0x03000001
+	miner := NewMiner(2)
+	result := make(chan error)
+	go func() {
+		_, err := bc.mineOnTip(context.Background(), miner, template, tipChanged)
+		result <- err
+	}()
+	for !miner.Stats().Mining {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, miner.Stats().Mining)
+	_, err := bc.CreateBlock(GenesisAddress, nil, "new tip")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrTipChanged, <-result)
+	assert.Equal(t, 3, bc.Height())
+}
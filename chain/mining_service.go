@@ -0,0 +1,160 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+//MiningService keeps mining blocks on top of the chain in the background until stopped.
+//each block includes the final transactions in the mempool at the time mining the block started.
+//mining restarts on the new tip whenever another block is added to the chain, and with a new template
+//including the new transactions when the mempool changes, at most once every TEMPLATE_REFRESH_INTERVAL
+type MiningService struct {
+	chain   *Blockchain
+	miner   *Miner
+	lock    sync.Mutex         //guards the fields below
+	payout  string             //address to pay the coinbase of mined blocks to
+	running bool               //true while the mining loop is running
+	cancel  context.CancelFunc //stops the mining loop
+	done    chan struct{}      //closed when the mining loop exits
+	lastErr error              //last error from mining, other than tip changes
+	txCount int                //number of transactions, besides the coinbase, in the block being mined
+}
+
+var TEMPLATE_REFRESH_INTERVAL = time.Second //min time between new block templates for mempool changes
+
+//MiningStatus describes the state of a MiningService
+type MiningStatus struct {
+	Running       bool       //true if the service is mining
+	PayoutAddress string     //address mined blocks pay to
+	Height        int        //current height of the chain being mined on
+	Stats         MinerStats //stats of the miner
+	LastError     string     //last error from mining, if any
+	Transactions  int        //number of transactions, besides the coinbase, in the block being mined
+}
+
+//ErrMiningRunning is returned when trying to start mining that is already running
+var ErrMiningRunning = errors.New("mining already running")
+
+//NewMiningService creates a stopped mining service for the given chain, with given number of miner workers (<= 0 for one per cpu)
+//and paying the mined coins to the given address
+func NewMiningService(bc *Blockchain, workers int, payoutAddress string) *MiningService {
+	return &MiningService{chain: bc, miner: NewMiner(workers), payout: payoutAddress}
+}
+
+//SetPayoutAddress changes the address mined blocks pay to. takes effect from the next block template
+func (ms *MiningService) SetPayoutAddress(address string) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	log.Println("Mining payout address set to", address)
+	ms.payout = address
+}
+
+//PayoutAddress gives the address mined blocks pay to
+func (ms *MiningService) PayoutAddress() string {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.payout
+}
+
+//Start starts mining in the background. returns ErrMiningRunning if already started
+func (ms *MiningService) Start() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.running {
+		return ErrMiningRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ms.running = true
+	ms.cancel = cancel
+	ms.done = make(chan struct{})
+	ms.lastErr = nil
+	go ms.mineLoop(ctx, ms.done)
+	log.Println("Mining started")
+	return nil
+}
+
+//Stop stops mining and waits for the mining loop to exit. does nothing if not running
+func (ms *MiningService) Stop() {
+	ms.lock.Lock()
+	if !ms.running {
+		ms.lock.Unlock()
+		return
+	}
+	ms.cancel()
+	done := ms.done
+	ms.lock.Unlock()
+	<-done
+	log.Println("Mining stopped")
+}
+
+//Status gives the current state of the service
+func (ms *MiningService) Status() MiningStatus {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	errStr := ""
+	if ms.lastErr != nil {
+		errStr = ms.lastErr.Error()
+	}
+	return MiningStatus{ms.running, ms.payout, ms.chain.Height(), ms.miner.Stats(), errStr, ms.txCount}
+}
+
+//mineLoop mines blocks one after another until the context is cancelled, and closes done when exiting
+func (ms *MiningService) mineLoop(ctx context.Context, done chan struct{}) {
+	defer func() {
+		ms.lock.Lock()
+		ms.running = false
+		ms.lock.Unlock()
+		close(done)
+	}()
+	for ctx.Err() == nil {
+		payout := ms.PayoutAddress()
+		mempoolChanged := ms.chain.MempoolChanged()
+		txs := ms.chain.MempoolFinal()
+		ms.lock.Lock()
+		ms.txCount = len(txs)
+		ms.lock.Unlock()
+		templateCtx, cancel := context.WithCancel(ctx)
+		go refreshOnMempoolChange(templateCtx, cancel, mempoolChanged, time.Now().Add(TEMPLATE_REFRESH_INTERVAL))
+		block, err := ms.chain.MineBlock(templateCtx, ms.miner, payout, txs, "Mined by node")
+		cancel()
+		switch {
+		case err == nil:
+			log.Println("Mined block", block.Index, "with", len(block.Transactions), "transactions")
+		case errors.Is(err, ErrTipChanged):
+			log.Println("Chain tip changed, restarting mining on new tip")
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, context.Canceled):
+			log.Println("Mempool changed, restarting mining with new transactions")
+		default:
+			log.Println("Mining failed, retrying:", err)
+			ms.lock.Lock()
+			ms.lastErr = err
+			ms.lock.Unlock()
+			//wait a bit so a persistent error does not spin the loop
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+//refreshOnMempoolChange cancels mining the current template when the mempool changes, but not before the given time,
+//so a stream of new transactions does not keep restarting the search
+func refreshOnMempoolChange(ctx context.Context, cancel context.CancelFunc, mempoolChanged <-chan struct{}, refreshAt time.Time) {
+	select {
+	case <-mempoolChanged:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-time.After(time.Until(refreshAt)):
+		cancel()
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//waitFor polls the given condition until it is true or the timeout passes
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+//start the mining service, check it mines blocks with pending transactions to the payout address, and stops when asked
+func TestMiningService(t *testing.T) {
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 1)
+	tx, err := bc.SendCoins(privKey, "receiver", 10, 0)
+	assert.NoError(t, err)
+
+	ms := NewMiningService(bc, 2, "miner")
+	assert.False(t, ms.Status().Running)
+	assert.NoError(t, ms.Start())
+	assert.Equal(t, ErrMiningRunning, ms.Start())
+	assert.True(t, waitFor(10*time.Second, func() bool { return bc.BalanceFor("receiver") == 10 }))
+	assert.Empty(t, bc.Mempool())
+
+	//change payout while running, later blocks should pay to the new address
+	ms.SetPayoutAddress("miner2")
+	assert.True(t, waitFor(10*time.Second, func() bool { return bc.BalanceFor("miner2") > 0 }))
+	ms.Stop()
+
+	status := ms.Status()
+	assert.False(t, status.Running)
+	assert.Equal(t, "miner2", status.PayoutAddress)
+	assert.Equal(t, bc.Height(), status.Height)
+	assert.True(t, status.Stats.BlocksFound >= 2)
+	assert.Equal(t, (bc.Height()-2)*INITIAL_SUBSIDY, bc.BalanceFor("miner")+bc.BalanceFor("miner2"))
+	assert.NoError(t, bc.validateChain(bc.Blocks()))
+	found := false
+	for _, block := range bc.Blocks() {
+		for _, blockTx := range block.Transactions {
+			found = found || blockTx.Id == tx.Id
+		}
+	}
+	assert.True(t, found)
+
+	//no more blocks after stopping, and stopping again does nothing
+	height := bc.Height()
+	ms.Stop()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, height, bc.Height())
+
+	//can be restarted
+	assert.NoError(t, ms.Start())
+	assert.True(t, waitFor(10*time.Second, func() bool { return bc.Height() > height }))
+	ms.Stop()
+}
+
+//transactions submitted while a block is being mined are picked up with a new template, without waiting for the block
+func TestMiningServiceRefresh(t *testing.T) {
+	defer func(interval time.Duration) { TEMPLATE_REFRESH_INTERVAL = interval }(TEMPLATE_REFRESH_INTERVAL)
+	TEMPLATE_REFRESH_INTERVAL = 50 * time.Millisecond
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 1)
+	//a target too hard to find a block during the test, so the template only changes with the mempool
+	bc.blocks[1].Bits = 0x1c00ffff
+
+	ms := NewMiningService(bc, 1, "miner")
+	assert.NoError(t, ms.Start())
+	defer ms.Stop()
+	assert.True(t, waitFor(10*time.Second, func() bool { return ms.Status().Stats.Mining }))
+	assert.Equal(t, 0, ms.Status().Transactions)
+	_, err := bc.SendCoins(privKey, "receiver", 10, 0)
+	assert.NoError(t, err)
+	assert.True(t, waitFor(10*time.Second, func() bool { return ms.Status().Transactions == 1 }))
+	_, err = bc.SendCoins(privKey, "receiver", 20, 0)
+	assert.NoError(t, err)
+	assert.True(t, waitFor(10*time.Second, func() bool { return ms.Status().Transactions == 2 }))
+	assert.Equal(t, 2, bc.Height())
+}
@@ -0,0 +1,243 @@
+package chain
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/mukatee/go-naive/cryptoff"
+	"log"
+)
+
+//coins held by a multisig address need the signatures of several owners to spend, and the owners usually do not share
+//their keys or even a machine. so the spending transaction is created as a PartialTx, which is passed from one owner to
+//the next (e.g. as a JSON file), each adding their signatures. once enough owners have signed, Finalize gives the
+//transaction with the unlocking scripts filled in, ready to submit.
+//
+//all signatures are over the sighash of the transaction, which does not include the unlocking scripts (see sigHash).
+//so the owners can sign in any order, and the transaction cannot be changed after the first signature without
+//making the signatures invalid.
+//
+//https://github.com/bitcoin/bips/blob/master/bip-0174.mediawiki
+
+//PartialTx is a transaction collecting the signatures of the owners of the txouts it spends
+type PartialTx struct {
+	Tx     Transaction   //the transaction, with the unlocking scripts and the id left empty until finalized
+	Inputs []PartialTxIn //for each txin of the transaction, the txout it spends and the signatures collected for it
+}
+
+//PartialTxIn is the signing state of one txin in a PartialTx
+type PartialTxIn struct {
+	Spent      UnspentTxOut      //the txout the txin spends, so signers can see the amount and the script without the chain
+	Signatures map[string]string //signature over the sighash for each public key that has signed
+}
+
+//ErrNotSigner is returned when signing a PartialTx with a key that none of its txins need
+var ErrNotSigner = errors.New("key is not a signer for any txin")
+
+//MultisigAddress gives the address for coins that need signatures from m of the given public keys to spend.
+//the order of the keys matters, the same keys in another order give another address
+func MultisigAddress(m int, pubKeys []string) (string, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > MAX_MULTISIG_KEYS {
+		return "", fmt.Errorf("multisig needs 1 to %d public keys, got %d", MAX_MULTISIG_KEYS, len(pubKeys))
+	}
+	if m < 1 || m > len(pubKeys) {
+		return "", fmt.Errorf("multisig needs 1 to %d signatures, got %d", len(pubKeys), m)
+	}
+	seen := make(map[string]bool)
+	for _, pubKey := range pubKeys {
+		key := cryptoff.DecodePublicKey(pubKey)
+		if !cryptoff.Curve.IsOnCurve(key.X, key.Y) {
+			return "", fmt.Errorf("invalid public key %s", pubKey)
+		}
+		if seen[pubKey] {
+			return "", fmt.Errorf("public key %s given twice", pubKey)
+		}
+		seen[pubKey] = true
+	}
+	return ScriptAddress(MultisigScript(m, pubKeys)), nil
+}
+
+//scriptSigners gives the signatures needed and the public keys that can give them, for a PubKeyScript or a MultisigScript.
+//returns false for other scripts, as those are not unlocked with just signatures
+func scriptSigners(script Script) (int, []string, bool) {
+	var ops []byte
+	var pushes [][]byte
+	for pc := 0; pc < len(script); {
+		op, data, next, err := nextOp(script, pc)
+		if err != nil {
+			return 0, nil, false
+		}
+		ops = append(ops, op)
+		pushes = append(pushes, data)
+		pc = next
+	}
+	isKey := func(i int) bool {
+		return ops[i] > OP_0 && ops[i] <= OP_PUSHDATA2 && len(pushes[i]) > 0
+	}
+	if len(ops) == 2 && isKey(0) && ops[1] == OP_CHECKSIG {
+		return 1, []string{string(pushes[0])}, true
+	}
+	last := len(ops) - 1
+	if len(ops) < 4 || ops[last] != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	number := func(i int) int {
+		if ops[i] >= OP_1 && ops[i] <= OP_16 {
+			return int(ops[i]-OP_1) + 1
+		}
+		if ops[i] == OP_0 || ops[i] > OP_PUSHDATA2 {
+			return -1
+		}
+		n, err := scriptNumber(pushes[i])
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	m := number(0)
+	n := number(last - 1)
+	if n != last-2 || m < 1 || m > n {
+		return 0, nil, false
+	}
+	var pubKeys []string
+	for i := 1; i < last-1; i++ {
+		if !isKey(i) {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, string(pushes[i]))
+	}
+	return m, pubKeys, true
+}
+
+//CreatePartialTx creates a transaction sending "count" coins to the "to" address from the given address, paying the given fee.
+//the change goes back to the from address. the transaction is not signed or submitted, it is returned for the owners
+//of the from address to sign, see PartialTx. coins already spent by transactions in the mempool are not used
+func (bc *Blockchain) CreatePartialTx(from string, to string, count int, fee int) (PartialTx, error) {
+	log.Print("Creating partial tx to send ", count, " coins with fee ", fee, " from ", from, " to ", to)
+	if fee < 0 {
+		return PartialTx{}, fmt.Errorf("negative fee %d", fee)
+	}
+	if _, _, ok := scriptSigners(AddressScript(from)); !ok {
+		return PartialTx{}, fmt.Errorf("address %s is not spent with signatures", from)
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	txIns, total := bc.findTxInsFor(from, count+fee)
+	if total < count+fee {
+		return PartialTx{}, fmt.Errorf("%w: sender has %d, less than %d", ErrInsufficientFunds, total, count+fee)
+	}
+	ptx := PartialTx{Tx: Transaction{"", txIns, SplitTxIns(from, to, count, fee, total), 0}}
+	view := bc.mempoolView()
+	for _, txIn := range txIns {
+		utxo, _ := view.get(txIn.TxId, txIn.TxIdx)
+		ptx.Inputs = append(ptx.Inputs, PartialTxIn{utxo, make(map[string]string)})
+	}
+	log.Print("Partial tx created with ", len(txIns), " txins")
+	return ptx, nil
+}
+
+//check verifies the inputs match the txins of the transaction, as a PartialTx may come from a file edited by anyone
+func (ptx *PartialTx) check() error {
+	if len(ptx.Inputs) != len(ptx.Tx.TxIns) {
+		return fmt.Errorf("partial tx has %d inputs for %d txins", len(ptx.Inputs), len(ptx.Tx.TxIns))
+	}
+	for i, txIn := range ptx.Tx.TxIns {
+		spent := ptx.Inputs[i].Spent
+		if spent.TxId != txIn.TxId || spent.TxIdx != txIn.TxIdx {
+			return fmt.Errorf("partial tx input %d is not for txin %s:%d", i, txIn.TxId, txIn.TxIdx)
+		}
+		if spent.Address != ScriptAddress(spent.Script) {
+			return fmt.Errorf("partial tx input %d address does not match its script", i)
+		}
+	}
+	return nil
+}
+
+//Sign adds the signature of the given key to each txin spending a txout the key is a signer for.
+//returns the number of txins signed, and ErrNotSigner if there were none
+func (ptx *PartialTx) Sign(privKey *ecdsa.PrivateKey) (int, error) {
+	err := ptx.check()
+	if err != nil {
+		return 0, err
+	}
+	pubKey := cryptoff.EncodePublicKey(&privKey.PublicKey)
+	msg := sigHash(ptx.Tx)
+	signed := 0
+	for i := range ptx.Inputs {
+		input := &ptx.Inputs[i]
+		_, pubKeys, _ := scriptSigners(input.Spent.Script)
+		if stringInSlice(pubKey, pubKeys) < 0 {
+			continue
+		}
+		if input.Signatures == nil {
+			input.Signatures = make(map[string]string)
+		}
+		input.Signatures[pubKey] = signData(privKey, msg)
+		signed++
+	}
+	log.Print("Signed ", signed, " txins of partial tx")
+	if signed == 0 {
+		return 0, ErrNotSigner
+	}
+	return signed, nil
+}
+
+//validSignatures gives the valid signatures collected for the input in the order of the keys in its script,
+//and the number of signatures the script needs
+func (input PartialTxIn) validSignatures(msg []byte) ([][]byte, int) {
+	m, pubKeys, ok := scriptSigners(input.Spent.Script)
+	if !ok {
+		return nil, 0
+	}
+	var sigs [][]byte
+	for _, pubKey := range pubKeys {
+		sig, found := input.Signatures[pubKey]
+		if found && cryptoff.VerifySignature(cryptoff.DecodePublicKey(pubKey), msg, sig) {
+			sigs = append(sigs, []byte(sig))
+		}
+	}
+	return sigs, m
+}
+
+//Missing gives the number of signatures each txin still needs before the transaction can be finalized
+func (ptx PartialTx) Missing() []int {
+	msg := sigHash(ptx.Tx)
+	missing := make([]int, len(ptx.Inputs))
+	for i, input := range ptx.Inputs {
+		sigs, m := input.validSignatures(msg)
+		if m == 0 {
+			//no signatures can unlock the script
+			m = 1
+		}
+		if len(sigs) < m {
+			missing[i] = m - len(sigs)
+		}
+	}
+	return missing
+}
+
+//Finalize gives the signed transaction, with the unlocking script of each txin built from the collected signatures.
+//fails if any txin does not have enough valid signatures yet
+func (ptx PartialTx) Finalize() (Transaction, error) {
+	err := ptx.check()
+	if err != nil {
+		return Transaction{}, err
+	}
+	msg := sigHash(ptx.Tx)
+	tx := ptx.Tx
+	tx.TxIns = make([]TxIn, len(ptx.Tx.TxIns))
+	for i, txIn := range ptx.Tx.TxIns {
+		sigs, m := ptx.Inputs[i].validSignatures(msg)
+		if m == 0 {
+			return Transaction{}, fmt.Errorf("txin %d spends a script not unlocked with signatures", i)
+		}
+		if len(sigs) < m {
+			return Transaction{}, fmt.Errorf("txin %d has %d of %d signatures needed", i, len(sigs), m)
+		}
+		txIn.Script = UnlockScript(sigs[:m]...)
+		tx.TxIns[i] = txIn
+	}
+	tx.Id = calculateTxId(tx)
+	log.Print("Finalized partial tx as ", tx.Id)
+	return tx, nil
+}
@@ -0,0 +1,110 @@
+package chain
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMultisigAddress(t *testing.T) {
+	_, _, address1 := cryptoff.CreateAddress()
+	_, _, address2 := cryptoff.CreateAddress()
+	address, err := MultisigAddress(2, []string{address1, address2})
+	assert.NoError(t, err)
+	assert.Equal(t, ScriptAddress(MultisigScript(2, []string{address1, address2})), address)
+	m, pubKeys, ok := scriptSigners(AddressScript(address))
+	assert.True(t, ok)
+	assert.Equal(t, 2, m)
+	assert.Equal(t, []string{address1, address2}, pubKeys)
+
+	_, err = MultisigAddress(3, []string{address1, address2})
+	assert.Error(t, err)
+	_, err = MultisigAddress(0, []string{address1, address2})
+	assert.Error(t, err)
+	_, err = MultisigAddress(1, []string{address1, address1})
+	assert.Error(t, err)
+	_, err = MultisigAddress(1, []string{address1, "not a key"})
+	assert.Error(t, err)
+	_, err = MultisigAddress(1, nil)
+	assert.Error(t, err)
+
+	m, pubKeys, ok = scriptSigners(PubKeyScript(address1))
+	assert.True(t, ok)
+	assert.Equal(t, 1, m)
+	assert.Equal(t, []string{address1}, pubKeys)
+	_, _, ok = scriptSigners(HashLockScript([]byte{1, 2}))
+	assert.False(t, ok)
+}
+
+//spend from a 2 of 3 multisig address, passing the partial transaction between the owners as JSON
+func TestSignPartialTx(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	privKey2, _, address2 := cryptoff.CreateAddress()
+	privKey3, _, address3 := cryptoff.CreateAddress()
+	shared, err := MultisigAddress(2, []string{address1, address2, address3})
+	assert.NoError(t, err)
+	bc.CreateTestChain(address1, 1)
+	_, err = bc.SendCoins(privKey1, shared, 600, 0)
+	assert.NoError(t, err)
+	_, err = bc.MinePending("miner", "fund")
+	assert.NoError(t, err)
+	assert.Equal(t, 600, bc.BalanceFor(shared))
+
+	_, err = bc.CreatePartialTx(shared, "receiver", 600, 10)
+	assert.True(t, errors.Is(err, ErrInsufficientFunds))
+	_, err = bc.CreatePartialTx(ScriptAddress(HashLockScript([]byte{1})), "receiver", 1, 0)
+	assert.Error(t, err)
+	ptx, err := bc.CreatePartialTx(shared, "receiver", 500, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, ptx.Missing())
+
+	//pass to the first owner and back
+	passOn := func(ptx PartialTx) PartialTx {
+		data, err := json.Marshal(ptx)
+		assert.NoError(t, err)
+		var received PartialTx
+		assert.NoError(t, json.Unmarshal(data, &received))
+		return received
+	}
+	ptx = passOn(ptx)
+	signed, err := ptx.Sign(privKey1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, signed)
+	_, err = ptx.Sign(privKey1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, ptx.Missing())
+	_, err = ptx.Finalize()
+	assert.Error(t, err)
+	other, _, _ := cryptoff.CreateAddress()
+	_, err = ptx.Sign(other)
+	assert.True(t, errors.Is(err, ErrNotSigner))
+
+	ptx = passOn(ptx)
+	//changing the transaction after signing makes the earlier signatures invalid
+	changed := passOn(ptx)
+	changed.Tx.TxOuts[0].Amount++
+	_, err = changed.Sign(privKey3)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, changed.Missing())
+
+	_, err = ptx.Sign(privKey3)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0}, ptx.Missing())
+	tx, err := passOn(ptx).Finalize()
+	assert.NoError(t, err)
+	assert.NoError(t, bc.SubmitTransaction(tx))
+	_, err = bc.MinePending("miner", "spend")
+	assert.NoError(t, err)
+	assert.Equal(t, 500, bc.BalanceFor("receiver"))
+	assert.Equal(t, 90, bc.BalanceFor(shared))
+
+	//inputs not matching the txins are rejected
+	ptx.Inputs = ptx.Inputs[:0]
+	_, err = ptx.Sign(privKey2)
+	assert.Error(t, err)
+	_, err = ptx.Finalize()
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+//when the fork choice switches to another chain, the blocks of the current chain after the fork point are disconnected,
+//and the blocks of the new chain after it are connected one by one with full validation.
+//disconnecting a block removes the txouts its transactions created, and restores the ones they spent from the undo data
+//recorded when the block was connected. non-coinbase transactions from disconnected blocks are returned to the mempool
+//if they are still valid on the new chain
+
+//BlockUndo holds what is needed to disconnect a block from the chain
+type BlockUndo struct {
+	Spent [][]UnspentTxOut //for each transaction in the block, the unspent txouts it spent
+}
+
+//ReorgEvent describes a switch from one chain to another that disconnected blocks from the old chain
+type ReorgEvent struct {
+	OldTip      string //hash of the last block before the switch
+	NewTip      string //hash of the last block after the switch
+	ForkIndex   int    //index of the last block common to both chains
+	Depth       int    //number of blocks disconnected from the old chain
+	Connected   int    //number of blocks connected from the new chain
+	Resurrected int    //number of transactions from disconnected blocks returned to the mempool
+}
+
+//how many events a subscriber channel holds before further events are dropped for it
+const reorgEventBuffer = 16
+
+//SubscribeReorgs gives a channel that receives an event for each chain reorganization.
+//events are dropped for a subscriber that does not keep up
+func (bc *Blockchain) SubscribeReorgs() <-chan ReorgEvent {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	events := make(chan ReorgEvent, reorgEventBuffer)
+	bc.reorgSubscribers = append(bc.reorgSubscribers, events)
+	return events
+}
+
+//notifyReorg sends the event to all subscribers, without waiting for any of them
+func (bc *Blockchain) notifyReorg(event ReorgEvent) {
+	for _, subscriber := range bc.reorgSubscribers {
+		select {
+		case subscriber <- event:
+		default:
+			log.Println("Reorg subscriber not keeping up, dropping event")
+		}
+	}
+}
+
+//findForkPoint gives the position of the last block that is the same in both chains, or -1 if even the first ones differ
+func findForkPoint(chain1 []Block, chain2 []Block) int {
+	fork := -1
+	for i := 0; i < len(chain1) && i < len(chain2); i++ {
+		if chain1[i].Hash != chain2[i].Hash {
+			break
+		}
+		fork = i
+	}
+	return fork
+}
+
+//ErrNoCommonGenesis is returned when trying to switch to a chain with a different genesis block
+var ErrNoCommonGenesis = errors.New("chain does not share genesis with current chain")
+
+//ErrRestoreFailed is returned when a switch to another chain fails, and the old chain cannot be restored either.
+//the chain and the unspent txouts then match each other, but are somewhere between the old and the new tip
+var ErrRestoreFailed = errors.New("failed to restore old chain")
+
+//reorganize switches the current chain to the given already validated one, which must share at least the genesis block with it.
+//if a block of the new chain is not valid, the current chain is restored and the error for that block returned.
+//if the old chain cannot be restored, the error wraps ErrRestoreFailed as well as the error for the block
+func (bc *Blockchain) reorganize(newChain []Block) error {
+	fork := findForkPoint(bc.blocks, newChain)
+	if fork < 0 {
+		log.Println("New chain does not share genesis with current chain, not switching")
+		return ErrNoCommonGenesis
+	}
+	oldTip := bc.blocks[len(bc.blocks)-1]
+	log.Println("Reorganizing chain from block", bc.blocks[fork].Index, ", disconnecting", len(bc.blocks)-1-fork, "blocks")
+	//keep the mempool aside while blocks are disconnected and connected, so nothing in it gets evicted halfway
+	pending := bc.mempool
+	bc.mempool = nil
+	disconnected := []Block{}
+	for len(bc.blocks)-1 > fork {
+		block, err := bc.disconnectTip()
+		if err != nil {
+			restoreErr := bc.reconnectBlocks(disconnected)
+			bc.resubmitToMempool(pending, nil)
+			if restoreErr != nil {
+				return bc.restoreFailed(err, restoreErr)
+			}
+			return err
+		}
+		disconnected = append(disconnected, block)
+	}
+	for _, block := range newChain[fork+1:] {
+		err := bc.addBlock(block)
+		if err != nil {
+			log.Println("Block in new chain is invalid, restoring old chain:", err)
+			var restoreErr error
+			for len(bc.blocks)-1 > fork && restoreErr == nil {
+				_, restoreErr = bc.disconnectTip()
+			}
+			if restoreErr == nil {
+				restoreErr = bc.reconnectBlocks(disconnected)
+			}
+			bc.resubmitToMempool(pending, nil)
+			if restoreErr != nil {
+				return bc.restoreFailed(err, restoreErr)
+			}
+			return err
+		}
+	}
+	mined := make(map[string]bool)
+	for _, block := range newChain[fork+1:] {
+		for _, tx := range block.Transactions {
+			mined[tx.Id] = true
+		}
+	}
+	//transactions from disconnected blocks go back first, as the pending ones may spend their txouts
+	orphaned := []Transaction{}
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for idx, tx := range disconnected[i].Transactions {
+			if idx == 0 && isCoinbase(tx) {
+				//coinbase is only valid in its own block
+				continue
+			}
+			orphaned = append(orphaned, tx)
+		}
+	}
+	resurrected := bc.resubmitToMempool(orphaned, mined)
+	bc.resubmitToMempool(pending, mined)
+	if len(disconnected) > 0 {
+		event := ReorgEvent{oldTip.Hash, bc.blocks[len(bc.blocks)-1].Hash, bc.blocks[fork].Index, len(disconnected), len(newChain) - 1 - fork, resurrected}
+		log.Println("Chain reorganized:", event)
+		bc.notifyReorg(event)
+	}
+	return nil
+}
+
+//reconnectBlocks adds back the blocks disconnected from the old chain, given in the order they were disconnected
+func (bc *Blockchain) reconnectBlocks(disconnected []Block) error {
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		err := bc.addBlock(disconnected[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//restoreFailed gives the error for a chain switch that failed with err, where restoring the old chain then failed with restoreErr
+func (bc *Blockchain) restoreFailed(err error, restoreErr error) error {
+	tip := bc.blocks[len(bc.blocks)-1]
+	log.Println("Failed to restore old chain, chain left at block", tip.Index, tip.Hash, ":", restoreErr)
+	//err first, so errors.As finds the invalid block of the new chain before any error from the old one
+	return fmt.Errorf("%w at block %d after switching failed (%w): %w", ErrRestoreFailed, tip.Index, err, restoreErr)
+}
+
+//resubmitToMempool adds the given transactions to the mempool, dropping the mined ones and any no longer valid. returns the number added
+func (bc *Blockchain) resubmitToMempool(txs []Transaction, mined map[string]bool) int {
+	added := 0
+	for _, tx := range txs {
+		if mined[tx.Id] || bc.addToMempool(tx) != nil {
+			log.Println("Dropped transaction after chain change:", tx.Id)
+			continue
+		}
+		added++
+	}
+	return added
+}
+
+//disconnectTip removes the last block from the chain, undoing the changes its transactions made to the unspent txouts:
+//the txouts the block created are removed, and the ones it spent are restored from the undo record stored when it was connected
+func (bc *Blockchain) disconnectTip() (Block, error) {
+	last := len(bc.blocks) - 1
+	block := bc.blocks[last]
+	log.Println("Disconnecting block", block.Index, block.Hash)
+	undo, found, err := bc.utxos.Undo(block.Hash)
+	if err == nil && !found {
+		err = fmt.Errorf("no undo data for block %s", block.Hash)
+	}
+	if err != nil {
+		log.Println("Cannot disconnect block:", err)
+		return Block{}, err
+	}
+	update := UtxoUpdate{Tip: block.PreviousHash, Block: block.Hash}
+	for i, tx := range block.Transactions {
+		update.Removed = append(update.Removed, txOutsOf(tx, block.Index)...)
+		update.Added = append(update.Added, undo.Spent[i]...)
+	}
+	err = bc.utxos.Apply(update)
+	if err != nil {
+		log.Println("Cannot disconnect block:", err)
+		return Block{}, err
+	}
+	//the full slice expression makes the next append copy, so blocks handed out before are not overwritten
+	bc.blocks = bc.blocks[:last:last]
+	bc.notifyTipChanged()
+	return block, nil
+}
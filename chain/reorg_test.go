@@ -0,0 +1,137 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//appendTestBlock mines a block with the given transactions after a coinbase on top of the given blocks, without validating it
+func appendTestBlock(blocks []Block, txs []Transaction) []Block {
+	prev := blocks[len(blocks)-1]
+	txs = append([]Transaction{CreateCoinbaseTx("appended", prev.Index+1, 0)}, txs...)
+	//unique data keeps blocks appended on the same parent apart, whatever the clock resolution
+	data := fmt.Sprintf("Appended%d-%d", prev.Index+1, time.Now().UnixNano())
+	block := Block{prev.Index + 1, "", prev.Hash, time.Now().UTC(), data, txs, "", nextBitsFor(blocks), 0}
+	return append(append([]Block{}, blocks...), mineBlock(block))
+}
+
+//switch to a longer fork, check the utxos match the new chain and the orphaned transaction is back in the mempool.
+//then try a longer fork with an invalid block, and check the chain is restored as it was
+func TestReorg(t *testing.T) {
+	privKey, _, address := cryptoff.CreateAddress()
+	bc := newTestChain()
+	base := bc.CreateTestChain(address, 3)
+	events := bc.SubscribeReorgs()
+
+	//old branch: a payment and one more block
+	tx, err := bc.SendCoins(privKey, "receiver", 100, 0)
+	assert.NoError(t, err)
+	_, err = bc.MinePending(address, "old branch")
+	assert.NoError(t, err)
+	_, err = bc.CreateBlock(address, nil, "old branch 2")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, bc.BalanceFor("receiver"))
+	assert.Empty(t, bc.Mempool())
+
+	//new branch: three blocks to another miner
+	alt := newTestChain()
+	setTestChain(t, alt, base)
+	for i := 0; i < 3; i++ {
+		_, err = alt.CreateBlock("altminer", nil, "new branch")
+		assert.NoError(t, err)
+	}
+	oldTip := bc.Blocks()[5].Hash
+	assert.True(t, bc.takeLongestChain(alt.Blocks()))
+	assert.Equal(t, alt.Blocks(), bc.Blocks())
+	assert.Equal(t, ReorgEvent{oldTip, alt.Blocks()[6].Hash, 4, 2, 3, 1}, <-events)
+
+	//state matches a chain built directly from the new blocks, with the payment waiting in the mempool again
+	reference := newTestChain()
+	setTestChain(t, reference, alt.Blocks())
+	assert.ElementsMatch(t, allUtxos(t, reference), allUtxos(t, bc))
+	_, found, _ := bc.utxos.Undo(oldTip)
+	assert.False(t, found)
+	assert.Equal(t, 0, bc.BalanceFor("receiver"))
+	assert.Equal(t, 3*INITIAL_SUBSIDY, bc.BalanceFor("altminer"))
+	assert.Equal(t, []Transaction{tx}, bc.Mempool())
+
+	//a longer fork with a double spend in its first block passes the header checks, but fails when connected
+	spend, err := alt.SendCoins(privKey, "double", 10, 0)
+	assert.NoError(t, err)
+	bad := appendTestBlock(base, []Transaction{spend, spend})
+	for i := 0; i < 4; i++ {
+		bad = appendTestBlock(bad, nil)
+	}
+	assert.NoError(t, bc.validateChain(bad))
+	before := bc.Blocks()
+	utxosBefore := allUtxos(t, bc)
+	assert.False(t, bc.takeLongestChain(bad))
+	assert.Equal(t, before, bc.Blocks())
+	assert.ElementsMatch(t, utxosBefore, allUtxos(t, bc))
+	assert.Equal(t, []Transaction{tx}, bc.Mempool())
+	assert.Empty(t, events)
+}
+
+//failingUtxoStore fails connecting or disconnecting the given blocks, to test what happens on storage errors
+type failingUtxoStore struct {
+	UtxoStore
+	failConnect    string //hash of the block to fail connecting
+	failDisconnect string //hash of the block to fail disconnecting
+}
+
+func (store *failingUtxoStore) Apply(update UtxoUpdate) error {
+	if update.Undo != nil && update.Block == store.failConnect {
+		return fmt.Errorf("test failure connecting block %s", update.Block)
+	}
+	if update.Undo == nil && update.Block == store.failDisconnect {
+		return fmt.Errorf("test failure disconnecting block %s", update.Block)
+	}
+	return store.UtxoStore.Apply(update)
+}
+
+//a switch that fails on an invalid block, and then fails to disconnect the new blocks to restore the old chain,
+//returns an error telling the chain was not restored, with the chain and utxos matching the block it was left at
+func TestReorgRestoreFails(t *testing.T) {
+	bc := newTestChain()
+	base := bc.CreateTestChain(GenesisAddress, 2)
+	store := &failingUtxoStore{UtxoStore: bc.utxos}
+	bc.utxos = store
+	_, err := bc.CreateBlock(GenesisAddress, nil, "old branch")
+	assert.NoError(t, err)
+	oldChain := bc.Blocks()
+
+	//a valid block and then one spending a txout that does not exist
+	missing := Transaction{"", []TxIn{{"missing", 0, nil, 0}}, []TxOut{TxOutTo("receiver", 10)}, 0}
+	missing.Id = calculateTxId(missing)
+	bad := appendTestBlock(base, nil)
+	bad = appendTestBlock(bad, []Transaction{missing})
+	bad = appendTestBlock(bad, nil)
+	assert.NoError(t, bc.validateChain(bad))
+	store.failDisconnect = bad[3].Hash
+
+	bc.lock.Lock()
+	err = bc.reorganize(bad)
+	bc.lock.Unlock()
+	assert.True(t, errors.Is(err, ErrRestoreFailed), "got %v", err)
+	assert.True(t, errors.Is(err, ErrMissingInput), "got %v", err)
+	//left on the valid block of the new chain, instead of the old tip
+	assert.Equal(t, bad[:4], bc.Blocks())
+	assert.NotEqual(t, oldChain, bc.Blocks())
+	reference := newTestChain()
+	setTestChain(t, reference, bad[:4])
+	assert.ElementsMatch(t, allUtxos(t, reference), allUtxos(t, bc))
+
+	//once disconnecting works again, the old chain is restored after the failed switch as before
+	store.failDisconnect = ""
+	setTestChain(t, bc, oldChain)
+	bc.lock.Lock()
+	err = bc.reorganize(bad)
+	bc.lock.Unlock()
+	assert.True(t, errors.Is(err, ErrMissingInput), "got %v", err)
+	assert.False(t, errors.Is(err, ErrRestoreFailed))
+	assert.Equal(t, oldChain, bc.Blocks())
+}
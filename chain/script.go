@@ -0,0 +1,538 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mukatee/go-naive/cryptoff"
+	"strings"
+)
+
+//each txout is locked with a script, and the txin spending it gives an unlocking script. to spend the txout,
+//the unlocking script is run first, and the locking script then on the stack it left. the spend is valid if the
+//locking script ends with a true value on top of the stack.
+//
+//the language is a small subset of the bitcoin script: data pushes, stack and hash operations, signature checks
+//and a lock on the block index. there are no loops or jumps, so a script always ends, and the limits below keep
+//the work for one script small. unlocking scripts may only push data, so they cannot change what the locking
+//script checks. signatures are over the sighash of the spending transaction (see sigHash), which leaves out
+//the unlocking scripts so they can be filled in after signing.
+//
+//standard locking scripts are built with PubKeyScript, PubKeyHashScript, MultisigScript, HashLockScript and
+//TimeLockScript, and unlocked with UnlockScript. a txout paying to a public key has that public key as its address,
+//other scripts have the script itself in the address, see ScriptAddress
+//
+//https://en.bitcoin.it/wiki/Script
+
+//Script is a locking or unlocking script, a sequence of opcodes and the data they push
+type Script []byte
+
+//opcodes of the script language, with the same values as in bitcoin.
+//opcodes 0x01-0x4b push the number of bytes given by the opcode
+const (
+	OP_0                   byte = 0x00 //push an empty value, which is false
+	OP_PUSHDATA1           byte = 0x4c //push the number of bytes given by the next byte
+	OP_PUSHDATA2           byte = 0x4d //push the number of bytes given by the next 2 bytes
+	OP_1                   byte = 0x51 //push the number 1, which is true. OP_2 to OP_16 follow it
+	OP_16                  byte = 0x60 //push the number 16
+	OP_VERIFY              byte = 0x69 //fail unless the top value is true, removing it
+	OP_RETURN              byte = 0x6a //fail, marks a txout that can never be spent
+	OP_DROP                byte = 0x75 //remove the top value
+	OP_DUP                 byte = 0x76 //duplicate the top value
+	OP_EQUAL               byte = 0x87 //replace the two top values with true if they are equal, false otherwise
+	OP_EQUALVERIFY         byte = 0x88 //OP_EQUAL and OP_VERIFY
+	OP_SHA256              byte = 0xa8 //replace the top value with its sha256 hash
+	OP_CHECKSIG            byte = 0xac //check the signature below the top public key, see checkSig
+	OP_CHECKSIGVERIFY      byte = 0xad //OP_CHECKSIG and OP_VERIFY
+	OP_CHECKMULTISIG       byte = 0xae //check m of n signatures, see checkMultisig
+	OP_CHECKMULTISIGVERIFY byte = 0xaf //OP_CHECKMULTISIG and OP_VERIFY
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1 //fail if the block index of the spend is below the top value, leaving it on the stack
+)
+
+//limits for a single script run. these are consensus rules, all nodes need to use the same values
+const (
+	MAX_SCRIPT_SIZE   = 10000 //bytes in a script
+	MAX_SCRIPT_OPS    = 201   //opcodes other than pushes in a script, each key of a multisig check counts as one
+	MAX_STACK_SIZE    = 1000  //values on the stack
+	MAX_PUSH_SIZE     = 520   //bytes in a single value pushed to the stack
+	MAX_MULTISIG_KEYS = 20    //public keys in a multisig check
+)
+
+const SCRIPT_ADDRESS_PREFIX = "script:" //start of the address of a locking script other than a PubKeyScript
+
+//ErrScriptFailed is returned when a script fails or breaks the rules of the language, wrapped with the reason
+var ErrScriptFailed = errors.New("script failed")
+
+var opNames = map[byte]string{
+	OP_0: "OP_0", OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN", OP_DROP: "OP_DROP", OP_DUP: "OP_DUP",
+	OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY", OP_SHA256: "OP_SHA256", OP_CHECKSIG: "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY", OP_CHECKMULTISIG: "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY", OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+func scriptError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrScriptFailed, fmt.Sprintf(format, args...))
+}
+
+//appendPush adds an opcode pushing the given data to the script
+func appendPush(script Script, data []byte) Script {
+	switch {
+	case len(data) == 0:
+		script = append(script, OP_0)
+	case len(data) <= 0x4b:
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		script = append(script, OP_PUSHDATA2)
+		script = binary.BigEndian.AppendUint16(script, uint16(len(data)))
+	}
+	return append(script, data...)
+}
+
+//appendNumber adds an opcode pushing the given number. 1-16 have their own opcodes, other numbers are pushed as data
+func appendNumber(script Script, number int) Script {
+	if number >= 1 && number <= 16 {
+		return append(script, OP_1+byte(number-1))
+	}
+	return appendPush(script, numberBytes(number))
+}
+
+//numberBytes gives the shortest big-endian bytes of a non-negative number, empty for zero
+func numberBytes(number int) []byte {
+	data := binary.BigEndian.AppendUint64(nil, uint64(number))
+	return bytes.TrimLeft(data, "\x00")
+}
+
+//scriptNumber reads a number from a stack value, big-endian and at most 4 bytes so it fits an int everywhere
+func scriptNumber(data []byte) (int, error) {
+	if len(data) > 4 {
+		return 0, scriptError("number of %d bytes", len(data))
+	}
+	number := 0
+	for _, b := range data {
+		number = number<<8 | int(b)
+	}
+	return number, nil
+}
+
+//PubKeyScript locks a txout to a public key (address): <pubkey> OP_CHECKSIG. unlocked with the signature of the key
+func PubKeyScript(pubKey string) Script {
+	return append(appendPush(nil, []byte(pubKey)), OP_CHECKSIG)
+}
+
+//PubKeyHash gives the hash of a public key (address) for PubKeyHashScript
+func PubKeyHash(pubKey string) []byte {
+	hash := sha256.Sum256([]byte(pubKey))
+	return hash[:]
+}
+
+//PubKeyHashScript locks a txout to the public key with the given hash: OP_DUP OP_SHA256 <hash> OP_EQUALVERIFY OP_CHECKSIG.
+//unlocked with the signature and the public key, so the key is only revealed when spending
+func PubKeyHashScript(pubKeyHash []byte) Script {
+	script := Script{OP_DUP, OP_SHA256}
+	script = appendPush(script, pubKeyHash)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+//MultisigScript locks a txout to m of the given public keys: <m> <pubkey>... <n> OP_CHECKMULTISIG.
+//unlocked with m signatures, in the same order as their keys are in the script
+func MultisigScript(m int, pubKeys []string) Script {
+	script := appendNumber(nil, m)
+	for _, pubKey := range pubKeys {
+		script = appendPush(script, []byte(pubKey))
+	}
+	script = appendNumber(script, len(pubKeys))
+	return append(script, OP_CHECKMULTISIG)
+}
+
+//HashLockScript locks a txout to the value with the given sha256 hash: OP_SHA256 <hash> OP_EQUAL.
+//unlocked with the value. anyone who sees the value can spend it, so the value has to be kept secret until then
+func HashLockScript(hash []byte) Script {
+	script := appendPush(Script{OP_SHA256}, hash)
+	return append(script, OP_EQUAL)
+}
+
+//TimeLockScript locks a txout to a public key until the block at the given index:
+//<index> OP_CHECKLOCKTIMEVERIFY OP_DROP <pubkey> OP_CHECKSIG. unlocked with the signature of the key in that block or later
+func TimeLockScript(index int, pubKey string) Script {
+	script := appendNumber(nil, index)
+	script = append(script, OP_CHECKLOCKTIMEVERIFY, OP_DROP)
+	return append(script, PubKeyScript(pubKey)...)
+}
+
+//UnlockScript gives an unlocking script pushing the given values in order, e.g. the signatures for the locking script
+func UnlockScript(values ...[]byte) Script {
+	var script Script
+	for _, value := range values {
+		script = appendPush(script, value)
+	}
+	return script
+}
+
+//ScriptAddress gives the address a locking script pays to. for a PubKeyScript it is the public key,
+//so plain wallet addresses are public keys. for others it is "script:" followed by the hex-encoded script,
+//so the script can be paid to with just the address, see AddressScript
+func ScriptAddress(script Script) string {
+	if len(script) > 0 {
+		op, data, next, err := nextOp(script, 0)
+		if err == nil && op <= OP_PUSHDATA2 && len(data) > 0 && next == len(script)-1 && script[next] == OP_CHECKSIG {
+			return string(data)
+		}
+	}
+	return SCRIPT_ADDRESS_PREFIX + hex.EncodeToString(script)
+}
+
+//AddressScript gives the locking script for paying to the address: the script in a script address,
+//or a PubKeyScript for anything else
+func AddressScript(address string) Script {
+	if strings.HasPrefix(address, SCRIPT_ADDRESS_PREFIX) {
+		script, err := hex.DecodeString(strings.TrimPrefix(address, SCRIPT_ADDRESS_PREFIX))
+		if err == nil {
+			return script
+		}
+	}
+	return PubKeyScript(address)
+}
+
+//nextOp reads the opcode at position pc of the script. gives the opcode, the data it pushes if any, and the position of the next opcode
+func nextOp(script Script, pc int) (byte, []byte, int, error) {
+	op := script[pc]
+	pc++
+	size := 0
+	switch {
+	case op > OP_0 && op <= 0x4b:
+		size = int(op)
+	case op == OP_PUSHDATA1:
+		if pc+1 > len(script) {
+			return op, nil, pc, scriptError("missing OP_PUSHDATA1 size")
+		}
+		size = int(script[pc])
+		pc++
+	case op == OP_PUSHDATA2:
+		if pc+2 > len(script) {
+			return op, nil, pc, scriptError("missing OP_PUSHDATA2 size")
+		}
+		size = int(binary.BigEndian.Uint16(script[pc:]))
+		pc += 2
+	default:
+		return op, nil, pc, nil
+	}
+	if pc+size > len(script) {
+		return op, nil, pc, scriptError("push of %d bytes past end of script", size)
+	}
+	return op, script[pc : pc+size], pc + size, nil
+}
+
+//String gives the script as text, with the opcode names and the pushed values in hex
+func (script Script) String() string {
+	parts := []string{}
+	for pc := 0; pc < len(script); {
+		op, data, next, err := nextOp(script, pc)
+		switch {
+		case err != nil:
+			parts = append(parts, "[error]")
+			next = len(script)
+		case op == OP_0:
+			parts = append(parts, "OP_0")
+		case op <= OP_PUSHDATA2:
+			parts = append(parts, hex.EncodeToString(data))
+		case op >= OP_1 && op <= OP_16:
+			parts = append(parts, fmt.Sprintf("OP_%d", op-OP_1+1))
+		case opNames[op] != "":
+			parts = append(parts, opNames[op])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN_%02x", op))
+		}
+		pc = next
+	}
+	return strings.Join(parts, " ")
+}
+
+//MarshalText encodes the script as hex, e.g. in the json of a transaction
+func (script Script) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(script)), nil
+}
+
+//UnmarshalText decodes a hex-encoded script
+func (script *Script) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		data = nil
+	}
+	*script = data
+	return nil
+}
+
+//scriptContext holds what a script checks from the transaction and block spending the txout
+type scriptContext struct {
+	sigHash []byte //hash the signatures of the spending transaction are over
+	index   int    //index of the block the spending transaction goes to
+}
+
+//scriptEngine runs scripts on a stack, counting the operations done
+type scriptEngine struct {
+	ctx   scriptContext
+	stack [][]byte
+	ops   int
+}
+
+//verifyScript checks the unlocking script of a txin unlocks the locking script of the txout it spends
+func verifyScript(unlocking Script, locking Script, ctx scriptContext) error {
+	for pc := 0; pc < len(unlocking); {
+		op, _, next, err := nextOp(unlocking, pc)
+		if err != nil {
+			return err
+		}
+		if op > OP_16 {
+			return scriptError("unlocking script has opcode %02x, only pushes are allowed", op)
+		}
+		pc = next
+	}
+	engine := &scriptEngine{ctx: ctx}
+	err := engine.run(unlocking)
+	if err != nil {
+		return err
+	}
+	err = engine.run(locking)
+	if err != nil {
+		return err
+	}
+	if len(engine.stack) == 0 || !isTrue(engine.stack[len(engine.stack)-1]) {
+		return scriptError("false result")
+	}
+	return nil
+}
+
+//isTrue checks if a stack value is true: any non-zero byte
+func isTrue(value []byte) bool {
+	for _, b := range value {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func boolValue(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+func (e *scriptEngine) push(value []byte) error {
+	if len(value) > MAX_PUSH_SIZE {
+		return scriptError("push of %d bytes", len(value))
+	}
+	if len(e.stack) >= MAX_STACK_SIZE {
+		return scriptError("stack over %d values", MAX_STACK_SIZE)
+	}
+	e.stack = append(e.stack, value)
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, scriptError("pop from empty stack")
+	}
+	value := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return value, nil
+}
+
+func (e *scriptEngine) popNumber() (int, error) {
+	value, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return scriptNumber(value)
+}
+
+//countOps adds to the operations done, failing when over MAX_SCRIPT_OPS
+func (e *scriptEngine) countOps(count int) error {
+	e.ops += count
+	if e.ops > MAX_SCRIPT_OPS {
+		return scriptError("over %d operations", MAX_SCRIPT_OPS)
+	}
+	return nil
+}
+
+//run runs the script on the current stack. the operation count is per script
+func (e *scriptEngine) run(script Script) error {
+	if len(script) > MAX_SCRIPT_SIZE {
+		return scriptError("script of %d bytes", len(script))
+	}
+	e.ops = 0
+	for pc := 0; pc < len(script); {
+		op, data, next, err := nextOp(script, pc)
+		if err != nil {
+			return err
+		}
+		pc = next
+		switch {
+		case op <= OP_PUSHDATA2:
+			err = e.push(data)
+		case op >= OP_1 && op <= OP_16:
+			err = e.push([]byte{op - OP_1 + 1})
+		default:
+			err = e.countOps(1)
+			if err == nil {
+				err = e.execute(op)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//execute runs a single opcode other than a push
+func (e *scriptEngine) execute(op byte) error {
+	switch op {
+	case OP_VERIFY:
+		return e.verify()
+	case OP_RETURN:
+		return scriptError("OP_RETURN")
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		if len(e.stack) == 0 {
+			return scriptError("OP_DUP on empty stack")
+		}
+		return e.push(e.stack[len(e.stack)-1])
+	case OP_EQUAL, OP_EQUALVERIFY:
+		value1, err := e.pop()
+		if err != nil {
+			return err
+		}
+		value2, err := e.pop()
+		if err != nil {
+			return err
+		}
+		err = e.push(boolValue(bytes.Equal(value1, value2)))
+		if err == nil && op == OP_EQUALVERIFY {
+			err = e.verify()
+		}
+		return err
+	case OP_SHA256:
+		value, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(value)
+		return e.push(hash[:])
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		err := e.checkSig()
+		if err == nil && op == OP_CHECKSIGVERIFY {
+			err = e.verify()
+		}
+		return err
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		err := e.checkMultisig()
+		if err == nil && op == OP_CHECKMULTISIGVERIFY {
+			err = e.verify()
+		}
+		return err
+	case OP_CHECKLOCKTIMEVERIFY:
+		if len(e.stack) == 0 {
+			return scriptError("OP_CHECKLOCKTIMEVERIFY on empty stack")
+		}
+		lockIndex, err := scriptNumber(e.stack[len(e.stack)-1])
+		if err != nil {
+			return err
+		}
+		if e.ctx.index < lockIndex {
+			return scriptError("locked until block %d, spent in block %d", lockIndex, e.ctx.index)
+		}
+	default:
+		return scriptError("unknown opcode %02x", op)
+	}
+	return nil
+}
+
+//verify removes the top value, failing if it is not true
+func (e *scriptEngine) verify() error {
+	value, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if !isTrue(value) {
+		return scriptError("verify failed")
+	}
+	return nil
+}
+
+//checkSignature checks the signature is by the public key over the sighash. both are as strings in the stack values
+func (e *scriptEngine) checkSignature(sig []byte, pubKey []byte) bool {
+	return cryptoff.VerifySignature(cryptoff.DecodePublicKey(string(pubKey)), e.ctx.sigHash, string(sig))
+}
+
+//checkSig pops the public key and the signature below it, and pushes true if the signature is valid
+func (e *scriptEngine) checkSig() error {
+	pubKey, err := e.pop()
+	if err != nil {
+		return err
+	}
+	sig, err := e.pop()
+	if err != nil {
+		return err
+	}
+	return e.push(boolValue(e.checkSignature(sig, pubKey)))
+}
+
+//checkMultisig pops n, n public keys, m and m signatures, and pushes true if each signature is valid for one of the keys.
+//the signatures have to be in the same order as the keys, so each key is tried at most once
+func (e *scriptEngine) checkMultisig() error {
+	n, err := e.popNumber()
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > MAX_MULTISIG_KEYS {
+		return scriptError("multisig with %d keys", n)
+	}
+	err = e.countOps(n)
+	if err != nil {
+		return err
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		pubKeys[i], err = e.pop()
+		if err != nil {
+			return err
+		}
+	}
+	m, err := e.popNumber()
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return scriptError("multisig needing %d of %d signatures", m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		sigs[i], err = e.pop()
+		if err != nil {
+			return err
+		}
+	}
+	key := 0
+	for _, sig := range sigs {
+		for key < n && !e.checkSignature(sig, pubKeys[key]) {
+			key++
+		}
+		if key == n {
+			return e.push(boolValue(false))
+		}
+		key++
+	}
+	return e.push(boolValue(true))
+}
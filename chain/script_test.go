@@ -0,0 +1,143 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStandardScripts(t *testing.T) {
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	privKey2, _, address2 := cryptoff.CreateAddress()
+	privKey3, _, address3 := cryptoff.CreateAddress()
+	ctx := scriptContext{[]byte("sighash"), 10}
+	sig1 := []byte(signData(privKey1, ctx.sigHash))
+	sig2 := []byte(signData(privKey2, ctx.sigHash))
+	sig3 := []byte(signData(privKey3, ctx.sigHash))
+	secret := []byte("secret")
+	secretHash := sha256.Sum256(secret)
+	multisig := MultisigScript(2, []string{address1, address2, address3})
+
+	tests := []struct {
+		name      string
+		unlocking Script
+		locking   Script
+		valid     bool
+	}{
+		{"pubkey", UnlockScript(sig1), PubKeyScript(address1), true},
+		{"pubkey other key", UnlockScript(sig2), PubKeyScript(address1), false},
+		{"pubkey no signature", nil, PubKeyScript(address1), false},
+		{"pubkey hash", UnlockScript(sig1, []byte(address1)), PubKeyHashScript(PubKeyHash(address1)), true},
+		{"pubkey hash other key", UnlockScript(sig2, []byte(address2)), PubKeyHashScript(PubKeyHash(address1)), false},
+		{"multisig", UnlockScript(sig1, sig3), multisig, true},
+		{"multisig other pair", UnlockScript(sig2, sig3), multisig, true},
+		{"multisig wrong order", UnlockScript(sig3, sig1), multisig, false},
+		{"multisig same signature twice", UnlockScript(sig1, sig1), multisig, false},
+		{"multisig one signature", UnlockScript(sig1), multisig, false},
+		{"hash lock", UnlockScript(secret), HashLockScript(secretHash[:]), true},
+		{"hash lock wrong value", UnlockScript([]byte("guess")), HashLockScript(secretHash[:]), false},
+		{"time lock reached", UnlockScript(sig1), TimeLockScript(10, address1), true},
+		{"time lock not reached", UnlockScript(sig1), TimeLockScript(11, address1), false},
+		{"time lock other key", UnlockScript(sig2), TimeLockScript(5, address1), false},
+		{"unspendable", UnlockScript(sig1), Script{OP_RETURN}, false},
+		{"unlocking not only pushes", Script{OP_1, OP_DUP}, Script{OP_EQUAL}, false},
+	}
+	for _, test := range tests {
+		err := verifyScript(test.unlocking, test.locking, ctx)
+		if test.valid {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.True(t, errors.Is(err, ErrScriptFailed), "%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	ctx := scriptContext{[]byte("sighash"), 1}
+	//each OP_DUP OP_DROP pair is two operations
+	ops := Script{OP_1}
+	for i := 0; i < MAX_SCRIPT_OPS/2; i++ {
+		ops = append(ops, OP_DUP, OP_DROP)
+	}
+	assert.NoError(t, verifyScript(nil, ops, ctx))
+	ops = append(ops, OP_DUP, OP_DROP)
+	assert.True(t, errors.Is(verifyScript(nil, ops, ctx), ErrScriptFailed))
+
+	stack := Script(bytes.Repeat([]byte{OP_1}, MAX_STACK_SIZE))
+	assert.NoError(t, verifyScript(nil, stack, ctx))
+	assert.Error(t, verifyScript(nil, append(stack, OP_1), ctx))
+
+	assert.NoError(t, verifyScript(UnlockScript(make([]byte, MAX_PUSH_SIZE)), Script{OP_DROP, OP_1}, ctx))
+	assert.Error(t, verifyScript(UnlockScript(make([]byte, MAX_PUSH_SIZE+1)), Script{OP_DROP, OP_1}, ctx))
+	assert.Error(t, verifyScript(nil, append(make(Script, MAX_SCRIPT_SIZE), OP_1), ctx))
+
+	//pushes past the end of the script and unknown opcodes
+	assert.Error(t, verifyScript(Script{0x05, 0x01}, Script{OP_1}, ctx))
+	assert.Error(t, verifyScript(nil, Script{OP_1, 0xff}, ctx))
+	tooMany := MultisigScript(1, make([]string, MAX_MULTISIG_KEYS+1))
+	assert.Error(t, verifyScript(UnlockScript([]byte("sig")), tooMany, ctx))
+}
+
+func TestScriptAddressAndString(t *testing.T) {
+	_, _, address := cryptoff.CreateAddress()
+	assert.Equal(t, address, ScriptAddress(PubKeyScript(address)))
+	assert.Equal(t, TxOut{address, 5, PubKeyScript(address)}, TxOutTo(address, 5))
+	hashLock := HashLockScript([]byte{0xab, 0xcd})
+	assert.Equal(t, "script:a802abcd87", ScriptAddress(hashLock))
+	assert.Equal(t, hashLock, AddressScript(ScriptAddress(hashLock)))
+	assert.Equal(t, PubKeyScript(address), AddressScript(address))
+	assert.Equal(t, TxOutToScript(hashLock, 5), TxOutTo(ScriptAddress(hashLock), 5))
+
+	assert.Equal(t, "OP_SHA256 abcd OP_EQUAL", hashLock.String())
+	assert.Equal(t, "OP_2 6131 6132 OP_2 OP_CHECKMULTISIG", MultisigScript(2, []string{"a1", "a2"}).String())
+	assert.Equal(t, "0100 OP_CHECKLOCKTIMEVERIFY OP_DROP 6131 OP_CHECKSIG", TimeLockScript(256, "a1").String())
+
+	text, err := hashLock.MarshalText()
+	assert.NoError(t, err)
+	var decoded Script
+	assert.NoError(t, decoded.UnmarshalText(text))
+	assert.Equal(t, hashLock, decoded)
+}
+
+//coins paid to a multisig script are counted for the script address, and spent with the signatures of the owners
+func TestSpendMultisigOutput(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	privKey2, _, address2 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+	cbTx := bc.blocks[1].Transactions[0]
+
+	multisig := MultisigScript(2, []string{address1, address2})
+	fund := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutToScript(multisig, INITIAL_SUBSIDY)})
+	_, err := bc.CreateBlock("miner", []Transaction{fund}, "fund")
+	assert.NoError(t, err)
+	assert.Equal(t, INITIAL_SUBSIDY, bc.BalanceFor(ScriptAddress(multisig)))
+
+	spend := Transaction{"", []TxIn{{TxId: fund.Id, TxIdx: 0}}, []TxOut{TxOutTo("receiver", INITIAL_SUBSIDY)}, 0}
+	msg := sigHash(spend)
+	//a single owner cannot spend it alone
+	spend.TxIns[0].Script = UnlockScript([]byte(signData(privKey1, msg)))
+	spend.Id = calculateTxId(spend)
+	assert.Error(t, bc.VerifyTransaction(spend))
+
+	spend.TxIns = []TxIn{{fund.Id, 0, UnlockScript([]byte(signData(privKey1, msg)), []byte(signData(privKey2, msg))), 0}}
+	spend.Id = calculateTxId(spend)
+	assert.NoError(t, bc.SubmitTransaction(spend))
+	_, err = bc.MinePending("miner", "spend")
+	assert.NoError(t, err)
+	assert.Equal(t, INITIAL_SUBSIDY, bc.BalanceFor("receiver"))
+	assert.Equal(t, 0, bc.BalanceFor(ScriptAddress(multisig)))
+
+	//a txout with an address not matching its script is rejected
+	block, err := bc.CreateBlock(address2, nil, "coins")
+	assert.NoError(t, err)
+	forged := TxOutToScript(multisig, INITIAL_SUBSIDY)
+	forged.Address = address2
+	other := bc.createTx(privKey2, []TxIn{{TxId: block.Transactions[0].Id, TxIdx: 0}}, []TxOut{forged})
+	var txErr *TxValidationError
+	assert.True(t, errors.As(bc.VerifyTransaction(other), &txErr))
+	assert.Contains(t, txErr.Reason, "does not match its script")
+}
@@ -0,0 +1,66 @@
+package chain
+
+import (
+	"fmt"
+	"sync"
+)
+
+//Storage is where a Blockchain keeps its blocks and unspent txouts between runs.
+//each block is appended with AppendBlock as it is connected, before its transactions are applied to the unspent txouts,
+//so after a crash the stored blocks are never behind the unspent txouts
+type Storage interface {
+	Exists() bool                     //true if a chain has been stored before
+	ReadBlocks() ([]Block, error)     //read all the stored blocks
+	WriteBlocks(blocks []Block) error //store the given blocks, replacing any previously stored ones
+	AppendBlock(block Block) error    //store the block as the tip, at the height of its index. stored blocks above it are dropped
+	Utxos() UtxoStore                 //the unspent txouts of the chain
+	Close() error                     //release files and other resources held by the storage
+}
+
+//MemoryStorage keeps the chain in memory only, for tests and simulated nodes
+type MemoryStorage struct {
+	lock   sync.Mutex //nodes write the chain while syncing, so it may be read and written at the same time
+	blocks []Block
+	utxos  *MemoryUtxoStore
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{utxos: NewMemoryUtxoStore()}
+}
+
+func (ms *MemoryStorage) Exists() bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.blocks != nil
+}
+
+func (ms *MemoryStorage) ReadBlocks() ([]Block, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return append([]Block{}, ms.blocks...), nil
+}
+
+func (ms *MemoryStorage) WriteBlocks(blocks []Block) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.blocks = append([]Block{}, blocks...)
+	return nil
+}
+
+func (ms *MemoryStorage) AppendBlock(block Block) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if block.Index > len(ms.blocks)+1 {
+		return fmt.Errorf("block %d would leave a gap after stored tip %d", block.Index, len(ms.blocks))
+	}
+	ms.blocks = append(ms.blocks[:block.Index-1], block)
+	return nil
+}
+
+func (ms *MemoryStorage) Utxos() UtxoStore {
+	return ms.utxos
+}
+
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,85 @@
+package chain
+
+import (
+	"log"
+)
+
+//the miner of each block is paid a subsidy of new coins in the coinbase transaction, on top of the transaction fees.
+//the subsidy starts at INITIAL_SUBSIDY and is halved every HALVING_INTERVAL blocks, until it goes to zero.
+//so the total supply of coins is limited, see ScheduledSupply.
+//all nodes on the same network need to use the same values, a block paying more than its subsidy is rejected.
+//
+//the coins paid by a coinbase can only be spent after COINBASE_MATURITY more blocks. if the block is orphaned
+//in a reorganization its coinbase disappears, and so would any transactions spending it. waiting for the block
+//to be buried deep enough keeps those spends from being invalidated, like in bitcoin
+
+const INITIAL_SUBSIDY = 1000 //coins paid to the miner of each block until the first halving
+
+var HALVING_INTERVAL = 100000 //number of blocks between halvings of the subsidy
+var COINBASE_MATURITY = 10    //blocks needed on top of a block before its coinbase txouts can be spent
+
+//BlockSubsidy gives the subsidy for the block at the given index. indices start from 1 for genesis
+func BlockSubsidy(index int) int {
+	if index < 1 {
+		return 0
+	}
+	halvings := (index - 1) / HALVING_INTERVAL
+	//shifting by the bit size or more would wrap around
+	if halvings >= 63 {
+		return 0
+	}
+	return INITIAL_SUBSIDY >> halvings
+}
+
+//ScheduledSupply gives the coins issued by the subsidies of all blocks up to and including the given height
+func ScheduledSupply(height int) int {
+	supply := 0
+	for start := 1; start <= height; start += HALVING_INTERVAL {
+		subsidy := BlockSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		end := start + HALVING_INTERVAL - 1
+		if end > height {
+			end = height
+		}
+		supply += subsidy * (end - start + 1)
+	}
+	return supply
+}
+
+//SupplyInfo describes the coin supply of the chain at a height
+type SupplyInfo struct {
+	Height    int //height the supply is for
+	Subsidy   int //subsidy of the block at the height
+	Scheduled int //coins the subsidy schedule allows to be issued up to the height
+	Issued    int //coins actually issued up to the height, coinbases may claim less than allowed
+}
+
+//Supply gives the coin supply at the given height of the current chain. returns false if the chain is not that high.
+//coins issued are the coins created by all transactions minus the coins they spent, i.e. what the coinbases
+//paid above the fees they collected
+func (bc *Blockchain) Supply(height int) (SupplyInfo, bool) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	if height < 1 || height > len(bc.blocks) {
+		log.Println("No block for supply at height", height)
+		return SupplyInfo{}, false
+	}
+	txOuts := make(map[outPoint]int)
+	issued := 0
+	for _, block := range bc.blocks[:height] {
+		for _, tx := range block.Transactions {
+			if !isCoinbase(tx) {
+				for _, txIn := range tx.TxIns {
+					issued -= txOuts[outPoint{txIn.TxId, txIn.TxIdx}]
+				}
+			}
+			for idx, txOut := range tx.TxOuts {
+				txOuts[outPoint{tx.Id, idx}] = txOut.Amount
+				issued += txOut.Amount
+			}
+		}
+	}
+	return SupplyInfo{height, BlockSubsidy(height), ScheduledSupply(height), issued}, true
+}
@@ -0,0 +1,143 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSubsidySchedule(t *testing.T) {
+	defer func(interval int) { HALVING_INTERVAL = interval }(HALVING_INTERVAL)
+	HALVING_INTERVAL = 3
+	subsidies := []int{}
+	for index := 0; index <= 10; index++ {
+		subsidies = append(subsidies, BlockSubsidy(index))
+	}
+	assert.Equal(t, []int{0, 1000, 1000, 1000, 500, 500, 500, 250, 250, 250, 125}, subsidies)
+	assert.Equal(t, 0, BlockSubsidy(1+3*10))
+	assert.Equal(t, 0, BlockSubsidy(1+3*100))
+
+	assert.Equal(t, 0, ScheduledSupply(0))
+	assert.Equal(t, 2000, ScheduledSupply(2))
+	assert.Equal(t, 3000+1500+250, ScheduledSupply(7))
+	//the supply stops growing when the subsidy goes to zero
+	total := ScheduledSupply(3 * 10)
+	assert.Equal(t, 3*(1000+500+250+125+62+31+15+7+3+1), total)
+	assert.Equal(t, total, ScheduledSupply(3*1000))
+}
+
+//mine blocks over a halving, check the coinbases claim the halved subsidy and fees, and the supply counts only the subsidies
+func TestHalvingAndSupply(t *testing.T) {
+	defer func(interval int) { HALVING_INTERVAL = interval }(HALVING_INTERVAL)
+	HALVING_INTERVAL = 2
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 1)
+	_, err := bc.SendCoins(privKey, "receiver", 100, 10)
+	assert.NoError(t, err)
+	block, err := bc.MinePending("miner", "halved")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, block.Index)
+	assert.Equal(t, INITIAL_SUBSIDY/2+10, block.Transactions[0].TxOuts[0].Amount)
+
+	supply, found := bc.Supply(3)
+	assert.True(t, found)
+	assert.Equal(t, SupplyInfo{3, INITIAL_SUBSIDY / 2, 2*INITIAL_SUBSIDY + INITIAL_SUBSIDY/2, 2*INITIAL_SUBSIDY + INITIAL_SUBSIDY/2}, supply)
+	supply, _ = bc.Supply(1)
+	assert.Equal(t, INITIAL_SUBSIDY, supply.Issued)
+	_, found = bc.Supply(4)
+	assert.False(t, found)
+	_, found = bc.Supply(0)
+	assert.False(t, found)
+
+	//a coinbase claiming less than allowed issues less
+	template, tipChanged := bc.newBlockTemplate("miner", nil, "modest")
+	template.Transactions[0] = CreateCoinbaseTx("miner", 4, -INITIAL_SUBSIDY/4)
+	_, err = bc.mineOnTip(context.Background(), NewMiner(1), template, tipChanged)
+	assert.NoError(t, err)
+	supply, _ = bc.Supply(4)
+	assert.Equal(t, 3*INITIAL_SUBSIDY, supply.Scheduled)
+	assert.Equal(t, 3*INITIAL_SUBSIDY-INITIAL_SUBSIDY/4, supply.Issued)
+}
+
+//coinbases of the same miner in different blocks get different ids
+func TestCoinbaseIdsUnique(t *testing.T) {
+	bc := newTestChain()
+	blocks := bc.CreateTestChain("miner", 3)
+	ids := map[string]bool{}
+	for _, block := range blocks {
+		ids[block.Transactions[0].Id] = true
+	}
+	assert.Equal(t, 4, len(ids))
+	assert.Equal(t, 3*INITIAL_SUBSIDY, bc.BalanceFor("miner"))
+}
+
+//blocks without a coinbase first, with a coinbase for another block, or with more than one coinbase are rejected
+func TestCoinbaseRules(t *testing.T) {
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 1)
+	tx, err := bc.SendCoins(privKey, "receiver", 100, 0)
+	assert.NoError(t, err)
+
+	mineWith := func(txs []Transaction) error {
+		template, tipChanged := bc.newBlockTemplate("miner", nil, "coinbase rules")
+		template.Transactions = txs
+		_, err := bc.mineOnTip(context.Background(), NewMiner(1), template, tipChanged)
+		return err
+	}
+	err = mineWith([]Transaction{tx})
+	assert.True(t, errors.Is(err, ErrBadCoinbase), "no coinbase")
+	err = mineWith([]Transaction{tx, CreateCoinbaseTx("miner", 3, 0)})
+	assert.True(t, errors.Is(err, ErrBadCoinbase), "coinbase not first")
+	err = mineWith([]Transaction{CreateCoinbaseTx("miner", 2, 0), tx})
+	assert.True(t, errors.Is(err, ErrBadCoinbase), "coinbase for another block")
+	err = mineWith([]Transaction{CreateCoinbaseTx("miner", 3, 0), CreateCoinbaseTx("other", 3, 0)})
+	assert.True(t, errors.Is(err, ErrBadCoinbase), "two coinbases")
+	fake := CreateCoinbaseTx("miner", 3, 0)
+	fake.Id = bc.blocks[1].Transactions[0].Id
+	err = mineWith([]Transaction{fake})
+	assert.True(t, errors.Is(err, ErrBadCoinbase), "coinbase with the id of another")
+	assert.Equal(t, 2, bc.Height())
+
+	//a coinbase is not accepted to the mempool
+	assert.Error(t, bc.SubmitTransaction(CreateCoinbaseTx("miner", 3, 0)))
+
+	assert.NoError(t, mineWith([]Transaction{CreateCoinbaseTx("miner", 3, 0), tx}))
+	assert.Equal(t, 100, bc.BalanceFor("receiver"))
+}
+
+//coinbase txouts can not be spent before maturity, neither in the mempool nor in a block, and the wallet leaves them out
+func TestCoinbaseMaturity(t *testing.T) {
+	defer func(maturity int) { COINBASE_MATURITY = maturity }(COINBASE_MATURITY)
+	COINBASE_MATURITY = 3
+	bc := newTestChain()
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 1)
+	coinbase := bc.blocks[1].Transactions[0]
+	assert.Equal(t, INITIAL_SUBSIDY, bc.BalanceFor(address))
+	assert.Equal(t, INITIAL_SUBSIDY, bc.ImmatureBalanceFor(address))
+
+	_, err := bc.SendCoins(privKey, "receiver", 10, 0)
+	assert.True(t, errors.Is(err, ErrInsufficientFunds), "immature coinbase should not be selected")
+	early := bc.createTx(privKey, []TxIn{{TxId: coinbase.Id, TxIdx: 0}}, []TxOut{TxOutTo("receiver", INITIAL_SUBSIDY)})
+	assert.Error(t, bc.SubmitTransaction(early))
+	_, err = bc.CreateBlock("miner", []Transaction{early}, "too early")
+	var txErr *TxValidationError
+	assert.True(t, errors.As(err, &txErr), "block spending immature coinbase should be rejected")
+
+	//block 2 has the coinbase, spendable in block 2+3
+	_, err = bc.CreateBlock("miner", nil, "burying")
+	assert.NoError(t, err)
+	assert.Equal(t, INITIAL_SUBSIDY, bc.ImmatureBalanceFor(address))
+	_, err = bc.CreateBlock("miner", nil, "burying")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, bc.ImmatureBalanceFor(address))
+	assert.Equal(t, 2*INITIAL_SUBSIDY, bc.ImmatureBalanceFor("miner"))
+	assert.NoError(t, bc.SubmitTransaction(early))
+	_, err = bc.MinePending("miner", "mature")
+	assert.NoError(t, err)
+	assert.Equal(t, INITIAL_SUBSIDY, bc.BalanceFor("receiver"))
+}
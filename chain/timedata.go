@@ -0,0 +1,135 @@
+package chain
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+//block timestamps are checked against the network-adjusted time instead of just the local clock, so a node with its
+//clock a bit off does not reject the blocks of everyone else. peers send their time in the handshake, and the offset
+//of each to the local clock is kept. the network-adjusted time is the local time plus the median of those offsets,
+//with the local clock counted as one offset of zero. the median needs MIN_TIME_SAMPLES peers, so a single peer
+//cannot move the time, and offsets over MAX_TIME_OFFSET are not applied at all, as the local clock is then more
+//likely right than the peers.
+//
+//the offsets are kept by host, not by connection, so a host opening several connections still counts only once.
+//at most MAX_TIME_SAMPLES hosts are kept, offsets from more are ignored until some of the hosts disconnect
+//
+//https://en.bitcoin.it/wiki/Block_timestamp
+
+var MIN_TIME_SAMPLES = 3      //peer offsets needed before the time is adjusted
+var MAX_TIME_SAMPLES = 200    //max number of hosts the offsets are kept for
+var MAX_TIME_OFFSET = 10 * 60 //seconds the network-adjusted time can be from the local clock
+
+//NetworkClock gives the network-adjusted time from the time offsets of the peers
+type NetworkClock struct {
+	lock    sync.Mutex             //guards the samples
+	samples map[string]*timeSample //offset of each peer host
+}
+
+//timeSample is the time offset of a peer host
+type timeSample struct {
+	offset time.Duration //time of the host minus the local time, from its latest connection
+	conns  int           //number of open connections from the host
+}
+
+//NewNetworkClock creates a clock with no peer offsets, giving the local time until enough peers are added
+func NewNetworkClock() *NetworkClock {
+	return &NetworkClock{samples: make(map[string]*timeSample)}
+}
+
+//peerHost gives the host of a peer address, or the whole address if it has no port
+func peerHost(peer string) string {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return peer
+	}
+	return host
+}
+
+//AddPeerOffset sets the offset of the clock of the given peer (host:port) to the local clock.
+//the offset replaces any earlier one from the same host, so each host counts once however many connections it has.
+//returns false if the offset was ignored because of MAX_TIME_SAMPLES, then RemovePeer must not be called for the peer
+func (c *NetworkClock) AddPeerOffset(peer string, offset time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	host := peerHost(peer)
+	sample, found := c.samples[host]
+	if !found {
+		if len(c.samples) >= MAX_TIME_SAMPLES {
+			log.Println("Already have time offsets from", len(c.samples), "hosts, ignoring", peer)
+			return false
+		}
+		sample = &timeSample{}
+		c.samples[host] = sample
+	}
+	log.Println("Peer", peer, "time offset:", offset)
+	sample.offset = offset
+	sample.conns++
+	return true
+}
+
+//RemovePeer drops a connection of the given peer (host:port), e.g. when disconnected.
+//the offset of the host is dropped when it has no connections left
+func (c *NetworkClock) RemovePeer(peer string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	host := peerHost(peer)
+	sample, found := c.samples[host]
+	if !found {
+		return
+	}
+	sample.conns--
+	if sample.conns <= 0 {
+		delete(c.samples, host)
+	}
+}
+
+//PeerOffsets gives a copy of the offsets of the peers, by host
+func (c *NetworkClock) PeerOffsets() map[string]time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	offsets := make(map[string]time.Duration)
+	for host, sample := range c.samples {
+		offsets[host] = sample.offset
+	}
+	return offsets
+}
+
+//Offset gives the adjustment from the local time to the network-adjusted time: the median of the peer offsets and zero
+//for the local clock. zero if there are fewer than MIN_TIME_SAMPLES peer hosts, or the median is over MAX_TIME_OFFSET
+func (c *NetworkClock) Offset() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.samples) < MIN_TIME_SAMPLES {
+		return 0
+	}
+	offsets := []time.Duration{0}
+	for _, sample := range c.samples {
+		offsets = append(offsets, sample.offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+	if len(offsets)%2 == 0 {
+		median = (offsets[len(offsets)/2-1] + median) / 2
+	}
+	limit := time.Duration(MAX_TIME_OFFSET) * time.Second
+	if median > limit || median < -limit {
+		log.Println("Peers median time offset", median, "is over the limit, check the local clock. Using local time")
+		return 0
+	}
+	return median
+}
+
+//Now gives the network-adjusted time
+func (c *NetworkClock) Now() time.Time {
+	return time.Now().Add(c.Offset())
+}
+
+//Clock gives the network clock of the chain, block timestamps are checked against its time
+func (bc *Blockchain) Clock() *NetworkClock {
+	return bc.clock
+}
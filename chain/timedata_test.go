@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNetworkClockOffset(t *testing.T) {
+	clock := NewNetworkClock()
+	clock.AddPeerOffset("peer1", 10*time.Second)
+	clock.AddPeerOffset("peer2", 20*time.Second)
+	//not enough peers yet
+	assert.Equal(t, time.Duration(0), clock.Offset())
+	clock.AddPeerOffset("peer3", -5*time.Second)
+	//median of -5, 0 (local), 10 and 20
+	assert.Equal(t, 5*time.Second, clock.Offset())
+	clock.AddPeerOffset("peer4", 30*time.Second)
+	assert.Equal(t, 10*time.Second, clock.Offset())
+	//a new offset from the same host replaces the old one, and is dropped with the last connection of the host
+	clock.AddPeerOffset("peer4", -time.Hour)
+	assert.Equal(t, 0*time.Second, clock.Offset())
+	assert.Equal(t, 4, len(clock.PeerOffsets()))
+
+	clock.RemovePeer("peer3")
+	clock.RemovePeer("peer4")
+	clock.RemovePeer("peer4")
+	assert.Equal(t, time.Duration(0), clock.Offset())
+	assert.WithinDuration(t, time.Now(), clock.Now(), time.Second)
+
+	//offsets over the limit are not applied
+	for _, peer := range []string{"peer1", "peer2", "peer3"} {
+		clock.AddPeerOffset(peer, time.Duration(MAX_TIME_OFFSET+1)*time.Second)
+	}
+	assert.Equal(t, time.Duration(0), clock.Offset())
+}
+
+//several connections from one host give one offset, so a single host cannot move the time on its own
+func TestNetworkClockOffsetByHost(t *testing.T) {
+	clock := NewNetworkClock()
+	for port := 9001; port <= 9005; port++ {
+		clock.AddPeerOffset(fmt.Sprintf("10.0.0.1:%d", port), 5*time.Minute)
+	}
+	assert.Equal(t, map[string]time.Duration{"10.0.0.1": 5 * time.Minute}, clock.PeerOffsets())
+	assert.Equal(t, time.Duration(0), clock.Offset())
+	clock.AddPeerOffset("10.0.0.2:9001", 5*time.Minute)
+	clock.AddPeerOffset("10.0.0.3:9001", 5*time.Minute)
+	assert.Equal(t, 5*time.Minute, clock.Offset())
+
+	//the host offset stays until its last connection is gone
+	clock.RemovePeer("10.0.0.3:9001")
+	for port := 9001; port <= 9004; port++ {
+		clock.RemovePeer(fmt.Sprintf("10.0.0.1:%d", port))
+	}
+	assert.Equal(t, 2, len(clock.PeerOffsets()))
+	clock.RemovePeer("10.0.0.1:9005")
+	assert.Equal(t, map[string]time.Duration{"10.0.0.2": 5 * time.Minute}, clock.PeerOffsets())
+
+	//hosts over MAX_TIME_SAMPLES are ignored
+	defer func(samples int) { MAX_TIME_SAMPLES = samples }(MAX_TIME_SAMPLES)
+	MAX_TIME_SAMPLES = 3
+	for host := 3; host <= 6; host++ {
+		added := clock.AddPeerOffset(fmt.Sprintf("10.0.0.%d:9001", host), -time.Minute)
+		assert.Equal(t, host <= 4, added)
+	}
+	assert.Equal(t, 3, len(clock.PeerOffsets()))
+	assert.NotContains(t, clock.PeerOffsets(), "10.0.0.5")
+	//median of -1m, -1m, 0 (local) and 5m
+	assert.Equal(t, -30*time.Second, clock.Offset())
+}
+
+//a block ahead of the local clock is accepted once the peers show the network time is ahead too
+func TestTimestampVsNetworkTime(t *testing.T) {
+	bc := newTestChain()
+	bc.CreateTestChain(GenesisAddress, 1)
+	block, _ := bc.newBlockTemplate(GenesisAddress, nil, "ahead")
+	block.Timestamp = time.Now().Add(time.Duration(3*MAX_TIMESTAMP_DRIFT) * time.Second)
+	block = mineBlock(block)
+	assert.True(t, errors.Is(bc.AddBlock(block), ErrTimestampTooLate))
+
+	for _, peer := range []string{"peer1", "peer2", "peer3"} {
+		bc.Clock().AddPeerOffset(peer, time.Duration(2*MAX_TIMESTAMP_DRIFT)*time.Second)
+	}
+	assert.NoError(t, bc.AddBlock(block))
+
+	//the next template is after the median time past, even though that is ahead of the local clock
+	next, _ := bc.newBlockTemplate(GenesisAddress, nil, "next")
+	assert.True(t, next.Timestamp.After(medianTimePast(bc.blocks)))
+}
@@ -4,63 +4,84 @@ import (
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/akamensky/base58"
 	"github.com/mukatee/go-naive/cryptoff"
 	"log"
 	"math/big"
-	"strings"
 )
 
-var COINBASE_AMOUNT = 1000
-
 type TxOut struct {
-	Address string //receiving public key
+	Address string //address the script pays to, the receiving public key for a plain payment. see ScriptAddress
 	Amount  int    //amount of coin units to send/receive
+	Script  Script //locking script, the conditions to spend the txout
 }
 
 type TxIn struct {
-	TxId  string //id of the transaction inside which this TxIn should be found
-	TxIdx int    //index of TxOut this refers to inside the transaction
+	TxId         string //id of the transaction inside which this TxIn should be found
+	TxIdx        int    //index of TxOut this refers to inside the transaction
+	Script       Script //unlocking script for the locking script of the txout, e.g. the signature of the owner over the sighash
+	RelativeLock int    //blocks (or seconds with RELATIVE_LOCK_TIME_FLAG) the txout must be in the chain before spending, 0 for none
 }
 
 type UnspentTxOut struct {
-	TxId    string //transaction id
-	TxIdx   int    //index of txout in transaction
-	Address string //public key of owner
-	Amount  int    //amount coin units that was sent/received
+	TxId     string //transaction id
+	TxIdx    int    //index of txout in transaction
+	Address  string //address the script pays to, the public key of the owner for a plain payment
+	Amount   int    //amount coin units that was sent/received
+	Coinbase int    //index of the block if created by its coinbase, 0 otherwise. coinbase txouts have to mature before spending
+	Script   Script //locking script of the txout
+	Height   int    //index of the block that created the txout, for relative lock times
 }
 
-//transaction is from a single person/entity
-//inputs from that entity use funds, outputs show how much and where
-//all the time there should be some list kept and updated based on this
-type Transaction struct {
-	Id        string
-	Sender    string //the address/public key of the sender
-	Signature string //signature including all txin and txout. in this case we sign Transaction.Id since that already has all the TxIn and TxOut
-	TxIns     []TxIn
-	TxOuts    []TxOut
+//TxOutTo gives a txout paying the amount to the given address, locked with the script of the address (see AddressScript)
+func TxOutTo(address string, amount int) TxOut {
+	return TxOutToScript(AddressScript(address), amount)
 }
 
-type ecdsaKeyElements struct {
-	R, S *big.Int
+//TxOutToScript gives a txout paying the amount to the given locking script, with the address of the script
+func TxOutToScript(script Script, amount int) TxOut {
+	return TxOut{ScriptAddress(script), amount, script}
 }
 
-//build a string with all transaction inputs and ouputs concatenated, hash it, and encode the hash into a hex-string
-func calculateTxId(tx Transaction) string {
-	log.Print("Calculating tx id (hash string)")
-	var strBuilder strings.Builder
-	for _, txIn := range tx.TxIns {
-		fmt.Fprintf(&strBuilder, "%d%d", txIn.TxIdx, txIn.TxIdx)
+//checkTxOut checks the txout has a positive amount, a script within the size limit, and the address of the script
+func checkTxOut(txOut TxOut) error {
+	if txOut.Amount <= 0 {
+		return fmt.Errorf("invalid txout amount %d", txOut.Amount)
 	}
-	for _, txOut := range tx.TxOuts {
-		fmt.Fprintf(&strBuilder, "%s%d", txOut.Address, txOut.Amount)
+	if len(txOut.Script) > MAX_SCRIPT_SIZE {
+		return fmt.Errorf("txout script of %d bytes", len(txOut.Script))
+	}
+	if txOut.Address != ScriptAddress(txOut.Script) {
+		return fmt.Errorf("txout address %s does not match its script", txOut.Address)
 	}
-	raw := strBuilder.String()
-	hash := sha256.Sum256([]byte(raw))
-	id := hex.EncodeToString(hash[:])
-	log.Print("Calculated tx id (hash string):", id)
-	return id
+	return nil
+}
+
+//transaction spends the txouts referred by its txins, and creates new txouts showing how much and where.
+//each txin unlocks the txout it spends, e.g. with the signature of its owner, so a transaction can combine coins
+//from several addresses.
+//all the time there should be some list kept and updated based on this
+type Transaction struct {
+	Id       string //hash over all the txins (including unlocking scripts) and txouts, see calculateTxId
+	TxIns    []TxIn
+	TxOuts   []TxOut
+	LockTime int //block index or unix time (see LOCKTIME_THRESHOLD) before which the transaction is not final, 0 for none
+}
+
+//TxValidationError is returned when a transaction fails verification, with the reason it was rejected
+type TxValidationError struct {
+	TxId   string //id of the rejected transaction
+	Reason string //description of the failed check
+}
+
+func (e *TxValidationError) Error() string {
+	return fmt.Sprintf("invalid transaction %s: %s", e.TxId, e.Reason)
+}
+
+type ecdsaKeyElements struct {
+	R, S *big.Int
 }
 
 //signData creates an ECDSA signature for given message (byte slice).
@@ -76,105 +97,198 @@ func signData(privKey *ecdsa.PrivateKey, msg []byte) string {
 	return signature
 }
 
-//createCoinbaseTx build a new coinbase transaction and assigns it to the given address
-func CreateCoinbaseTx(address string) Transaction {
-	log.Print("Creating coinbase transaction for ", address)
+//createCoinbaseTx build a new coinbase transaction for the block at given index, and assigns it to the given address.
+//the coinbase pays the block subsidy (see BlockSubsidy) plus the given fees of the other transactions in the block
+func CreateCoinbaseTx(address string, index int, fees int) Transaction {
+	log.Print("Creating coinbase transaction for ", address, " in block ", index, " with fees ", fees)
 	var cbTx Transaction
 
-	//no txin for coinbase tx
+	//the coinbase does not spend anything, its only txin has the block index to make the coinbase id unique
+	cbTx.TxIns = []TxIn{{TxId: "", TxIdx: index}}
 
-	var txOut TxOut
-	txOut.Amount = COINBASE_AMOUNT
-	txOut.Address = address
-	cbTx.TxOuts = append(cbTx.TxOuts, txOut)
+	cbTx.TxOuts = []TxOut{TxOutTo(address, BlockSubsidy(index)+fees)}
 
 	cbTx.Id = calculateTxId(cbTx)
-	cbTx.Signature = "coinbase"
 
 	log.Print("Coinbase tx created")
 	return cbTx
 }
 
-//SendCoins sends "count" number of coins to the "to" address, from the owner of given private key
-func SendCoins(privKey *ecdsa.PrivateKey, to string, count int) Transaction {
-	from := cryptoff.EncodePublicKey(&privKey.PublicKey)
-	log.Print("Creating tx to send ", count, " coins from ", from, " to ", to)
-	//TODO: error handling (insufficient funds)
-	txIns, total := findTxInsFor(from, count)
-	txOuts := SplitTxIns(from, to, count, total)
-	tx := createTx(privKey, txIns, txOuts)
+//isCoinbase checks if the transaction is a coinbase, with the single txin not spending any txout
+func isCoinbase(tx Transaction) bool {
+	return len(tx.TxIns) == 1 && tx.TxIns[0].TxId == ""
+}
+
+//ErrInsufficientFunds is returned by SendCoins when the sender does not have enough unspent coins
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+//SendCoins sends "count" number of coins to the "to" address, from the owner of given private key.
+//the sender also pays the given fee, which goes to the miner of the block including the transaction.
+//the created transaction is submitted to the mempool, to be included in the next mined block.
+//coins already spent by transactions in the mempool are not used again
+func (bc *Blockchain) SendCoins(privKey *ecdsa.PrivateKey, to string, count int, fee int) (Transaction, error) {
+	return bc.SendCoinsFrom([]*ecdsa.PrivateKey{privKey}, to, count, fee)
+}
+
+//SendCoinsFrom is SendCoins combining coins of several addresses, one for each of the given private keys.
+//coins are taken from the addresses in the given order until there is enough, the change goes back to the first one
+func (bc *Blockchain) SendCoinsFrom(privKeys []*ecdsa.PrivateKey, to string, count int, fee int) (Transaction, error) {
+	return bc.SendCoinsAfter(privKeys, to, count, fee, 0)
+}
+
+//SendCoinsAfter is SendCoinsFrom with the transaction locked until the given block index or unix time, see LOCKTIME_THRESHOLD.
+//the transaction waits in the mempool until it is final, the coins it spends cannot be sent again meanwhile
+func (bc *Blockchain) SendCoinsAfter(privKeys []*ecdsa.PrivateKey, to string, count int, fee int, lockTime int) (Transaction, error) {
+	if len(privKeys) == 0 {
+		return Transaction{}, errors.New("no private keys to send from")
+	}
+	from := cryptoff.EncodePublicKey(&privKeys[0].PublicKey)
+	log.Print("Creating tx to send ", count, " coins with fee ", fee, " from ", len(privKeys), " addresses to ", to)
+	if fee < 0 {
+		return Transaction{}, fmt.Errorf("negative fee %d", fee)
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	var txIns []TxIn
+	var signers []*ecdsa.PrivateKey
+	total := 0
+	used := make(map[string]bool)
+	for _, privKey := range privKeys {
+		address := cryptoff.EncodePublicKey(&privKey.PublicKey)
+		if used[address] || total >= count+fee {
+			continue
+		}
+		used[address] = true
+		found, amount := bc.findTxInsFor(address, count+fee-total)
+		for range found {
+			signers = append(signers, privKey)
+		}
+		txIns = append(txIns, found...)
+		total += amount
+	}
+	if total < count+fee {
+		return Transaction{}, fmt.Errorf("%w: senders have %d, less than %d", ErrInsufficientFunds, total, count+fee)
+	}
+	txOuts := SplitTxIns(from, to, count, fee, total)
+	tx := signTx(Transaction{"", txIns, txOuts, lockTime}, signers)
 	log.Print("Send-tx created")
-	return tx
+	err := bc.addToMempool(tx)
+	return tx, err
 }
 
-//createTx builds a new transaction where the sender is identified by the given private key,
+//createTx builds a new transaction where all the given txIns are signed by the given private key, as pay to public key,
 //and where the transaction includes the given tXins and txOuts
-func createTx(privKey *ecdsa.PrivateKey, txIns []TxIn, txOuts []TxOut) Transaction {
-	pubKey := cryptoff.EncodePublicKey(&privKey.PublicKey)
-	log.Print("Creating tx from ", pubKey, " with ", len(txIns), " tx-ins, ", len(txOuts), " tx-outs")
-	tx := Transaction{"", pubKey, "", txIns, txOuts}
-
-	signTxIns(tx, privKey)
+func (bc *Blockchain) createTx(privKey *ecdsa.PrivateKey, txIns []TxIn, txOuts []TxOut) Transaction {
+	log.Print("Creating tx with ", len(txIns), " tx-ins, ", len(txOuts), " tx-outs")
+	signers := make([]*ecdsa.PrivateKey, len(txIns))
+	for i := range signers {
+		signers[i] = privKey
+	}
+	return signTx(Transaction{"", txIns, txOuts, 0}, signers)
+}
 
+//signTx signs each txin of the transaction with the private key at the same position in privKeys, and calculates the id.
+//the txins get the unlocking script for a PubKeyScript, i.e. just the signature.
+//all txins sign the same sighash, so each owner can sign without seeing the signatures of the others
+func signTx(tx Transaction, privKeys []*ecdsa.PrivateKey) Transaction {
+	msg := sigHash(tx)
+	//copy the txins, so the slice of the caller is not changed
+	txIns := make([]TxIn, len(tx.TxIns))
+	for i, txIn := range tx.TxIns {
+		txIn.Script = UnlockScript([]byte(signData(privKeys[i], msg)))
+		txIns[i] = txIn
+	}
+	tx.TxIns = txIns
 	tx.Id = calculateTxId(tx)
-	tx.Signature = signData(privKey, []byte(tx.Id))
-	log.Print("Created tx and signed with signature: ", tx.Signature)
+	log.Print("Created tx ", tx.Id, " and signed all txins")
 	return tx
 }
 
-//processTransaction takes txIns from transaction and removes any matching unspent txOuts,
-//and creates new txOuts matching the transaction
-func processTransaction(tx Transaction) {
-	//TODO: check that tx is valid, and all txin and txout are valid as well
-	//first param from range is index, second is the value
-	for _, val := range tx.TxIns {
-		consumeTxOut(val.TxId, val.TxIdx)
-	}
-	for idx, val := range tx.TxOuts {
-		createTxOut(tx.Id, val.Amount, val.Address, idx)
+//sigHash gives the hash each txin signs: the transaction with the unlocking scripts of all txins left empty.
+//so a signature commits to all txins, txouts and lock times, and cannot be moved to another transaction
+func sigHash(tx Transaction) []byte {
+	unsigned := Transaction{TxOuts: tx.TxOuts, LockTime: tx.LockTime}
+	for _, txIn := range tx.TxIns {
+		unsigned.TxIns = append(unsigned.TxIns, TxIn{TxId: txIn.TxId, TxIdx: txIn.TxIdx, RelativeLock: txIn.RelativeLock})
 	}
+	hash := sha256.Sum256(appendTxContent(nil, unsigned))
+	return hash[:]
 }
 
-//consumeTxOut scans the list of unspent txouts to find one with matching transaction id and index, removes that when found
-func consumeTxOut(txId string, txIdx int) {
-	log.Print("Consuming tx-out with tx-id=", txId, ", tx-idx=", txIdx)
-	for idx, val := range unspentTxOuts {
-		if val.TxId == txId && val.TxIdx == txIdx {
-			//remove the matching unspend txout from the list of unspents
-			//unpacking with ... https://www.reddit.com/r/golang/comments/1y8ytg/what_mean_in_append_function_when_appending_byte/
-			unspentTxOuts = append(unspentTxOuts[:idx], unspentTxOuts[idx+1:]...)
-			return
-		}
+//VerifyTransaction checks the given transaction against the current set of unspent txouts:
+//the id must match the content, every txin must refer to an unspent txout and its unlocking script must unlock
+//the locking script of that txout, and the inputs must cover the outputs.
+//txouts of a coinbase can only be spent once mature, see COINBASE_MATURITY.
+//inputs exceeding the outputs are the fee of the transaction, see txFee
+func (bc *Blockchain) VerifyTransaction(tx Transaction) error {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return verifyTransaction(tx, newUtxoView(bc.utxos, bc.nextIndex()))
+}
+
+//verifyTransaction does the checks for VerifyTransaction, using the unspent txouts in the given view
+func verifyTransaction(tx Transaction, utxos *utxoView) error {
+	log.Print("Verifying transaction ", tx.Id)
+	if calculateTxId(tx) != tx.Id {
+		return &TxValidationError{tx.Id, "id does not match transaction content"}
+	}
+	if len(tx.TxIns) == 0 {
+		return &TxValidationError{tx.Id, "no txins in transaction"}
 	}
-	//TODO: error when not found
-}
-
-//createTxOut creates a txout from given parameters (pubKey is recipient) and adds it to list of unspent txouts
-func createTxOut(txId string, amount int, pubKey string, txIdx int) {
-	log.Print("Creating tx-out from: tx-in=", txId, ", amount=", amount, ", pubkey=", pubKey, ", tx-idx=", txIdx)
-	newUTXO := UnspentTxOut{txId, txIdx, pubKey, amount}
-	unspentTxOuts = append(unspentTxOuts, newUTXO)
-}
-
-//signTxIns verifies that the given transaction is valid, i.e. all txin exist as unspent txout for the spending user
-//TODO: check why did i call this sign... when no signing appears to happen -> rename this
-func signTxIns(tx Transaction, privKey *ecdsa.PrivateKey) bool {
-	//key from string https://stackoverflow.com/questions/48392334/how-to-sign-a-message-with-an-ecdsa-string-privatekey
-	myAddress := cryptoff.EncodePublicKey(&privKey.PublicKey)
-	//first param from range is index, second is the value
-	for _, val := range tx.TxIns {
-		errorStatus := false
-		internalIdx := findUnspentTransaction(myAddress, val.TxId)
-		if internalIdx < 0 {
-			//TODO: error logging
-			log.Print("Error: trying to spend a transaction that does not exist (as unspent..)")
-			errorStatus = true
+	if isCoinbase(tx) {
+		return &TxValidationError{tx.Id, "coinbase is only valid as the first transaction of its block"}
+	}
+	err := checkLocks(tx)
+	if err != nil {
+		return &TxValidationError{tx.Id, err.Error()}
+	}
+	msg := sigHash(tx)
+	totalIn := 0
+	for i, txIn := range tx.TxIns {
+		for _, other := range tx.TxIns[:i] {
+			if other.TxId == txIn.TxId && other.TxIdx == txIn.TxIdx {
+				return &TxValidationError{tx.Id, fmt.Sprintf("txin (%s, %d) used twice", txIn.TxId, txIn.TxIdx)}
+			}
+		}
+		utxo, found := utxos.get(txIn.TxId, txIn.TxIdx)
+		if !found {
+			return &TxValidationError{tx.Id, fmt.Sprintf("txin (%s, %d) is not an unspent txout", txIn.TxId, txIn.TxIdx)}
+		}
+		err := verifyScript(txIn.Script, utxo.Script, scriptContext{msg, utxos.index})
+		if err != nil {
+			return &TxValidationError{tx.Id, fmt.Sprintf("txin (%s, %d) does not unlock txout of %s: %v", txIn.TxId, txIn.TxIdx, utxo.Address, err)}
 		}
-		if errorStatus {
-			return false
+		if !utxos.mature(utxo) {
+			return &TxValidationError{tx.Id, fmt.Sprintf("txin (%s, %d) spends coinbase of block %d before it matures", txIn.TxId, txIn.TxIdx, utxo.Coinbase)}
+		}
+		totalIn += utxo.Amount
+	}
+	totalOut := 0
+	for _, txOut := range tx.TxOuts {
+		err := checkTxOut(txOut)
+		if err != nil {
+			return &TxValidationError{tx.Id, err.Error()}
 		}
+		totalOut += txOut.Amount
+	}
+	if totalIn < totalOut {
+		return &TxValidationError{tx.Id, fmt.Sprintf("inputs %d less than outputs %d", totalIn, totalOut)}
+	}
+	return nil
+}
+
+//txFee gives the fee of the transaction: the amount of the txins that is not paid to the txouts.
+//uses the unspent txouts in the given view, so has to be called before the transaction is applied to the view
+func txFee(tx Transaction, utxos *utxoView) int {
+	fee := 0
+	for _, txIn := range tx.TxIns {
+		utxo, _ := utxos.get(txIn.TxId, txIn.TxIdx)
+		fee += utxo.Amount
+	}
+	for _, txOut := range tx.TxOuts {
+		fee -= txOut.Amount
 	}
-	return true
+	return fee
 }
 
 //hexToPublicKey converts a hex-encoded string into a goland public-key
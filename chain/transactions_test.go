@@ -1,41 +1,41 @@
 package chain
 
 import (
+	"context"
 	"crypto/ecdsa"
-	"crypto/rand"
+	"errors"
 	"github.com/mukatee/go-naive/cryptoff"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 func TestCoinbaseOnly(t *testing.T) {
-	createGenesisBlock(true)
+	bc := newTestChain()
+	bc.createGenesisBlock(true)
 
-	privKey, _ := ecdsa.GenerateKey(cryptoff.Curve, rand.Reader)
-	pubKey := &privKey.PublicKey
-	address := cryptoff.EncodePublicKey(pubKey)
-	cbTx := CreateCoinbaseTx(address)
-	txs := []Transaction{cbTx}
-	CreateBlock(txs, "My data", 0)
+	_, _, address := cryptoff.CreateAddress()
+	_, err := bc.CreateBlock(address, nil, "My data")
+	assert.NoError(t, err)
 
-	assert.Equal(t, len(GlobalChain), 2, "Genesis block + single block with only coinbase transaction expected")
+	assert.Equal(t, len(bc.blocks), 2, "Genesis block + single block with only coinbase transaction expected")
 
-	valid := validateChain(GlobalChain)
-	assert.True(t, valid, "Blockchain should be valid")
+	err = bc.validateChain(bc.blocks)
+	assert.NoError(t, err, "Blockchain should be valid")
+	assert.Equal(t, INITIAL_SUBSIDY, bc.BalanceFor(address))
 }
 
 func TestCoinbaseAndUsers(t *testing.T) {
-	createGenesisBlock(true)
+	bc := newTestChain()
+	bc.createGenesisBlock(true)
 
 	privKey1, _, address1 := cryptoff.CreateAddress()
 	_, _, address2 := cryptoff.CreateAddress()
 
-	cbTx := CreateCoinbaseTx(address1)
+	_, err := bc.CreateBlock(address1, nil, "My data")
+	assert.NoError(t, err)
 
-	txs := []Transaction{cbTx}
-	CreateBlock(txs, "My data", 0)
-
-	u1Tx := SendCoins(privKey1, address2, 50)
+	u1Tx, err := bc.SendCoins(privKey1, address2, 50, 0)
+	assert.NoError(t, err)
 
 	/*	txIn := TxIn{cbTx.Id, 0}
 		txIns := []TxIn{txIn}
@@ -45,15 +45,206 @@ func TestCoinbaseAndUsers(t *testing.T) {
 		txOuts := []TxOut{txOut1, txOut2}
 
 
-		u1Tx := createTx(privKey1, txIns, txOuts)*/
+		u1Tx := bc.createTx(privKey1, txIns, txOuts)*/
+
+	txs := []Transaction{u1Tx}
+	_, err = bc.CreateBlock(GenesisAddress, txs, "My data")
+	assert.NoError(t, err)
+
+	assert.Equal(t, len(bc.blocks), 3, "Genesis block + two blocks expected")
 
-	txs = []Transaction{u1Tx}
-	CreateBlock(txs, "My data", 0)
+	err = bc.validateChain(bc.blocks)
+	assert.NoError(t, err, "Blockchain should be valid")
+	assert.Equal(t, 50, bc.BalanceFor(address2))
+	assert.Equal(t, INITIAL_SUBSIDY-50, bc.BalanceFor(address1))
+}
 
-	assert.Equal(t, len(GlobalChain), 3, "Genesis block + two blocks expected")
+func TestVerifyTransaction(t *testing.T) {
+	bc := newTestChain()
+	bc.createGenesisBlock(true)
 
-	valid := validateChain(GlobalChain)
-	assert.True(t, valid, "Blockchain should be valid")
-	assert.Equal(t, 50, BalanceFor(address2))
-	assert.Equal(t, COINBASE_AMOUNT-50, BalanceFor(address1))
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	privKey2, _, address2 := cryptoff.CreateAddress()
+	_, err := bc.CreateBlock(address1, nil, "My data")
+	assert.NoError(t, err)
+	cbTx := bc.blocks[1].Transactions[0]
+
+	tx, err := bc.SendCoins(privKey1, address2, 50, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, bc.VerifyTransaction(tx))
+
+	//changing the content after signing breaks the id
+	tampered := tx
+	tampered.TxOuts = []TxOut{TxOutTo(address2, 500), TxOutTo(address1, 500)}
+	assert.Error(t, bc.VerifyTransaction(tampered))
+
+	//re-calculating the id after tampering breaks the signature
+	tampered.Id = calculateTxId(tampered)
+	assert.Error(t, bc.VerifyTransaction(tampered))
+
+	//spending coins of another address, even if signed correctly
+	stolen := bc.createTx(privKey2, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address2, INITIAL_SUBSIDY)})
+	assert.Error(t, bc.VerifyTransaction(stolen))
+
+	//spending more than the inputs have
+	overspend := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address2, INITIAL_SUBSIDY+1)})
+	assert.Error(t, bc.VerifyTransaction(overspend))
+
+	//spending the same txout twice in one transaction
+	twice := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}, {TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address2, INITIAL_SUBSIDY*2)})
+	assert.Error(t, bc.VerifyTransaction(twice))
+
+	//an unlocking script doing more than pushing values, even if it leaves true on the stack
+	notPush := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address2, INITIAL_SUBSIDY)})
+	notPush.TxIns[0].Script = Script{OP_1, OP_DUP}
+	notPush.Id = calculateTxId(notPush)
+	assert.Error(t, bc.VerifyTransaction(notPush))
+
+	//a signature from another transaction spending the same txout is not valid for this one
+	moved := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address2, INITIAL_SUBSIDY)})
+	moved.TxIns[0].Script = tx.TxIns[0].Script
+	moved.Id = calculateTxId(moved)
+	assert.Error(t, bc.VerifyTransaction(moved))
+
+	//spending a txout that does not exist
+	missing := bc.createTx(privKey1, []TxIn{{TxId: "abc", TxIdx: 0}}, []TxOut{TxOutTo(address2, 1)})
+	var txErr *TxValidationError
+	assert.True(t, errors.As(bc.VerifyTransaction(missing), &txErr))
+}
+
+func TestRejectBlockWithInvalidTx(t *testing.T) {
+	bc := newTestChain()
+	bc.createGenesisBlock(true)
+
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	_, _, address2 := cryptoff.CreateAddress()
+	_, err := bc.CreateBlock(address1, nil, "My data")
+	assert.NoError(t, err)
+
+	tx, err := bc.SendCoins(privKey1, address2, 50, 0)
+	assert.NoError(t, err)
+	//the txins are shared with the pooled copy, so change a copy of them
+	tx.TxIns = append([]TxIn{}, tx.TxIns...)
+	tx.TxIns[0].Script = UnlockScript([]byte(signData(privKey1, []byte("other data"))))
+	tx.Id = calculateTxId(tx)
+	_, err = bc.CreateBlock(address1, []Transaction{tx}, "Bad block")
+
+	var blockErr *BlockValidationError
+	assert.True(t, errors.As(err, &blockErr), "Block with invalid signature should be rejected")
+	var txErr *TxValidationError
+	assert.True(t, errors.As(err, &txErr), "Rejection should give the transaction error as reason")
+	assert.Equal(t, tx.Id, txErr.TxId)
+	assert.Equal(t, 2, len(bc.blocks), "Rejected block should not be added")
+	assert.Equal(t, 0, bc.BalanceFor(address2))
+	assert.Equal(t, INITIAL_SUBSIDY, bc.BalanceFor(address1))
+}
+
+//the sender pays the fee on top of the amount, and the miner of the block can claim it but no more
+func TestFees(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	_, _, address2 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+
+	_, err := bc.SendCoins(privKey1, address2, 50, -1)
+	assert.Error(t, err)
+	_, err = bc.SendCoins(privKey1, address2, INITIAL_SUBSIDY, 1)
+	assert.True(t, errors.Is(err, ErrInsufficientFunds), "fee should count towards the funds needed")
+	tx, err := bc.SendCoins(privKey1, address2, 50, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, []TxOut{TxOutTo(address2, 50), TxOutTo(address1, INITIAL_SUBSIDY-57)}, tx.TxOuts)
+
+	//a coinbase claiming more than the subsidy and fees is rejected
+	template, tipChanged := bc.newBlockTemplate("miner", []Transaction{tx}, "too much")
+	template.Transactions[0] = CreateCoinbaseTx("miner", 3, 8)
+	_, err = bc.mineOnTip(context.Background(), NewMiner(1), template, tipChanged)
+	assert.True(t, errors.Is(err, ErrCoinbaseTooLarge))
+	assert.Equal(t, 2, bc.Height())
+
+	block, err := bc.MinePending("miner", "fees")
+	assert.NoError(t, err)
+	assert.Equal(t, INITIAL_SUBSIDY+7, block.Transactions[0].TxOuts[0].Amount)
+	assert.Equal(t, INITIAL_SUBSIDY+7, bc.BalanceFor("miner"))
+	assert.Equal(t, 50, bc.BalanceFor(address2))
+	assert.Equal(t, INITIAL_SUBSIDY-57, bc.BalanceFor(address1))
+}
+
+//coins of several addresses combined in one transaction, each txin signed by the owner of its txout
+func TestSendFromMultipleAddresses(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	privKey2, _, address2 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+	_, err := bc.CreateBlock(address2, nil, "coins")
+	assert.NoError(t, err)
+
+	_, err = bc.SendCoinsFrom([]*ecdsa.PrivateKey{privKey1, privKey2}, "receiver", 2*INITIAL_SUBSIDY, 1)
+	assert.True(t, errors.Is(err, ErrInsufficientFunds))
+	_, err = bc.SendCoinsFrom(nil, "receiver", 1, 0)
+	assert.Error(t, err)
+
+	tx, err := bc.SendCoinsFrom([]*ecdsa.PrivateKey{privKey1, privKey2}, "receiver", INITIAL_SUBSIDY+100, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(tx.TxIns))
+	assert.NoError(t, verifyScript(tx.TxIns[0].Script, PubKeyScript(address1), scriptContext{sigHash(tx), 3}))
+	assert.NoError(t, verifyScript(tx.TxIns[1].Script, PubKeyScript(address2), scriptContext{sigHash(tx), 3}))
+	//change goes to the first sender
+	assert.Equal(t, []TxOut{TxOutTo("receiver", INITIAL_SUBSIDY+100), TxOutTo(address1, INITIAL_SUBSIDY-110)}, tx.TxOuts)
+
+	//the signatures of the two owners cannot be swapped
+	swapped := tx
+	swapped.TxIns = []TxIn{tx.TxIns[0], tx.TxIns[1]}
+	swapped.TxIns[0].Script, swapped.TxIns[1].Script = tx.TxIns[1].Script, tx.TxIns[0].Script
+	swapped.Id = calculateTxId(swapped)
+	assert.Error(t, bc.VerifyTransaction(swapped))
+
+	_, err = bc.MinePending("miner", "combined")
+	assert.NoError(t, err)
+	assert.Equal(t, INITIAL_SUBSIDY+100, bc.BalanceFor("receiver"))
+	assert.Equal(t, INITIAL_SUBSIDY-110, bc.BalanceFor(address1))
+	assert.Equal(t, 0, bc.BalanceFor(address2))
+}
+
+//blocks spending a txout twice, spending missing txouts or repeating a transaction are rejected without changing anything
+func TestBlockSpendRules(t *testing.T) {
+	bc := newTestChain()
+	privKey1, _, address1 := cryptoff.CreateAddress()
+	_, _, address2 := cryptoff.CreateAddress()
+	bc.CreateTestChain(address1, 1)
+	cbTx := bc.blocks[1].Transactions[0]
+
+	tx1 := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address2, INITIAL_SUBSIDY)})
+	tx2 := bc.createTx(privKey1, []TxIn{{TxId: cbTx.Id, TxIdx: 0}}, []TxOut{TxOutTo(address1, INITIAL_SUBSIDY)})
+	missing := bc.createTx(privKey1, []TxIn{{TxId: "abc", TxIdx: 0}}, []TxOut{TxOutTo(address2, 1)})
+	mine := func(txs []Transaction) (Block, error) {
+		template, tipChanged := bc.newBlockTemplate("miner", txs, "spends")
+		//the fees of invalid transactions make no sense, so claim just the subsidy
+		template.Transactions[0] = CreateCoinbaseTx("miner", template.Index, 0)
+		return bc.mineOnTip(context.Background(), NewMiner(1), template, tipChanged)
+	}
+	before := allUtxos(t, bc)
+	_, err := mine([]Transaction{tx1, tx2})
+	assert.True(t, errors.Is(err, ErrDoubleSpend), "got %v", err)
+	_, err = mine([]Transaction{tx1, missing})
+	assert.True(t, errors.Is(err, ErrMissingInput), "got %v", err)
+	_, err = mine([]Transaction{tx1, tx1})
+	assert.True(t, errors.Is(err, ErrDuplicateTx), "got %v", err)
+	assert.Equal(t, 2, bc.Height())
+	assert.Equal(t, before, allUtxos(t, bc))
+
+	//a transaction already in the chain cannot be included again
+	_, err = mine([]Transaction{tx1})
+	assert.NoError(t, err)
+	_, err = mine([]Transaction{tx1})
+	assert.True(t, errors.Is(err, ErrDuplicateTx), "got %v", err)
+	assert.Equal(t, 3, bc.Height())
+
+	//applying an unverified block with a bad transaction leaves the store as it was
+	store := NewMemoryUtxoStore()
+	assert.NoError(t, rebuildUtxos(store, bc.blocks[:2]))
+	stored, _ := store.All()
+	bad := Block{Index: 3, Hash: "bad", Transactions: []Transaction{CreateCoinbaseTx("miner", 3, 0), tx1, tx2}}
+	assert.True(t, errors.Is(applyBlockUtxos(store, bad), ErrMissingInput))
+	after, _ := store.All()
+	assert.Equal(t, stored, after)
 }
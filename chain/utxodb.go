@@ -0,0 +1,230 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"log"
+	"os"
+)
+
+//UtxoDB is a UtxoStore in a leveldb database, similar to the bitcoin chainstate.
+//keys in the database:
+//"u" + txid + txout index -> count, amount, coinbase block index, locking script and address of the unspent txout
+//"a" + address + 0 + txid + txout index -> nothing, the index of unspent txouts by address
+//"d" + block hash -> undo record of the block, gob encoded
+//"tip" -> hash of the block the state is for
+//
+//each update is written as one synced batch, so after a crash the database is at the last block fully applied
+
+var UTXO_DB_CACHE_SIZE = 16 * opt.MiB //memory for leveldb to cache unspent txouts in
+
+var (
+	utxoKeyPrefix    = []byte("u")
+	addressKeyPrefix = []byte("a")
+	undoKeyPrefix    = []byte("d")
+	utxoTipKey       = []byte("tip")
+)
+
+//UtxoDB is a UtxoStore kept in a leveldb database
+type UtxoDB struct {
+	db *leveldb.DB
+}
+
+//NewUtxoDB opens the database in the given directory, creating it if needed
+func NewUtxoDB(path string) (*UtxoDB, error) {
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(path, &opt.Options{BlockCacheCapacity: UTXO_DB_CACHE_SIZE})
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Opened unspent txout database at", path)
+	return &UtxoDB{db}, nil
+}
+
+func utxoKey(txId string, txIdx int) []byte {
+	key := append(append([]byte{}, utxoKeyPrefix...), txId...)
+	return binary.BigEndian.AppendUint32(key, uint32(txIdx))
+}
+
+func addressKey(address string, txId string, txIdx int) []byte {
+	key := append(addressPrefix(address), txId...)
+	return binary.BigEndian.AppendUint32(key, uint32(txIdx))
+}
+
+//addressPrefix is the start of the address index keys for the address. the 0 byte ends the address
+func addressPrefix(address string) []byte {
+	key := append(append([]byte{}, addressKeyPrefix...), address...)
+	return append(key, 0)
+}
+
+func undoKey(blockHash string) []byte {
+	return append(append([]byte{}, undoKeyPrefix...), blockHash...)
+}
+
+//encodeUtxo gives the value stored for an unspent txout: count, amount, coinbase block index, block index and script length,
+//then the script and the address
+func encodeUtxo(utxo UnspentTxOut, count int) []byte {
+	value := make([]byte, 24, 24+len(utxo.Script)+len(utxo.Address))
+	binary.BigEndian.PutUint32(value[0:], uint32(count))
+	binary.BigEndian.PutUint64(value[4:], uint64(utxo.Amount))
+	binary.BigEndian.PutUint32(value[12:], uint32(utxo.Coinbase))
+	binary.BigEndian.PutUint32(value[16:], uint32(utxo.Height))
+	binary.BigEndian.PutUint32(value[20:], uint32(len(utxo.Script)))
+	value = append(value, utxo.Script...)
+	return append(value, utxo.Address...)
+}
+
+func decodeUtxo(txId string, txIdx int, value []byte) (UnspentTxOut, int, error) {
+	if len(value) < 24 || len(value) < 24+int(binary.BigEndian.Uint32(value[20:])) {
+		return UnspentTxOut{}, 0, fmt.Errorf("invalid unspent txout record of %d bytes", len(value))
+	}
+	count := int(binary.BigEndian.Uint32(value[0:]))
+	amount := int(binary.BigEndian.Uint64(value[4:]))
+	coinbase := int(binary.BigEndian.Uint32(value[12:]))
+	height := int(binary.BigEndian.Uint32(value[16:]))
+	scriptEnd := 24 + int(binary.BigEndian.Uint32(value[20:]))
+	var script Script
+	if scriptEnd > 24 {
+		script = append(script, value[24:scriptEnd]...)
+	}
+	return UnspentTxOut{txId, txIdx, string(value[scriptEnd:]), amount, coinbase, script, height}, count, nil
+}
+
+//decodeUtxoKey gives the txid and index from a "u" or "a" key, they are at the end of both
+func decodeUtxoKey(key []byte, prefixLength int) (string, int) {
+	txId := string(key[prefixLength : len(key)-4])
+	txIdx := int(binary.BigEndian.Uint32(key[len(key)-4:]))
+	return txId, txIdx
+}
+
+func (udb *UtxoDB) Get(txId string, txIdx int) (UnspentTxOut, int, error) {
+	value, err := udb.db.Get(utxoKey(txId, txIdx), nil)
+	if err == leveldb.ErrNotFound {
+		return UnspentTxOut{}, 0, nil
+	}
+	if err != nil {
+		return UnspentTxOut{}, 0, err
+	}
+	return decodeUtxo(txId, txIdx, value)
+}
+
+func (udb *UtxoDB) ForAddress(address string) ([]UnspentTxOut, error) {
+	prefix := addressPrefix(address)
+	iter := udb.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	utxos := []UnspentTxOut{}
+	for iter.Next() {
+		txId, txIdx := decodeUtxoKey(iter.Key(), len(prefix))
+		utxo, count, err := udb.Get(txId, txIdx)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < count; i++ {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos, iter.Error()
+}
+
+func (udb *UtxoDB) All() ([]UnspentTxOut, error) {
+	iter := udb.db.NewIterator(util.BytesPrefix(utxoKeyPrefix), nil)
+	defer iter.Release()
+	utxos := []UnspentTxOut{}
+	for iter.Next() {
+		txId, txIdx := decodeUtxoKey(iter.Key(), len(utxoKeyPrefix))
+		utxo, count, err := decodeUtxo(txId, txIdx, iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < count; i++ {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos, iter.Error()
+}
+
+func (udb *UtxoDB) Tip() (string, error) {
+	value, err := udb.db.Get(utxoTipKey, nil)
+	if err == leveldb.ErrNotFound {
+		return "", nil
+	}
+	return string(value), err
+}
+
+func (udb *UtxoDB) Undo(blockHash string) (BlockUndo, bool, error) {
+	value, err := udb.db.Get(undoKey(blockHash), nil)
+	if err == leveldb.ErrNotFound {
+		return BlockUndo{}, false, nil
+	}
+	if err != nil {
+		return BlockUndo{}, false, err
+	}
+	var undo BlockUndo
+	err = gob.NewDecoder(bytes.NewReader(value)).Decode(&undo)
+	return undo, err == nil, err
+}
+
+func (udb *UtxoDB) Apply(update UtxoUpdate) error {
+	changes, txOuts := update.netChanges()
+	batch := new(leveldb.Batch)
+	for point, change := range changes {
+		if change == 0 {
+			continue
+		}
+		_, count, err := udb.Get(point.TxId, point.TxIdx)
+		if err != nil {
+			return err
+		}
+		utxo := txOuts[point]
+		count += change
+		if count <= 0 {
+			if count < 0 {
+				log.Println("Removing txout not unspent:", point)
+			}
+			batch.Delete(utxoKey(point.TxId, point.TxIdx))
+			batch.Delete(addressKey(utxo.Address, point.TxId, point.TxIdx))
+			continue
+		}
+		batch.Put(utxoKey(point.TxId, point.TxIdx), encodeUtxo(utxo, count))
+		batch.Put(addressKey(utxo.Address, point.TxId, point.TxIdx), nil)
+	}
+	if update.Undo != nil {
+		var undo bytes.Buffer
+		err := gob.NewEncoder(&undo).Encode(update.Undo)
+		if err != nil {
+			return err
+		}
+		batch.Put(undoKey(update.Block), undo.Bytes())
+	} else {
+		batch.Delete(undoKey(update.Block))
+	}
+	batch.Put(utxoTipKey, []byte(update.Tip))
+	return udb.db.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func (udb *UtxoDB) Clear() error {
+	log.Println("Clearing unspent txout database")
+	batch := new(leveldb.Batch)
+	iter := udb.db.NewIterator(nil, nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+	return udb.db.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func (udb *UtxoDB) Close() error {
+	return udb.db.Close()
+}
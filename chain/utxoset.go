@@ -0,0 +1,435 @@
+package chain
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+//the unspent txouts of the current chain are kept in a UtxoStore, keyed by (transaction id, txout index), with an index
+//by address for balances. connecting a block applies its changes to the store as one update, together with an undo record
+//holding the txouts the block spent, so the block can be disconnected later without replaying the chain.
+//the store records which block its state is for, so a restarting node whose stored blocks end at the same block
+//does not need to replay all the transactions.
+//
+//a transaction with the id of one that still has unspent txouts is rejected, so each txout is unspent at most once.
+//the store still counts them, as stores written by older versions may hold the same txout more than once
+
+//UtxoUpdate is a change to the unspent txouts from connecting or disconnecting a block, applied as a whole
+type UtxoUpdate struct {
+	Tip     string         //hash of the block the store is at after the update
+	Removed []UnspentTxOut //txouts spent by the block, or created by it when disconnecting
+	Added   []UnspentTxOut //txouts created by the block, or restored when disconnecting
+	Block   string         //hash of the block to store or delete the undo record for
+	Undo    *BlockUndo     //undo record for a connected block, nil to delete the record of a disconnected block
+}
+
+//UtxoStore holds the unspent txouts of the chain and the undo records of its blocks
+type UtxoStore interface {
+	Get(txId string, txIdx int) (UnspentTxOut, int, error) //the txout and how many times it is unspent, 0 if not at all
+	ForAddress(address string) ([]UnspentTxOut, error)     //unspent txouts paying to the address
+	All() ([]UnspentTxOut, error)                          //all unspent txouts
+	Tip() (string, error)                                  //hash of the block the state is for, empty if none
+	Undo(blockHash string) (BlockUndo, bool, error)        //undo record for the block, false if none stored
+	Apply(update UtxoUpdate) error                         //apply the update, all or nothing
+	Clear() error                                          //remove everything, to build the state again from genesis
+}
+
+//outPoint identifies a txout
+type outPoint struct {
+	TxId  string
+	TxIdx int
+}
+
+func pointOf(utxo UnspentTxOut) outPoint {
+	return outPoint{utxo.TxId, utxo.TxIdx}
+}
+
+//netChanges sums the update into a change in count per txout, so a txout created and spent in the same block cancels out
+func (update UtxoUpdate) netChanges() (map[outPoint]int, map[outPoint]UnspentTxOut) {
+	changes := make(map[outPoint]int)
+	txOuts := make(map[outPoint]UnspentTxOut)
+	for _, utxo := range update.Removed {
+		changes[pointOf(utxo)]--
+		txOuts[pointOf(utxo)] = utxo
+	}
+	for _, utxo := range update.Added {
+		changes[pointOf(utxo)]++
+		txOuts[pointOf(utxo)] = utxo
+	}
+	return changes, txOuts
+}
+
+//sortUtxos orders unspent txouts by transaction id and index, so listings do not depend on map order
+func sortUtxos(utxos []UnspentTxOut) {
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].TxId != utxos[j].TxId {
+			return utxos[i].TxId < utxos[j].TxId
+		}
+		return utxos[i].TxIdx < utxos[j].TxIdx
+	})
+}
+
+//utxoEntry is an unspent txout with the number of times it is unspent
+type utxoEntry struct {
+	utxo  UnspentTxOut
+	count int
+}
+
+//MemoryUtxoStore keeps the unspent txouts in memory only, for tests and simulated nodes
+type MemoryUtxoStore struct {
+	lock      sync.Mutex //chains sharing a MemoryStorage also share this
+	utxos     map[outPoint]utxoEntry
+	byAddress map[string]map[outPoint]bool
+	undo      map[string]BlockUndo
+	tip       string
+}
+
+func NewMemoryUtxoStore() *MemoryUtxoStore {
+	return &MemoryUtxoStore{utxos: make(map[outPoint]utxoEntry), byAddress: make(map[string]map[outPoint]bool), undo: make(map[string]BlockUndo)}
+}
+
+func (ms *MemoryUtxoStore) Get(txId string, txIdx int) (UnspentTxOut, int, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	entry := ms.utxos[outPoint{txId, txIdx}]
+	return entry.utxo, entry.count, nil
+}
+
+func (ms *MemoryUtxoStore) ForAddress(address string) ([]UnspentTxOut, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	utxos := []UnspentTxOut{}
+	for point := range ms.byAddress[address] {
+		entry := ms.utxos[point]
+		for i := 0; i < entry.count; i++ {
+			utxos = append(utxos, entry.utxo)
+		}
+	}
+	sortUtxos(utxos)
+	return utxos, nil
+}
+
+func (ms *MemoryUtxoStore) All() ([]UnspentTxOut, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	utxos := []UnspentTxOut{}
+	for _, entry := range ms.utxos {
+		for i := 0; i < entry.count; i++ {
+			utxos = append(utxos, entry.utxo)
+		}
+	}
+	sortUtxos(utxos)
+	return utxos, nil
+}
+
+func (ms *MemoryUtxoStore) Tip() (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.tip, nil
+}
+
+func (ms *MemoryUtxoStore) Undo(blockHash string) (BlockUndo, bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	undo, found := ms.undo[blockHash]
+	return undo, found, nil
+}
+
+func (ms *MemoryUtxoStore) Apply(update UtxoUpdate) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	changes, txOuts := update.netChanges()
+	for point, change := range changes {
+		if change == 0 {
+			continue
+		}
+		entry := ms.utxos[point]
+		entry.utxo = txOuts[point]
+		entry.count += change
+		address := entry.utxo.Address
+		if entry.count <= 0 {
+			if entry.count < 0 {
+				log.Println("Removing txout not unspent:", point)
+			}
+			delete(ms.utxos, point)
+			delete(ms.byAddress[address], point)
+			if len(ms.byAddress[address]) == 0 {
+				delete(ms.byAddress, address)
+			}
+			continue
+		}
+		ms.utxos[point] = entry
+		if ms.byAddress[address] == nil {
+			ms.byAddress[address] = make(map[outPoint]bool)
+		}
+		ms.byAddress[address][point] = true
+	}
+	if update.Undo != nil {
+		ms.undo[update.Block] = *update.Undo
+	} else {
+		delete(ms.undo, update.Block)
+	}
+	ms.tip = update.Tip
+	return nil
+}
+
+func (ms *MemoryUtxoStore) Clear() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.utxos = make(map[outPoint]utxoEntry)
+	ms.byAddress = make(map[string]map[outPoint]bool)
+	ms.undo = make(map[string]BlockUndo)
+	ms.tip = ""
+	return nil
+}
+
+//utxoView shows the unspent txouts of a store with transactions applied on top, without changing the store.
+//used to check transactions against the chain plus transactions not in it yet, e.g. the mempool or a block being verified.
+//the changes are collected so they can be applied to the store as an update
+type utxoView struct {
+	store   UtxoStore
+	index   int                       //index of the block the transactions applied go to, for the coinbase maturity
+	changes map[outPoint]int          //change in count on top of the store for each txout
+	spent   map[outPoint]bool         //txouts spent in the view. each can be spent once, even if unspent more than once in the store
+	created map[outPoint]UnspentTxOut //txouts created by the transactions applied
+	order   []outPoint                //created txouts in the order created
+	removed []UnspentTxOut            //txouts spent by the transactions applied
+	added   []UnspentTxOut            //txouts created by the transactions applied
+}
+
+//newUtxoView creates a view on the store, for transactions going to the block at given index
+func newUtxoView(store UtxoStore, index int) *utxoView {
+	return &utxoView{store: store, index: index, changes: make(map[outPoint]int), spent: make(map[outPoint]bool), created: make(map[outPoint]UnspentTxOut)}
+}
+
+//get looks for the unspent txout with given transaction id and index. returns false if not found
+func (v *utxoView) get(txId string, txIdx int) (UnspentTxOut, bool) {
+	point := outPoint{txId, txIdx}
+	if v.spent[point] {
+		return UnspentTxOut{}, false
+	}
+	utxo, count, err := v.store.Get(txId, txIdx)
+	if err != nil {
+		log.Println("Failed to read unspent txout:", err)
+		count = 0
+	}
+	if created, found := v.created[point]; found {
+		utxo = created
+	}
+	return utxo, count+v.changes[point] > 0
+}
+
+//forAddress gives the unspent txouts paying to the given address, stored ones first and then ones created in the view
+func (v *utxoView) forAddress(address string) []UnspentTxOut {
+	stored, err := v.store.ForAddress(address)
+	if err != nil {
+		log.Println("Failed to read unspent txouts for", address, ":", err)
+	}
+	counts := make(map[outPoint]int)
+	txOuts := make(map[outPoint]UnspentTxOut)
+	points := []outPoint{}
+	for _, utxo := range stored {
+		point := pointOf(utxo)
+		if _, seen := txOuts[point]; !seen {
+			points = append(points, point)
+			txOuts[point] = utxo
+		}
+		counts[point]++
+	}
+	for _, point := range v.order {
+		if _, seen := txOuts[point]; !seen && v.created[point].Address == address {
+			points = append(points, point)
+			txOuts[point] = v.created[point]
+		}
+	}
+	utxos := []UnspentTxOut{}
+	for _, point := range points {
+		if v.spent[point] {
+			continue
+		}
+		for i := 0; i < counts[point]+v.changes[point]; i++ {
+			utxos = append(utxos, txOuts[point])
+		}
+	}
+	return utxos
+}
+
+//apply spends the txins of the transaction and adds its txouts to the view. returns the txouts spent.
+//if a txin does not refer to an unspent txout, or a txout of the transaction already exists unspent,
+//the view is not changed and ErrMissingInput or ErrDuplicateTx is returned
+func (v *utxoView) apply(tx Transaction) ([]UnspentTxOut, error) {
+	spent := []UnspentTxOut{}
+	txIns := tx.TxIns
+	if isCoinbase(tx) {
+		//the coinbase txin only holds the block index
+		txIns = nil
+	}
+	seen := make(map[outPoint]bool)
+	for _, txIn := range txIns {
+		point := outPoint{txIn.TxId, txIn.TxIdx}
+		utxo, found := v.get(txIn.TxId, txIn.TxIdx)
+		if !found || seen[point] {
+			log.Println("Txout to spend not found: ", txIn.TxId, txIn.TxIdx)
+			return nil, fmt.Errorf("%w: (%s, %d) in %s", ErrMissingInput, txIn.TxId, txIn.TxIdx, tx.Id)
+		}
+		seen[point] = true
+		spent = append(spent, utxo)
+	}
+	for idx := range tx.TxOuts {
+		if _, found := v.get(tx.Id, idx); found {
+			log.Println("Txout to create already exists: ", tx.Id, idx)
+			return nil, fmt.Errorf("%w: %s already has unspent txouts", ErrDuplicateTx, tx.Id)
+		}
+	}
+	for _, utxo := range spent {
+		v.changes[pointOf(utxo)]--
+		v.spent[pointOf(utxo)] = true
+		v.removed = append(v.removed, utxo)
+	}
+	for _, utxo := range txOutsOf(tx, v.index) {
+		point := pointOf(utxo)
+		if _, found := v.created[point]; !found {
+			v.created[point] = utxo
+			v.order = append(v.order, point)
+		}
+		v.changes[point]++
+		delete(v.spent, point)
+		v.added = append(v.added, utxo)
+	}
+	return spent, nil
+}
+
+//mature checks if the txout can be spent by a transaction in the block the view is for.
+//a coinbase txout needs COINBASE_MATURITY blocks on top of its block first
+func (v *utxoView) mature(utxo UnspentTxOut) bool {
+	return utxo.Coinbase == 0 || v.index-utxo.Coinbase >= COINBASE_MATURITY
+}
+
+//txOutsOf gives the txouts of the transaction in the block at given index as unspent txouts, marked with the block index if from a coinbase
+func txOutsOf(tx Transaction, index int) []UnspentTxOut {
+	coinbase := 0
+	if isCoinbase(tx) {
+		coinbase = tx.TxIns[0].TxIdx
+	}
+	utxos := []UnspentTxOut{}
+	for idx, txOut := range tx.TxOuts {
+		utxos = append(utxos, UnspentTxOut{tx.Id, idx, txOut.Address, txOut.Amount, coinbase, txOut.Script, index})
+	}
+	return utxos
+}
+
+//rebuildUtxos clears the store and applies the given blocks to it from genesis, as when they were first connected
+func rebuildUtxos(store UtxoStore, blocks []Block) error {
+	err := store.Clear()
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		err = applyBlockUtxos(store, block)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Rebuilt unspent txouts from", len(blocks), "blocks")
+	return nil
+}
+
+//UtxoCheck is the result of comparing the stored unspent txouts to ones rebuilt from the blocks of the chain
+type UtxoCheck struct {
+	Tip        string         //hash of the last block in the chain
+	StoredTip  string         //hash of the block the stored unspent txouts are for
+	Rebuilt    int            //number of unspent txouts rebuilt from the blocks
+	Missing    []UnspentTxOut //rebuilt from the blocks but not in the store
+	Extra      []UnspentTxOut //in the store but not rebuilt from the blocks
+	BadAddress []string       //addresses for which the address index does not give the rebuilt unspent txouts
+}
+
+//Ok is true if the store matched the blocks
+func (check UtxoCheck) Ok() bool {
+	return check.Tip == check.StoredTip && len(check.Missing) == 0 && len(check.Extra) == 0 && len(check.BadAddress) == 0
+}
+
+//CheckUtxos rebuilds the unspent txouts from the blocks of the current chain in memory, and compares the store to them
+func (bc *Blockchain) CheckUtxos() (UtxoCheck, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	check := UtxoCheck{Tip: bc.blocks[len(bc.blocks)-1].Hash}
+	var err error
+	check.StoredTip, err = bc.utxos.Tip()
+	if err != nil {
+		return check, err
+	}
+	rebuilt := NewMemoryUtxoStore()
+	err = rebuildUtxos(rebuilt, bc.blocks)
+	if err != nil {
+		return check, err
+	}
+	expected, _ := rebuilt.All()
+	stored, err := bc.utxos.All()
+	if err != nil {
+		return check, err
+	}
+	check.Rebuilt = len(expected)
+	check.Missing, check.Extra = diffUtxos(expected, stored)
+	for address := range rebuilt.byAddress {
+		expected, _ := rebuilt.ForAddress(address)
+		stored, err := bc.utxos.ForAddress(address)
+		if err != nil {
+			return check, err
+		}
+		missing, extra := diffUtxos(expected, stored)
+		if len(missing) > 0 || len(extra) > 0 {
+			check.BadAddress = append(check.BadAddress, address)
+		}
+	}
+	log.Printf("Checked unspent txouts: %d rebuilt, %d missing, %d extra, %d bad addresses", check.Rebuilt, len(check.Missing), len(check.Extra), len(check.BadAddress))
+	return check, nil
+}
+
+//utxoContent is the content of an unspent txout as a comparable value, to use as a map key
+type utxoContent struct {
+	point    outPoint
+	address  string
+	amount   int
+	coinbase int
+	script   string
+	height   int
+}
+
+func contentOf(utxo UnspentTxOut) utxoContent {
+	return utxoContent{pointOf(utxo), utxo.Address, utxo.Amount, utxo.Coinbase, string(utxo.Script), utxo.Height}
+}
+
+//diffUtxos gives the txouts in expected but not in actual, and the ones in actual but not in expected, counting duplicates
+func diffUtxos(expected []UnspentTxOut, actual []UnspentTxOut) ([]UnspentTxOut, []UnspentTxOut) {
+	counts := make(map[utxoContent]int)
+	for _, utxo := range actual {
+		counts[contentOf(utxo)]++
+	}
+	missing := []UnspentTxOut{}
+	for _, utxo := range expected {
+		if counts[contentOf(utxo)] > 0 {
+			counts[contentOf(utxo)]--
+			continue
+		}
+		missing = append(missing, utxo)
+	}
+	extra := []UnspentTxOut{}
+	for _, utxo := range actual {
+		if counts[contentOf(utxo)] > 0 {
+			counts[contentOf(utxo)]--
+			extra = append(extra, utxo)
+		}
+	}
+	return missing, extra
+}
+
+//RebuildUtxos replaces the stored unspent txouts with ones rebuilt from the blocks of the current chain.
+//the undo records of the blocks are written again as well
+func (bc *Blockchain) RebuildUtxos() error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return rebuildUtxos(bc.utxos, bc.blocks)
+}
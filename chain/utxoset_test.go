@@ -0,0 +1,115 @@
+package chain
+
+import (
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+//apply the same updates to both stores, and check they give the same unspent txouts, address index and undo records
+func TestUtxoStores(t *testing.T) {
+	utxoDB, err := NewUtxoDB(t.TempDir())
+	assert.NoError(t, err)
+	defer utxoDB.Close()
+	for name, store := range map[string]UtxoStore{"memory": NewMemoryUtxoStore(), "leveldb": utxoDB} {
+		cb := UnspentTxOut{"cb", 0, "miner", 1000, 1, PubKeyScript("miner"), 1}
+		pay := UnspentTxOut{"pay", 0, "receiver", 400, 0, PubKeyScript("receiver"), 3}
+		change := UnspentTxOut{"pay", 1, "miner", 600, 0, PubKeyScript("miner"), 3}
+		undo := BlockUndo{[][]UnspentTxOut{nil, {cb}}}
+
+		//the same coinbase twice is counted twice
+		assert.NoError(t, store.Apply(UtxoUpdate{"block1", nil, []UnspentTxOut{cb}, "block1", &BlockUndo{}}), name)
+		assert.NoError(t, store.Apply(UtxoUpdate{"block2", nil, []UnspentTxOut{cb}, "block2", &BlockUndo{}}), name)
+		utxo, count, err := store.Get("cb", 0)
+		assert.NoError(t, err, name)
+		assert.Equal(t, cb, utxo, name)
+		assert.Equal(t, 2, count, name)
+
+		//a block creating a txout and spending it cancels out
+		temp := UnspentTxOut{"temp", 0, "miner", 5, 0, PubKeyScript("miner"), 3}
+		update := UtxoUpdate{"block3", []UnspentTxOut{cb, temp}, []UnspentTxOut{temp, pay, change}, "block3", &undo}
+		assert.NoError(t, store.Apply(update), name)
+		all, err := store.All()
+		assert.NoError(t, err, name)
+		assert.Equal(t, []UnspentTxOut{cb, pay, change}, all, name)
+		forMiner, err := store.ForAddress("miner")
+		assert.NoError(t, err, name)
+		assert.Equal(t, []UnspentTxOut{cb, change}, forMiner, name)
+		stored, found, err := store.Undo("block3")
+		assert.NoError(t, err, name)
+		assert.True(t, found, name)
+		assert.Equal(t, undo, stored, name)
+		tip, _ := store.Tip()
+		assert.Equal(t, "block3", tip, name)
+
+		//disconnecting block3 restores the state before it
+		assert.NoError(t, store.Apply(UtxoUpdate{"block2", []UnspentTxOut{pay, change}, []UnspentTxOut{cb}, "block3", nil}), name)
+		all, _ = store.All()
+		assert.Equal(t, []UnspentTxOut{cb, cb}, all, name)
+		forReceiver, _ := store.ForAddress("receiver")
+		assert.Empty(t, forReceiver, name)
+		_, found, _ = store.Undo("block3")
+		assert.False(t, found, name)
+
+		assert.NoError(t, store.Clear(), name)
+		all, _ = store.All()
+		assert.Empty(t, all, name)
+		tip, _ = store.Tip()
+		assert.Equal(t, "", tip, name)
+	}
+}
+
+//restart a chain from a block store: the stored unspent txouts are used when they match the stored blocks,
+//and rebuilt from the blocks when the node stopped between storing a block and applying it to the unspent txouts
+func TestUtxosOnRestart(t *testing.T) {
+	path := t.TempDir()
+	privKey, _, address := cryptoff.CreateAddress()
+	bs, err := NewBlockStore(path)
+	assert.NoError(t, err)
+	bc := NewBlockchain(DefaultGenesis, bs)
+	bc.CreateTestChain(address, 2)
+	_, err = bc.SendCoins(privKey, "receiver", 300, 0)
+	assert.NoError(t, err)
+	_, err = bc.MinePending(address, "payment")
+	assert.NoError(t, err)
+	assert.NoError(t, bc.WriteBlockChain())
+	//a txout not from any block shows whether the stored state is used as it is
+	extra := UnspentTxOut{"extra", 0, "receiver", 1, 0, PubKeyScript("receiver"), 1}
+	assert.NoError(t, bc.utxos.Apply(UtxoUpdate{bc.Blocks()[3].Hash, nil, []UnspentTxOut{extra}, "none", nil}))
+	assert.NoError(t, bc.Close())
+
+	bs, err = NewBlockStore(path)
+	assert.NoError(t, err)
+	restarted := NewBlockchain(DefaultGenesis, bs)
+	assert.True(t, restarted.InitBlockChain())
+	assert.Equal(t, 301, restarted.BalanceFor("receiver"))
+	check, err := restarted.CheckUtxos()
+	assert.NoError(t, err)
+	assert.False(t, check.Ok())
+	assert.Equal(t, []UnspentTxOut{extra}, check.Extra)
+	assert.Empty(t, check.Missing)
+	assert.Equal(t, []string{"receiver"}, check.BadAddress)
+	assert.NoError(t, restarted.RebuildUtxos())
+	check, err = restarted.CheckUtxos()
+	assert.NoError(t, err)
+	assert.True(t, check.Ok())
+	assert.Equal(t, 300, restarted.BalanceFor("receiver"))
+
+	//a block stored without its transactions applied, as if the node crashed in between, leaves the unspent txouts behind the stored blocks
+	next := appendTestBlock(restarted.Blocks(), nil)
+	assert.NoError(t, bs.AppendBlock(next[4]))
+	assert.NoError(t, restarted.Close())
+
+	bs, err = NewBlockStore(path)
+	assert.NoError(t, err)
+	again := NewBlockchain(DefaultGenesis, bs)
+	defer again.Close()
+	assert.True(t, again.InitBlockChain())
+	assert.Equal(t, 5, again.Height())
+	assert.Equal(t, next, again.Blocks())
+	assert.Equal(t, INITIAL_SUBSIDY, again.BalanceFor("appended"))
+	assert.Equal(t, 300, again.BalanceFor("receiver"))
+	check, err = again.CheckUtxos()
+	assert.NoError(t, err)
+	assert.True(t, check.Ok())
+}
@@ -43,6 +43,26 @@ func verifyESig(pub *ecdsa.PublicKey, msg []byte, esig ecdsaSignature) bool {
 	return ecdsa.Verify(pub, digest[:], esig.R, esig.S)
 }
 
+//VerifySignature checks that the given base58 encoded signature (as produced by merging R and S with MergeTwoByteSlices)
+//is a valid signature by the given public key over the given bytes
+func VerifySignature(pub *ecdsa.PublicKey, msg []byte, sig58 string) bool {
+	if pub == nil || pub.X == nil || pub.Y == nil || !Curve.IsOnCurve(pub.X, pub.Y) {
+		return false
+	}
+	data, err := base58.Decode(sig58)
+	if err != nil {
+		return false
+	}
+	rBytes, sBytes := splitTwoByteSlices(data)
+	if len(rBytes) == 0 || len(sBytes) == 0 {
+		return false
+	}
+	var esig ecdsaSignature
+	esig.R = bytesToBigInt(rBytes)
+	esig.S = bytesToBigInt(sBytes)
+	return verifyESig(pub, msg, esig)
+}
+
 //encodePrivateKey base58 encodes the private key for storage/presentation
 func EncodePrivateKey(privKey *ecdsa.PrivateKey) string {
 	return base58.Encode(privKey.D.Bytes())
@@ -82,18 +102,25 @@ func MergeTwoByteSlices(slice1 []byte, slice2 []byte) []byte {
 	//https://stackoverflow.com/questions/37210379/convert-int-to-a-single-byte-in-go#37210523
 	finalBytes[0] = byte(s1Len)
 	copy(finalBytes[1:1+s1Len], slice1[:])
-	copy(finalBytes[1+s2Len:], slice2[:])
+	copy(finalBytes[1+s1Len:], slice2[:])
 	return finalBytes
 }
 
 //splitTwoByteSlices splits a merged byte slice, produced by mergeTwoByteSlices()
+//returns two nil slices if the given data is too short to contain what the length byte says
 func splitTwoByteSlices(whole []byte) ([]byte, []byte) {
+	if len(whole) < 1 {
+		return nil, nil
+	}
 	//int(byte) seems to always produce a positive valued integer (-1 = 255). so I just trust this is ok for 1 byte length
 	size1 := int(whole[0])
 	slice1End := 1 + size1
+	if slice1End > len(whole) {
+		return nil, nil
+	}
 	//if want big.int: https://stackoverflow.com/questions/24757814/golang-convert-byte-array-to-big-int
 	slice1 := whole[1:slice1End]
-	slice2 := whole[slice1End+1:]
+	slice2 := whole[slice1End:]
 	return slice1, slice2
 }
 
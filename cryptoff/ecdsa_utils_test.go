@@ -9,6 +9,7 @@ import (
 	"encoding/asn1"
 	"encoding/hex"
 	"fmt"
+	"github.com/akamensky/base58"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -74,6 +75,21 @@ func TestEncodeDecodeKeys(t *testing.T) {
 
 }
 
+//sign data the same way transactions are signed (merged R and S, base58 encoded) and verify it with VerifySignature
+func TestVerifyEncodedSignature(t *testing.T) {
+	privKey, pubKey, address := CreateAddress()
+	msg := []byte("Hello ECDSA")
+	esig := CreateSignature(msg, privKey)
+	sig58 := base58.Encode(MergeTwoByteSlices(esig.R.Bytes(), esig.S.Bytes()))
+
+	assert.True(t, VerifySignature(pubKey, msg, sig58), "Encoded signature should verify OK")
+	assert.True(t, VerifySignature(DecodePublicKey(address), msg, sig58), "Encoded signature should verify OK with decoded key")
+	assert.False(t, VerifySignature(pubKey, []byte("Hello ECDSB"), sig58), "Signature should not verify for other data")
+	_, otherKey, _ := CreateAddress()
+	assert.False(t, VerifySignature(otherKey, msg, sig58), "Signature should not verify for other key")
+	assert.False(t, VerifySignature(pubKey, msg, "abc"), "Garbage signature should not verify")
+}
+
 func TestErroReporting(t *testing.T) {
 	//this reports two errors, so all errors are reported
 	t.Errorf("Error 1")
@@ -1,22 +1,82 @@
 package main
 
 import (
+	"flag"
 	"github.com/mukatee/go-naive/chain"
+	"github.com/mukatee/go-naive/net"
 	"github.com/mukatee/go-naive/wallet"
 	"io"
 	"log"
 	"os"
+	"strings"
 )
 
+var p2pAddress = flag.String("p2p", "", "address to accept peer connections at, e.g. :9200. no peer networking if empty")
+var peerList = flag.String("peers", "", "comma separated addresses of peers to connect to and sync from")
+var rpcAddress = flag.String("rpc", ":9090", "address to serve the HTTP RPC interface at. no RPC if empty")
+
 func main() {
+	flag.Parse()
 	print(wallet.HelpText)
 	setupLogging()
 	addr, loaded := wallet.InitWallet()
-	loaded = chain.InitBlockChain()
+	storage, err := chain.NewBlockStore("node/blocks/")
+	if err != nil {
+		log.Fatal("Failed to open block store: ", err)
+	}
+	bc := chain.NewBlockchain(chain.DefaultGenesis, storage)
+	loaded = bc.InitBlockChain()
 	if !loaded {
-		chain.CreateTestChain(addr, 2)
+		if *peerList != "" {
+			//only the genesis block, rest is synced from peers
+			bc.CreateTestChain(addr, 0)
+		} else {
+			bc.CreateTestChain(addr, 2)
+		}
+	}
+	node := startNode(bc)
+	//the same miner is controlled from the console and over RPC
+	mining := chain.NewMiningService(bc, 0, addr)
+	startServer(bc, mining, node)
+	wallet.ReadConsole(bc, mining)
+}
+
+//startServer starts the RPC server if an address is given in the command line, connecting added peers with the given node if any
+func startServer(bc *chain.Blockchain, mining *chain.MiningService, node *net.Node) {
+	if *rpcAddress == "" {
+		return
+	}
+	server := net.NewServer(bc, mining)
+	if node != nil {
+		server.SetNode(node)
+	}
+	server.Start(*rpcAddress)
+	log.Println("RPC server listening at", *rpcAddress)
+}
+
+//startNode starts the peer networking if asked for in the command line. a loaded chain resumes syncing from its stored height.
+//returns nil if there is no peer networking
+func startNode(bc *chain.Blockchain) *net.Node {
+	if *p2pAddress == "" && *peerList == "" {
+		return nil
+	}
+	node := net.NewNode(bc)
+	if *p2pAddress != "" {
+		err := node.Listen(*p2pAddress)
+		if err != nil {
+			log.Fatal("Failed to start p2p listener: ", err)
+		}
+	}
+	for _, peer := range strings.Split(*peerList, ",") {
+		if peer == "" {
+			continue
+		}
+		err := node.Connect(peer)
+		if err != nil {
+			log.Println("Failed to connect to peer", peer, ":", err)
+		}
 	}
-	wallet.ReadConsole()
+	return node
 }
 
 func setupLogging() {
@@ -0,0 +1,167 @@
+package net
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/mukatee/go-naive/chain"
+)
+
+//message payloads are sent in a binary encoding following the canonical encoding of blocks and transactions (see chain/encoding.go):
+//integers are big-endian, counts 4 bytes and other integers 8 bytes signed, a string is its length followed by its bytes.
+//blocks, transactions and headers are sent in their canonical encoding.
+//the message envelope is json, so each payload goes in it as a base64 string
+//
+//version: protocol version (4 bytes), genesis hash, height, listen address, time
+//inv and getdata: kind, hash count, hashes
+//getheaders and getblocks: from, count
+//headers, blocks and chain: a json list with the encoding of each header or block
+
+func appendInt64(buf []byte, value int64) []byte {
+	return binary.BigEndian.AppendUint64(buf, uint64(value))
+}
+
+func appendString(buf []byte, value string) []byte {
+	return append(binary.BigEndian.AppendUint32(buf, uint32(len(value))), value...)
+}
+
+//payloadDecoder reads the fields of a payload in order. the first error is kept and later reads do nothing
+type payloadDecoder struct {
+	data []byte
+	err  error
+}
+
+//newPayloadDecoder reads the encoded bytes from the json payload of a message
+func newPayloadDecoder(payload json.RawMessage) *payloadDecoder {
+	d := &payloadDecoder{}
+	d.err = json.Unmarshal(payload, &d.data)
+	return d
+}
+
+func (d *payloadDecoder) next(size int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < size {
+		d.err = fmt.Errorf("%w: need %d bytes, %d left", chain.ErrBadEncoding, size, len(d.data))
+		return nil
+	}
+	bytes := d.data[:size]
+	d.data = d.data[size:]
+	return bytes
+}
+
+func (d *payloadDecoder) uint32() uint32 {
+	bytes := d.next(4)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(bytes)
+}
+
+func (d *payloadDecoder) int64() int64 {
+	bytes := d.next(8)
+	if d.err != nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(bytes))
+}
+
+func (d *payloadDecoder) string() string {
+	return string(d.next(int(d.uint32())))
+}
+
+//count reads the number of items that follow, each taking at least minSize bytes
+func (d *payloadDecoder) count(minSize int) int {
+	count := int(d.uint32())
+	if d.err == nil && count*minSize > len(d.data) {
+		d.err = fmt.Errorf("%w: count %d does not fit in %d bytes", chain.ErrBadEncoding, count, len(d.data))
+		return 0
+	}
+	return count
+}
+
+//end checks all bytes were read, and gives the first error
+func (d *payloadDecoder) end() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("%w: %d extra bytes", chain.ErrBadEncoding, len(d.data))
+	}
+	return d.err
+}
+
+func encodeVersion(version VersionPayload) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(version.Version))
+	buf = appendString(buf, version.GenesisHash)
+	buf = appendInt64(buf, int64(version.Height))
+	buf = appendString(buf, version.ListenAddress)
+	return appendInt64(buf, version.Time)
+}
+
+func decodeVersion(payload json.RawMessage) (VersionPayload, error) {
+	var version VersionPayload
+	d := newPayloadDecoder(payload)
+	version.Version = int(d.uint32())
+	version.GenesisHash = d.string()
+	version.Height = int(d.int64())
+	version.ListenAddress = d.string()
+	version.Time = d.int64()
+	return version, d.end()
+}
+
+func encodeInv(inv InvPayload) []byte {
+	buf := appendString(nil, inv.Kind)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(inv.Hashes)))
+	for _, hash := range inv.Hashes {
+		buf = appendString(buf, hash)
+	}
+	return buf
+}
+
+func decodeInv(payload json.RawMessage) (InvPayload, error) {
+	var inv InvPayload
+	d := newPayloadDecoder(payload)
+	inv.Kind = d.string()
+	for i, count := 0, d.count(4); i < count; i++ {
+		inv.Hashes = append(inv.Hashes, d.string())
+	}
+	return inv, d.end()
+}
+
+func encodeRange(request RangePayload) []byte {
+	buf := appendInt64(nil, int64(request.From))
+	return appendInt64(buf, int64(request.Count))
+}
+
+func decodeRange(payload json.RawMessage) (RangePayload, error) {
+	var request RangePayload
+	d := newPayloadDecoder(payload)
+	request.From = int(d.int64())
+	request.Count = int(d.int64())
+	return request, d.end()
+}
+
+//encodeHeaders gives the canonical encoding of each header
+func encodeHeaders(headers []chain.BlockHeader) [][]byte {
+	encoded := make([][]byte, len(headers))
+	for i, header := range headers {
+		encoded[i] = chain.EncodeHeader(header)
+	}
+	return encoded
+}
+
+//decodeHeaders reads a list of encoded headers from a message payload
+func decodeHeaders(payload json.RawMessage) ([]chain.BlockHeader, error) {
+	var encoded [][]byte
+	if err := json.Unmarshal(payload, &encoded); err != nil {
+		return nil, err
+	}
+	headers := make([]chain.BlockHeader, len(encoded))
+	for i, data := range encoded {
+		header, err := chain.DecodeHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		headers[i] = header
+	}
+	return headers, nil
+}
@@ -0,0 +1,53 @@
+package net
+
+import (
+	"encoding/json"
+	"github.com/mukatee/go-naive/chain"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+//payloadJson puts the encoded payload in json, as it is in a message
+func payloadJson(encoded []byte) json.RawMessage {
+	bytes, _ := json.Marshal(encoded)
+	return bytes
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	version := VersionPayload{PROTOCOL_VERSION, "genesis", 12, "127.0.0.1:9000", 1539000000000000005}
+	decodedVersion, err := decodeVersion(payloadJson(encodeVersion(version)))
+	assert.NoError(t, err)
+	assert.Equal(t, version, decodedVersion)
+
+	inv := InvPayload{INV_TX, []string{"tx1", "tx2"}}
+	decodedInv, err := decodeInv(payloadJson(encodeInv(inv)))
+	assert.NoError(t, err)
+	assert.Equal(t, inv, decodedInv)
+
+	request := RangePayload{5, 500}
+	decodedRange, err := decodeRange(payloadJson(encodeRange(request)))
+	assert.NoError(t, err)
+	assert.Equal(t, request, decodedRange)
+
+	bc := chain.NewBlockchain(chain.DefaultGenesis, chain.NewMemoryStorage())
+	bc.CreateTestChain("address1", 2)
+	headers := bc.Headers(1, 3)
+	bytes, _ := json.Marshal(encodeHeaders(headers))
+	decodedHeaders, err := decodeHeaders(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, headers, decodedHeaders)
+}
+
+func TestDecodeInvalidPayload(t *testing.T) {
+	encoded := encodeVersion(VersionPayload{PROTOCOL_VERSION, "genesis", 12, "", 0})
+	_, err := decodeVersion(payloadJson(encoded[:len(encoded)-1]))
+	assert.ErrorIs(t, err, chain.ErrBadEncoding)
+	_, err = decodeRange(payloadJson(append(encodeRange(RangePayload{1, 2}), 0)))
+	assert.ErrorIs(t, err, chain.ErrBadEncoding)
+	//a hash count far beyond the data
+	_, err = decodeInv(payloadJson(append(appendString(nil, INV_BLOCK), 0xff, 0xff, 0xff, 0xff)))
+	assert.ErrorIs(t, err, chain.ErrBadEncoding)
+	//the old json payload is not accepted
+	_, err = decodeInv(json.RawMessage(`{"Kind":"tx","Hashes":[]}`))
+	assert.Error(t, err)
+}
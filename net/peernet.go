@@ -1,15 +1,31 @@
 package net
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mukatee/go-naive/chain"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
 
 type Peer struct {
 	Address string
 }
 
-var peers = []Peer{}
+func (s *Server) addPeer(peer Peer) {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	s.peers = append(s.peers, peer)
+}
 
-func addPeer(peer Peer) {
-	peers = append(peers, peer)
+//listPeers returns a copy of the list of known peers
+func (s *Server) listPeers() []Peer {
+	s.peersLock.RLock()
+	defer s.peersLock.RUnlock()
+	return append([]Peer{}, s.peers...)
 }
 
 func jsonPeers(peers []Peer) string {
@@ -17,3 +33,578 @@ func jsonPeers(peers []Peer) string {
 	json := string(bytes)
 	return json
 }
+
+//the peer-to-peer protocol runs over plain TCP connections, with each message sent as a line of JSON.
+//the payload of each message is in a binary encoding, see encoding.go.
+//after connecting, both sides send a "version" message, and answer the other sides version with "verack".
+//other messages are ignored until the version of the peer is received.
+//new blocks and transactions are announced with "inv", and peers ask for the ones they do not have with "getdata".
+//the content is sent as "block" and "tx" messages. a peer that is behind syncs with the messages in peersync.go.
+//a peer on another fork asks for the chain with "getchain" and gets the last MAX_CHAIN_BLOCKS blocks of it as a "chain"
+//message. a whole chain is given to the fork choice (TakeMostDifficultChain), and the blocks of a partial one to the
+//block index one by one (ProcessBlock), which switches to them if they fork off a known block and have more work
+
+var PROTOCOL_VERSION = 8    //version of the peer protocol this node speaks
+var MAX_CHAIN_BLOCKS = 1000 //max number of blocks sent in a chain message, the ones at the tip
+
+//message types
+const (
+	MSG_VERSION  = "version"
+	MSG_VERACK   = "verack"
+	MSG_INV      = "inv"
+	MSG_GETDATA  = "getdata"
+	MSG_BLOCK    = "block"
+	MSG_TX       = "tx"
+	MSG_GETCHAIN = "getchain"
+	MSG_CHAIN    = "chain"
+)
+
+//kinds of items in inv and getdata messages
+const (
+	INV_BLOCK = "block"
+	INV_TX    = "tx"
+)
+
+//Message is the envelope for all messages sent between peers
+type Message struct {
+	Type    string          //one of the MSG_ types
+	Payload json.RawMessage //content, depending on the type
+}
+
+//VersionPayload is sent by both sides when a connection is opened
+type VersionPayload struct {
+	Version       int    //PROTOCOL_VERSION of the sender
+	GenesisHash   string //hash of the genesis block, peers on a different chain are disconnected
+	Height        int    //height of the senders chain, to see if we should ask for its chain
+	ListenAddress string //address the sender accepts connections at, if any
+	Time          int64  //current time of the sender as unix nanoseconds, for the network-adjusted time
+}
+
+//InvPayload lists blocks or transactions by hash, for announcing (inv) and requesting (getdata) them
+type InvPayload struct {
+	Kind   string   //INV_BLOCK or INV_TX
+	Hashes []string //block hashes or transaction ids
+}
+
+//ErrGenesisMismatch is the reason for dropping a peer that is on a different chain
+var ErrGenesisMismatch = errors.New("peer has different genesis block")
+
+//ErrProtocolMismatch is the reason for dropping a peer that speaks another version of the protocol
+var ErrProtocolMismatch = errors.New("peer has different protocol version")
+
+//ErrDuplicateVersion is the reason for dropping a peer that sends its version again after the handshake
+var ErrDuplicateVersion = errors.New("peer sent version twice")
+
+//peerConn is a connection to a single peer
+type peerConn struct {
+	conn          net.Conn
+	address       string        //the address dialled, or the remote address for accepted connections
+	writeLock     sync.Mutex    //one message written at a time
+	encoder       *json.Encoder //writes messages to conn
+	ready         bool          //true after the version of the peer is received. guarded by the node lock
+	listenAddress string        //the address the peer accepts connections at, from its version. guarded by the node lock
+	timeOffset    time.Duration //time of the peer from its version minus our time when received. guarded by the node lock
+	height        int           //height of the peer chain from its version, or the latest block it sent. guarded by the node lock
+	timeRecorded  bool          //true if the time offset of the peer was added to the network clock. guarded by the node lock
+}
+
+//Node connects to other nodes, and keeps the chain in sync with them by gossiping blocks and transactions
+type Node struct {
+	chain        *chain.Blockchain
+	lock         sync.Mutex           //guards the fields below
+	listener     net.Listener         //accepts connections from peers, nil if not listening
+	peers        map[string]*peerConn //open connections by remote address
+	announcedTxs map[string]bool      //mempool transactions already announced to peers
+	sync         *syncState           //sync in progress, nil if not syncing
+	closed       chan struct{}        //closed when the node is shut down
+	wg           sync.WaitGroup       //running goroutines, to wait for on Close()
+}
+
+//NewNode creates a node for the given chain. use Listen() to accept peers and Connect() to connect to them
+func NewNode(bc *chain.Blockchain) *Node {
+	n := &Node{chain: bc, peers: make(map[string]*peerConn), announcedTxs: make(map[string]bool), closed: make(chan struct{})}
+	n.wg.Add(1)
+	go n.announceLoop()
+	return n
+}
+
+//Listen starts accepting connections from peers at the given address (e.g., "127.0.0.1:0" for any free port)
+func (n *Node) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	n.listener = listener
+	n.lock.Unlock()
+	log.Println("P2P node listening at", listener.Addr())
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("P2P listener stopped:", err)
+				return
+			}
+			n.startPeer(conn, conn.RemoteAddr().String())
+		}
+	}()
+	return nil
+}
+
+//Address gives the address the node is listening at, or empty if not listening
+func (n *Node) Address() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.listener == nil {
+		return ""
+	}
+	return n.listener.Addr().String()
+}
+
+//Connect opens a connection to the peer at the given address and starts the handshake
+func (n *Node) Connect(address string) error {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	n.startPeer(conn, address)
+	return nil
+}
+
+//Peers lists the peers that have completed the handshake
+func (n *Node) Peers() []Peer {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	peers := []Peer{}
+	for _, p := range n.peers {
+		if p.ready {
+			address := p.address
+			if p.listenAddress != "" {
+				address = p.listenAddress
+			}
+			peers = append(peers, Peer{address})
+		}
+	}
+	return peers
+}
+
+//PeerStatus describes a peer that has completed the handshake, for the node status
+type PeerStatus struct {
+	Address    string        //address the peer accepts connections at, or the one connected to
+	TimeOffset time.Duration //time of the peer minus our time at the handshake, in nanoseconds
+}
+
+//NodeStatus describes the chain of the node and its view of the network time
+type NodeStatus struct {
+	Height         int           //height of the chain
+	MedianTimePast time.Time     //median timestamp of the last blocks, a new block has to be later
+	NetworkTime    time.Time     //network-adjusted time, new blocks can be at most chain.MAX_TIMESTAMP_DRIFT ahead of it
+	TimeOffset     time.Duration //network-adjusted time minus local time, in nanoseconds
+	Peers          []PeerStatus  //peers that have completed the handshake, with their time offsets
+}
+
+//Status gives the status of the node and its peers
+func (n *Node) Status() NodeStatus {
+	status := chainStatus(n.chain)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, p := range n.peers {
+		if p.ready {
+			address := p.address
+			if p.listenAddress != "" {
+				address = p.listenAddress
+			}
+			status.Peers = append(status.Peers, PeerStatus{address, p.timeOffset})
+		}
+	}
+	return status
+}
+
+//chainStatus gives the status of the chain, without any peers
+func chainStatus(bc *chain.Blockchain) NodeStatus {
+	offset := bc.Clock().Offset()
+	return NodeStatus{bc.Height(), bc.MedianTimePast(), time.Now().Add(offset), offset, []PeerStatus{}}
+}
+
+//Close disconnects all peers, stops listening and waits for the node goroutines to exit
+func (n *Node) Close() {
+	n.lock.Lock()
+	select {
+	case <-n.closed:
+		n.lock.Unlock()
+		return
+	default:
+	}
+	close(n.closed)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	for _, p := range n.peers {
+		p.conn.Close()
+	}
+	n.lock.Unlock()
+	n.wg.Wait()
+}
+
+//startPeer registers a new connection, sends our version, and starts reading messages from it
+func (n *Node) startPeer(conn net.Conn, address string) {
+	p := &peerConn{conn: conn, address: address, encoder: json.NewEncoder(conn)}
+	n.lock.Lock()
+	select {
+	case <-n.closed:
+		n.lock.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	n.peers[conn.RemoteAddr().String()] = p
+	n.wg.Add(1)
+	n.lock.Unlock()
+	log.Println("Connected to peer", address)
+	go n.readLoop(p)
+	n.send(p, MSG_VERSION, encodeVersion(n.version()))
+}
+
+//version gives the version message describing this node
+func (n *Node) version() VersionPayload {
+	return VersionPayload{PROTOCOL_VERSION, n.chain.GenesisHash(), n.chain.Height(), n.Address(), time.Now().UnixNano()}
+}
+
+//dropPeer closes the connection to the peer and forgets it
+func (n *Node) dropPeer(p *peerConn, reason error) {
+	log.Println("Dropping peer", p.address, ":", reason)
+	p.conn.Close()
+	n.lock.Lock()
+	delete(n.peers, p.conn.RemoteAddr().String())
+	//only a connection whose offset was counted is removed from the clock, so it does not drop the offset of another connection from the same host
+	if p.timeRecorded {
+		n.chain.Clock().RemovePeer(p.conn.RemoteAddr().String())
+		p.timeRecorded = false
+	}
+	n.lock.Unlock()
+	n.endSync(p)
+}
+
+//send writes a message with the given type and payload to the peer
+func (n *Node) send(p *peerConn, msgType string, payload interface{}) {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Failed to encode", msgType, "message:", err)
+		return
+	}
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	err = p.encoder.Encode(Message{msgType, bytes})
+	if err != nil {
+		log.Println("Failed to send", msgType, "to", p.address, ":", err)
+	}
+}
+
+//broadcast sends the message to all peers that have completed the handshake
+func (n *Node) broadcast(msgType string, payload interface{}) {
+	n.lock.Lock()
+	peers := []*peerConn{}
+	for _, p := range n.peers {
+		if p.ready {
+			peers = append(peers, p)
+		}
+	}
+	n.lock.Unlock()
+	for _, p := range peers {
+		n.send(p, msgType, payload)
+	}
+}
+
+//readLoop reads and handles messages from the peer until the connection closes
+func (n *Node) readLoop(p *peerConn) {
+	defer n.wg.Done()
+	decoder := json.NewDecoder(p.conn)
+	for {
+		var msg Message
+		err := decoder.Decode(&msg)
+		if err != nil {
+			n.dropPeer(p, err)
+			return
+		}
+		err = n.handleMessage(p, msg)
+		if err != nil {
+			n.dropPeer(p, err)
+			return
+		}
+	}
+}
+
+//encodeBlocks gives the canonical encoding of each block, blocks and transactions are sent in their canonical
+//encoding so the receiver gets exactly the bytes their hashes and ids are calculated from
+func encodeBlocks(blocks []chain.Block) [][]byte {
+	encoded := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		encoded[i] = chain.EncodeBlock(block)
+	}
+	return encoded
+}
+
+//decodeBlocks reads a list of encoded blocks from a message payload
+func decodeBlocks(payload json.RawMessage) ([]chain.Block, error) {
+	var encoded [][]byte
+	if err := json.Unmarshal(payload, &encoded); err != nil {
+		return nil, err
+	}
+	blocks := make([]chain.Block, len(encoded))
+	for i, data := range encoded {
+		block, err := chain.DecodeBlock(data)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = block
+	}
+	return blocks, nil
+}
+
+//handleMessage acts on a single message from the peer. returns an error if the peer should be dropped
+func (n *Node) handleMessage(p *peerConn, msg Message) error {
+	n.lock.Lock()
+	ready := p.ready
+	n.lock.Unlock()
+	if !ready && msg.Type != MSG_VERSION {
+		log.Println("Ignoring", msg.Type, "from", p.address, "before version")
+		return nil
+	}
+	switch msg.Type {
+	case MSG_VERSION:
+		version, err := decodeVersion(msg.Payload)
+		if err != nil {
+			return err
+		}
+		return n.handleVersion(p, version)
+	case MSG_VERACK:
+		log.Println("Handshake with", p.address, "acknowledged")
+	case MSG_INV:
+		inv, err := decodeInv(msg.Payload)
+		if err != nil {
+			return err
+		}
+		n.handleInv(p, inv)
+	case MSG_GETDATA:
+		inv, err := decodeInv(msg.Payload)
+		if err != nil {
+			return err
+		}
+		n.handleGetData(p, inv)
+	case MSG_BLOCK:
+		var encoded []byte
+		if err := json.Unmarshal(msg.Payload, &encoded); err != nil {
+			return err
+		}
+		block, err := chain.DecodeBlock(encoded)
+		if err != nil {
+			return err
+		}
+		n.handleBlock(p, block)
+	case MSG_TX:
+		var encoded []byte
+		if err := json.Unmarshal(msg.Payload, &encoded); err != nil {
+			return err
+		}
+		tx, err := chain.DecodeTransaction(encoded)
+		if err != nil {
+			return err
+		}
+		err = n.chain.SubmitTransaction(tx)
+		if err != nil {
+			log.Println("Rejected transaction from", p.address, ":", err)
+		}
+	case MSG_GETHEADERS, MSG_GETBLOCKS:
+		request, err := decodeRange(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if msg.Type == MSG_GETHEADERS {
+			n.handleGetHeaders(p, request)
+		} else {
+			n.handleGetBlocks(p, request)
+		}
+	case MSG_HEADERS:
+		headers, err := decodeHeaders(msg.Payload)
+		if err != nil {
+			return err
+		}
+		return n.handleHeaders(p, headers)
+	case MSG_BLOCKS:
+		blocks, err := decodeBlocks(msg.Payload)
+		if err != nil {
+			return err
+		}
+		return n.handleBlocks(p, blocks)
+	case MSG_GETCHAIN:
+		from := n.chain.Height() - MAX_CHAIN_BLOCKS + 1
+		if from < 1 {
+			from = 1
+		}
+		n.send(p, MSG_CHAIN, encodeBlocks(n.chain.BlockRange(from, MAX_CHAIN_BLOCKS)))
+	case MSG_CHAIN:
+		blocks, err := decodeBlocks(msg.Payload)
+		if err != nil {
+			return err
+		}
+		n.handleChain(p, blocks)
+	default:
+		log.Println("Unknown message type from", p.address, ":", msg.Type)
+	}
+	return nil
+}
+
+//handleVersion completes the handshake with the peer, and starts syncing from it if it is ahead of us.
+//the time in the version gives the offset of the peer clock for the network-adjusted time of the chain.
+//the time the message took to arrive is counted in the offset, which is fine for offsets of seconds.
+//a peer with another protocol version, or sending its version again, is dropped
+func (n *Node) handleVersion(p *peerConn, version VersionPayload) error {
+	own := n.version()
+	if version.Version != own.Version {
+		return fmt.Errorf("%w: %d vs ours %d", ErrProtocolMismatch, version.Version, own.Version)
+	}
+	if version.GenesisHash != own.GenesisHash {
+		return ErrGenesisMismatch
+	}
+	offset := time.Unix(0, version.Time).Sub(time.Unix(0, own.Time))
+	n.lock.Lock()
+	if p.ready {
+		n.lock.Unlock()
+		return ErrDuplicateVersion
+	}
+	p.ready = true
+	p.listenAddress = version.ListenAddress
+	p.timeOffset = offset
+	p.height = version.Height
+	p.timeRecorded = n.chain.Clock().AddPeerOffset(p.conn.RemoteAddr().String(), offset)
+	n.lock.Unlock()
+	log.Println("Peer", p.address, "has version", version.Version, ", height", version.Height, "and time offset", offset)
+	n.send(p, MSG_VERACK, struct{}{})
+	if version.Height > own.Height {
+		n.startSync(p)
+	}
+	return nil
+}
+
+//handleInv asks the peer for the announced blocks and transactions we do not have yet
+func (n *Node) handleInv(p *peerConn, inv InvPayload) {
+	missing := []string{}
+	for _, hash := range inv.Hashes {
+		known := false
+		switch inv.Kind {
+		case INV_BLOCK:
+			known = n.chain.HasBlock(hash)
+		case INV_TX:
+			_, known = n.chain.MempoolTransaction(hash)
+		}
+		if !known {
+			missing = append(missing, hash)
+		}
+	}
+	if len(missing) > 0 {
+		n.send(p, MSG_GETDATA, encodeInv(InvPayload{inv.Kind, missing}))
+	}
+}
+
+//handleGetData sends the requested blocks and transactions we have to the peer
+func (n *Node) handleGetData(p *peerConn, inv InvPayload) {
+	for _, hash := range inv.Hashes {
+		switch inv.Kind {
+		case INV_BLOCK:
+			if block, found := n.chain.BlockByHash(hash); found {
+				n.send(p, MSG_BLOCK, chain.EncodeBlock(block))
+			}
+		case INV_TX:
+			if tx, found := n.chain.MempoolTransaction(hash); found {
+				n.send(p, MSG_TX, chain.EncodeTransaction(tx))
+			}
+		}
+	}
+}
+
+//handleBlock gives the block from the peer to the block index, which switches to its branch if that has most work.
+//if the parent of the block is not known, we are either behind and sync from the peer,
+//or on a different fork and ask for the peers whole chain for the fork choice
+func (n *Node) handleBlock(p *peerConn, block chain.Block) {
+	n.lock.Lock()
+	if block.Index > p.height {
+		p.height = block.Index
+	}
+	n.lock.Unlock()
+	err := n.chain.ProcessBlock(block)
+	if err == nil {
+		log.Println("Processed block", block.Index, "from", p.address)
+		return
+	}
+	if !errors.Is(err, chain.ErrOrphanBlock) {
+		log.Println("Rejected block from", p.address, ":", err)
+		return
+	}
+	if block.Index > n.chain.Height()+1 {
+		log.Println("Block", block.Index, "from", p.address, "is ahead of our tip, syncing")
+		n.startSync(p)
+		return
+	}
+	log.Println("Block", block.Index, "from", p.address, "is on an unknown fork, asking for chain")
+	n.send(p, MSG_GETCHAIN, struct{}{})
+}
+
+//handleChain gives the chain from the peer to the fork choice if it starts from genesis.
+//otherwise it is the tip of a longer chain, and its blocks are processed one by one to switch to it if it forks off a known block
+func (n *Node) handleChain(p *peerConn, blocks []chain.Block) {
+	log.Println("Received chain of", len(blocks), "blocks from", p.address)
+	if len(blocks) == 0 {
+		return
+	}
+	if blocks[0].Index == 1 {
+		n.chain.TakeMostDifficultChain(blocks)
+		return
+	}
+	for _, block := range blocks {
+		err := n.chain.ProcessBlock(block)
+		if err != nil {
+			log.Println("Rejected block", block.Index, "of chain from", p.address, ":", err)
+			return
+		}
+	}
+}
+
+//announceLoop announces the chain tip to peers whenever it changes, and new mempool transactions as they arrive
+func (n *Node) announceLoop() {
+	defer n.wg.Done()
+	for {
+		tipChanged := n.chain.TipChanged()
+		mempoolChanged := n.chain.MempoolChanged()
+		select {
+		case <-n.closed:
+			return
+		case <-tipChanged:
+			n.broadcast(MSG_INV, encodeInv(InvPayload{INV_BLOCK, []string{n.chain.Tip().Hash}}))
+			//the new block took transactions out of the mempool
+			n.announceTransactions()
+		case <-mempoolChanged:
+			n.announceTransactions()
+		}
+	}
+}
+
+//announceTransactions sends an inv for the mempool transactions not announced before.
+//transactions no longer in the mempool are forgotten, so the announced ones do not pile up
+func (n *Node) announceTransactions() {
+	ids := []string{}
+	announced := make(map[string]bool)
+	n.lock.Lock()
+	for _, tx := range n.chain.Mempool() {
+		if !n.announcedTxs[tx.Id] {
+			ids = append(ids, tx.Id)
+		}
+		announced[tx.Id] = true
+	}
+	n.announcedTxs = announced
+	n.lock.Unlock()
+	if len(ids) > 0 {
+		n.broadcast(MSG_INV, encodeInv(InvPayload{INV_TX, ids}))
+	}
+}
@@ -0,0 +1,248 @@
+package net
+
+import (
+	"encoding/json"
+	"github.com/mukatee/go-naive/chain"
+	"github.com/mukatee/go-naive/cryptoff"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//startTestNode creates a chain with only the genesis block, and a node for it listening on a free local port
+func startTestNode(t *testing.T, genesis chain.GenesisParams) (*chain.Blockchain, *Node) {
+	bc := chain.NewBlockchain(genesis, chain.NewMemoryStorage())
+	bc.CreateTestChain(chain.GenesisAddress, 0)
+	node := NewNode(bc)
+	assert.NoError(t, node.Listen("127.0.0.1:0"))
+	return bc, node
+}
+
+//eventually polls the given condition until it is true or a few seconds pass
+func eventually(condition func() bool) bool {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+//run three nodes in a line (1 - 2 - 3) and check blocks and transactions from either end reach all of them
+func TestGossipBlocksAndTransactions(t *testing.T) {
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	bc2, node2 := startTestNode(t, chain.DefaultGenesis)
+	bc3, node3 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	defer node2.Close()
+	defer node3.Close()
+
+	//node1 is ahead before connecting, so the others should catch up through the handshake and announcements
+	privKey, _, address := cryptoff.CreateAddress()
+	for i := 0; i < 3; i++ {
+		_, err := bc1.CreateBlock(address, nil, "before connect")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, node2.Connect(node1.Address()))
+	assert.NoError(t, node3.Connect(node2.Address()))
+	assert.True(t, eventually(func() bool { return bc2.Height() == 4 && bc3.Height() == 4 }))
+	assert.True(t, eventually(func() bool { return len(node2.Peers()) == 2 }))
+	assert.Equal(t, []Peer{{node1.Address()}}, filterPeers(node2.Peers(), node1.Address()))
+	assert.Equal(t, 3*chain.INITIAL_SUBSIDY, bc3.BalanceFor(address))
+
+	//a new block on one end reaches the other end
+	block, err := bc1.CreateBlock(address, nil, "after connect")
+	assert.NoError(t, err)
+	assert.True(t, eventually(func() bool { _, found := bc3.BlockByHash(block.Hash); return found }))
+
+	//a transaction sent on node3 reaches the mempool of node1, gets mined there, and the block reaches node3
+	tx, err := bc3.SendCoins(privKey, "receiver", 10, 0)
+	assert.NoError(t, err)
+	assert.True(t, eventually(func() bool { _, found := bc1.MempoolTransaction(tx.Id); return found }))
+	_, err = bc1.MinePending(chain.GenesisAddress, "mined from gossip")
+	assert.NoError(t, err)
+	assert.True(t, eventually(func() bool { return bc3.BalanceFor("receiver") == 10 && len(bc3.Mempool()) == 0 }))
+	assert.Equal(t, bc1.Blocks(), bc2.Blocks())
+	assert.Equal(t, bc1.Blocks(), bc3.Blocks())
+	//the mined transaction is no longer kept as announced
+	for _, node := range []*Node{node1, node2, node3} {
+		assert.True(t, eventually(func() bool { return announcedCount(node) == 0 }))
+	}
+}
+
+//announcedCount gives the number of transactions the node keeps as announced
+func announcedCount(n *Node) int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return len(n.announcedTxs)
+}
+
+//filterPeers gives the peers with the given address
+func filterPeers(peers []Peer, address string) []Peer {
+	found := []Peer{}
+	for _, peer := range peers {
+		if peer.Address == address {
+			found = append(found, peer)
+		}
+	}
+	return found
+}
+
+//two nodes mining separately end up on the chain with most work once connected
+func TestForkResolvedOnConnect(t *testing.T) {
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	bc2, node2 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	defer node2.Close()
+	for i := 0; i < 2; i++ {
+		_, err := bc1.CreateBlock("miner1", nil, "fork 1")
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 4; i++ {
+		_, err := bc2.CreateBlock("miner2", nil, "fork 2")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, node1.Connect(node2.Address()))
+	assert.True(t, eventually(func() bool { return bc1.Height() == 5 }))
+	assert.Equal(t, bc2.Blocks(), bc1.Blocks())
+	assert.Equal(t, 0, bc1.BalanceFor("miner1"))
+	assert.Equal(t, 4*chain.INITIAL_SUBSIDY, bc1.BalanceFor("miner2"))
+
+	//a block on the shorter side's old tip would not fit anymore, new blocks on the winning chain still gossip back
+	block, err := bc1.CreateBlock("miner1", nil, "on winning chain")
+	assert.NoError(t, err)
+	assert.True(t, eventually(func() bool { _, found := bc2.BlockByHash(block.Hash); return found }))
+}
+
+//nodes forked after a common start switch to the chain with most work, with only the tip of the chain sent
+func TestForkResolvedFromChainTip(t *testing.T) {
+	defer func(blocks int) { MAX_CHAIN_BLOCKS = blocks }(MAX_CHAIN_BLOCKS)
+	MAX_CHAIN_BLOCKS = 4
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	bc2, node2 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	defer node2.Close()
+	for i := 0; i < 4; i++ {
+		block, err := bc1.CreateBlock("common", nil, "common")
+		assert.NoError(t, err)
+		assert.NoError(t, bc2.AddBlock(block))
+	}
+	_, err := bc1.CreateBlock("miner1", nil, "fork 1")
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := bc2.CreateBlock("miner2", nil, "fork 2")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, node1.Connect(node2.Address()))
+	assert.True(t, eventually(func() bool { return bc1.Height() == 8 }))
+	assert.Equal(t, bc2.Blocks(), bc1.Blocks())
+	assert.Equal(t, 0, bc1.BalanceFor("miner1"))
+}
+
+//a node on a different chain is dropped during the handshake
+func TestGenesisMismatchDropsPeer(t *testing.T) {
+	otherGenesis := chain.DefaultGenesis
+	otherGenesis.Data = "some other chain"
+	_, node1 := startTestNode(t, chain.DefaultGenesis)
+	_, node2 := startTestNode(t, otherGenesis)
+	defer node1.Close()
+	defer node2.Close()
+	assert.NoError(t, node1.Connect(node2.Address()))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, node1.Peers())
+	assert.Empty(t, node2.Peers())
+}
+
+//dialWithVersions opens a raw connection to the node, and sends the given version messages on it
+func dialWithVersions(t *testing.T, address string, versions ...VersionPayload) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	assert.NoError(t, err)
+	encoder := json.NewEncoder(conn)
+	for _, version := range versions {
+		payload, _ := json.Marshal(encodeVersion(version))
+		assert.NoError(t, encoder.Encode(Message{MSG_VERSION, payload}))
+	}
+	return conn
+}
+
+//closedByNode reads the connection until the node closes it, false if it stays open for a second
+func closedByNode(conn net.Conn) bool {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.Copy(ioutil.Discard, conn)
+	return err == nil
+}
+
+//a peer with another protocol version, or sending its version twice, is dropped
+func TestBadVersionDropsPeer(t *testing.T) {
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	version := VersionPayload{PROTOCOL_VERSION, bc1.GenesisHash(), 1, "", time.Now().UnixNano()}
+	newer := version
+	newer.Version++
+	assert.True(t, closedByNode(dialWithVersions(t, node1.Address(), newer)))
+	assert.True(t, closedByNode(dialWithVersions(t, node1.Address(), version, version)))
+	assert.False(t, closedByNode(dialWithVersions(t, node1.Address(), version)))
+	assert.True(t, eventually(func() bool { return len(node1.Peers()) == 0 }))
+	assert.Empty(t, bc1.Clock().PeerOffsets())
+}
+
+//a connection closed before its version does not drop the time offset of another connection from the same host
+func TestTimeOffsetKeptForHost(t *testing.T) {
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	_, node2 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	defer node2.Close()
+	connections := func() int {
+		node1.lock.Lock()
+		defer node1.lock.Unlock()
+		return len(node1.peers)
+	}
+	assert.NoError(t, node2.Connect(node1.Address()))
+	assert.True(t, eventually(func() bool { return len(bc1.Clock().PeerOffsets()) == 1 }))
+	conn := dialWithVersions(t, node1.Address())
+	assert.True(t, eventually(func() bool { return connections() == 2 }))
+	conn.Close()
+	assert.True(t, eventually(func() bool { return connections() == 1 }))
+	assert.Equal(t, 1, len(bc1.Clock().PeerOffsets()))
+}
+
+//the time offsets of peers are collected in the handshake, shown in the status, and dropped with the peer
+func TestPeerTimeOffsets(t *testing.T) {
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	bc2, node2 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	assert.NoError(t, node2.Connect(node1.Address()))
+	assert.True(t, eventually(func() bool { return len(node1.Status().Peers) == 1 && len(node2.Status().Peers) == 1 }))
+	status := node2.Status()
+	assert.Equal(t, node1.Address(), status.Peers[0].Address)
+	//both nodes run on the same clock, so the offset is only the time the message took
+	assert.True(t, status.Peers[0].TimeOffset < time.Second && status.Peers[0].TimeOffset > -time.Second)
+	assert.Equal(t, 1, len(bc1.Clock().PeerOffsets()))
+	assert.Equal(t, 1, len(bc2.Clock().PeerOffsets()))
+	//a single peer is not enough to adjust the time
+	assert.Equal(t, time.Duration(0), status.TimeOffset)
+	assert.Equal(t, bc2.MedianTimePast(), status.MedianTimePast)
+
+	//the status is also served over rpc
+	server := NewServer(bc2, chain.NewMiningService(bc2, 0, chain.GenesisAddress))
+	server.SetNode(node2)
+	server.Start("127.0.0.1:9096")
+	time.Sleep(1)
+	resp, err := http.Get("http://127.0.0.1:9096/status")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	rpcStatus := NodeStatus{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&rpcStatus))
+	assert.Equal(t, bc2.Height(), rpcStatus.Height)
+	assert.Equal(t, []PeerStatus{{node1.Address(), status.Peers[0].TimeOffset}}, rpcStatus.Peers)
+
+	node2.Close()
+	assert.True(t, eventually(func() bool { return len(bc1.Clock().PeerOffsets()) == 0 }))
+	assert.Empty(t, bc2.Clock().PeerOffsets())
+}
@@ -0,0 +1,271 @@
+package net
+
+import (
+	"errors"
+	"github.com/mukatee/go-naive/chain"
+	"log"
+	"time"
+)
+
+//a node that is behind a peer syncs headers-first: it asks the peer for headers starting from its own tip,
+//validates the header chain, and then downloads the full blocks for those headers in batches.
+//each block is stored by the chain as it is added, so a restarted node continues from the height it reached.
+//headers come at most MAX_HEADERS_PER_MSG at a time, if a full set is received more are asked for after the blocks are in.
+//if the headers from the peer do not start from our tip, the peer is on another fork, and its whole chain is
+//asked for instead, for the fork choice to decide.
+//each request has SYNC_TIMEOUT to be answered. if the peer stalls, the sync from it is dropped and continued from
+//the peer with the highest chain, if any is ahead of us
+
+var MAX_HEADERS_PER_MSG = 500       //max number of headers sent in one message
+var SYNC_BATCH_SIZE = 50            //number of blocks asked for in one message when syncing
+var SYNC_TIMEOUT = 30 * time.Second //time a peer has to answer a sync request before syncing from another
+
+//more sync message types
+const (
+	MSG_GETHEADERS = "getheaders"
+	MSG_HEADERS    = "headers"
+	MSG_GETBLOCKS  = "getblocks"
+	MSG_BLOCKS     = "blocks"
+)
+
+//RangePayload asks for headers or blocks by index
+type RangePayload struct {
+	From  int //index of the first block
+	Count int //max number of headers or blocks
+}
+
+//ErrUnexpectedBlock is the reason for dropping a peer that sends blocks not matching the headers it sent
+var ErrUnexpectedBlock = errors.New("block does not match synced headers")
+
+//syncState tracks the sync from a single peer
+type syncState struct {
+	peer     *peerConn           //peer we are syncing from
+	headers  []chain.BlockHeader //validated headers we do not have the blocks for yet
+	moreLeft bool                //true if the last headers message was full, so the peer may have more
+	requests int                 //number of requests sent, to tell if a timeout is for the latest one
+	timer    *time.Timer         //fires if the peer does not answer the latest request in SYNC_TIMEOUT
+}
+
+//startSync starts syncing from the peer, unless already syncing from some peer
+func (n *Node) startSync(p *peerConn) {
+	n.lock.Lock()
+	if n.sync != nil {
+		n.lock.Unlock()
+		return
+	}
+	n.sync = &syncState{peer: p}
+	n.lock.Unlock()
+	log.Println("Starting sync from", p.address)
+	n.requestHeaders(p)
+}
+
+//requestHeaders asks the peer for headers starting from our tip
+func (n *Node) requestHeaders(p *peerConn) {
+	n.sendSyncRequest(p, MSG_GETHEADERS, RangePayload{n.chain.Height(), MAX_HEADERS_PER_MSG})
+}
+
+//sendSyncRequest sends a request to the peer we are syncing from, and starts the timeout for its answer
+func (n *Node) sendSyncRequest(p *peerConn, msgType string, request RangePayload) {
+	n.lock.Lock()
+	state := n.syncFrom(p)
+	if state == nil {
+		n.lock.Unlock()
+		return
+	}
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	state.requests++
+	requests := state.requests
+	state.timer = time.AfterFunc(SYNC_TIMEOUT, func() { n.syncStalled(state, requests) })
+	n.lock.Unlock()
+	n.send(p, msgType, encodeRange(request))
+}
+
+//syncStalled drops the sync if the given request is still the latest one, and it was not answered.
+//the sync continues from the peer with the highest chain, if any other peer is ahead of us
+func (n *Node) syncStalled(state *syncState, requests int) {
+	n.lock.Lock()
+	select {
+	case <-n.closed:
+		n.lock.Unlock()
+		return
+	default:
+	}
+	if n.sync != state || state.requests != requests {
+		n.lock.Unlock()
+		return
+	}
+	log.Println("Sync from", state.peer.address, "timed out, no answer in", SYNC_TIMEOUT)
+	n.sync = nil
+	n.lock.Unlock()
+	n.syncFromOther(state.peer)
+}
+
+//syncFromOther starts syncing from the peer with the highest chain other than the given one, if any is ahead of us
+func (n *Node) syncFromOther(failed *peerConn) {
+	height := n.chain.Height()
+	var next *peerConn
+	n.lock.Lock()
+	for _, p := range n.peers {
+		if p != failed && p.ready && p.height > height {
+			next = p
+			height = p.height
+		}
+	}
+	n.lock.Unlock()
+	if next != nil {
+		n.startSync(next)
+	}
+}
+
+//endSync stops syncing from the peer, if currently syncing from it
+func (n *Node) endSync(p *peerConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.sync != nil && n.sync.peer == p {
+		log.Println("Sync from", p.address, "ended at height", n.chain.Height())
+		if n.sync.timer != nil {
+			n.sync.timer.Stop()
+		}
+		n.sync = nil
+	}
+}
+
+//syncFrom gives the sync state if syncing from the given peer, nil otherwise. expects the caller to hold the node lock
+func (n *Node) syncFrom(p *peerConn) *syncState {
+	if n.sync == nil || n.sync.peer != p {
+		return nil
+	}
+	return n.sync
+}
+
+//handleGetHeaders sends the requested range of headers to the peer
+func (n *Node) handleGetHeaders(p *peerConn, request RangePayload) {
+	count := request.Count
+	if count > MAX_HEADERS_PER_MSG {
+		count = MAX_HEADERS_PER_MSG
+	}
+	n.send(p, MSG_HEADERS, encodeHeaders(n.chain.Headers(request.From, count)))
+}
+
+//handleGetBlocks sends the requested range of blocks to the peer
+func (n *Node) handleGetBlocks(p *peerConn, request RangePayload) {
+	count := request.Count
+	if count > SYNC_BATCH_SIZE {
+		count = SYNC_BATCH_SIZE
+	}
+	n.send(p, MSG_BLOCKS, encodeBlocks(n.chain.BlockRange(request.From, count)))
+}
+
+//handleHeaders validates the headers from the peer we are syncing from, and starts fetching the blocks for them.
+//returns an error if the headers are invalid, to drop the peer
+func (n *Node) handleHeaders(p *peerConn, headers []chain.BlockHeader) error {
+	n.lock.Lock()
+	state := n.syncFrom(p)
+	n.lock.Unlock()
+	if state == nil {
+		log.Println("Ignoring headers from", p.address, "when not syncing from it")
+		return nil
+	}
+	err := n.chain.ValidateHeaders(headers)
+	if errors.Is(err, chain.ErrUnknownAncestor) {
+		log.Println("Headers from", p.address, "are on another fork, asking for chain")
+		n.endSync(p)
+		n.send(p, MSG_GETCHAIN, struct{}{})
+		return nil
+	}
+	if err != nil {
+		n.endSync(p)
+		return err
+	}
+	log.Println("Received", len(headers), "valid headers from", p.address)
+	n.lock.Lock()
+	if len(headers) > 0 {
+		//the first header is our own tip
+		state.headers = headers[1:]
+	}
+	state.moreLeft = len(headers) >= MAX_HEADERS_PER_MSG
+	n.lock.Unlock()
+	n.requestBlocks(p)
+	return nil
+}
+
+//requestBlocks asks the peer for the next batch of blocks for the synced headers.
+//if all are fetched, asks for more headers if there may be more, or ends the sync
+func (n *Node) requestBlocks(p *peerConn) {
+	n.lock.Lock()
+	state := n.syncFrom(p)
+	if state == nil {
+		n.lock.Unlock()
+		return
+	}
+	remaining := len(state.headers)
+	moreLeft := state.moreLeft
+	from := 0
+	if remaining > 0 {
+		from = state.headers[0].Index
+	}
+	n.lock.Unlock()
+	switch {
+	case remaining > 0:
+		count := SYNC_BATCH_SIZE
+		if count > remaining {
+			count = remaining
+		}
+		n.sendSyncRequest(p, MSG_GETBLOCKS, RangePayload{from, count})
+	case moreLeft:
+		n.requestHeaders(p)
+	default:
+		n.endSync(p)
+	}
+}
+
+//handleBlocks adds a batch of blocks from the peer we are syncing from, checking they match the headers received before.
+//after the batch is added, the next batch is asked for.
+//returns an error if the blocks do not match the headers or are not valid, to drop the peer.
+//no blocks while headers are still waiting for theirs means the peer does not have them (anymore, e.g. after a reorg),
+//so the sync from it ends and continues from another peer
+func (n *Node) handleBlocks(p *peerConn, blocks []chain.Block) error {
+	if len(blocks) == 0 {
+		n.lock.Lock()
+		state := n.syncFrom(p)
+		n.lock.Unlock()
+		if state == nil {
+			log.Println("Ignoring blocks from", p.address, "when not syncing from it")
+			return nil
+		}
+		log.Println("No blocks from", p.address, "for the synced headers, syncing from another peer")
+		n.endSync(p)
+		n.syncFromOther(p)
+		return nil
+	}
+	for _, block := range blocks {
+		n.lock.Lock()
+		state := n.syncFrom(p)
+		if state == nil {
+			n.lock.Unlock()
+			log.Println("Ignoring blocks from", p.address, "when not syncing from it")
+			return nil
+		}
+		if len(state.headers) == 0 || state.headers[0].Hash != block.Hash {
+			n.lock.Unlock()
+			n.endSync(p)
+			return ErrUnexpectedBlock
+		}
+		state.headers = state.headers[1:]
+		n.lock.Unlock()
+		if _, known := n.chain.BlockByHash(block.Hash); known {
+			//already received from gossip meanwhile
+			continue
+		}
+		err := n.chain.AddBlock(block)
+		if err != nil {
+			n.endSync(p)
+			return err
+		}
+	}
+	log.Println("Synced", len(blocks), "blocks from", p.address, ", height now", n.chain.Height())
+	n.requestBlocks(p)
+	return nil
+}
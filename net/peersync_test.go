@@ -0,0 +1,164 @@
+package net
+
+import (
+	"encoding/json"
+	"github.com/mukatee/go-naive/chain"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//sync a node that is far behind, with small batches so headers and blocks take several rounds,
+//then restart it from its storage and check it continues from the height it reached
+func TestSyncAndResume(t *testing.T) {
+	defer func(headers, batch int) { MAX_HEADERS_PER_MSG, SYNC_BATCH_SIZE = headers, batch }(MAX_HEADERS_PER_MSG, SYNC_BATCH_SIZE)
+	MAX_HEADERS_PER_MSG = 5
+	SYNC_BATCH_SIZE = 2
+
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	for i := 0; i < 12; i++ {
+		_, err := bc1.CreateBlock("miner1", nil, "to sync")
+		assert.NoError(t, err)
+	}
+
+	storage := chain.NewMemoryStorage()
+	bc2 := chain.NewBlockchain(chain.DefaultGenesis, storage)
+	assert.False(t, bc2.InitBlockChain())
+	bc2.CreateTestChain(chain.GenesisAddress, 0)
+	node2 := NewNode(bc2)
+	assert.NoError(t, node2.Connect(node1.Address()))
+	assert.True(t, eventually(func() bool { return bc2.Height() == 13 }))
+	assert.Equal(t, bc1.Blocks(), bc2.Blocks())
+	assert.Equal(t, 12*chain.INITIAL_SUBSIDY, bc2.BalanceFor("miner1"))
+	//each block is stored as it is added
+	blocks, err := storage.ReadBlocks()
+	assert.NoError(t, err)
+	assert.Equal(t, bc2.Blocks(), blocks)
+	node2.Close()
+
+	//more blocks while node2 is down
+	for i := 0; i < 7; i++ {
+		_, err := bc1.CreateBlock("miner1", nil, "while down")
+		assert.NoError(t, err)
+	}
+	restarted := chain.NewBlockchain(chain.DefaultGenesis, storage)
+	assert.True(t, restarted.InitBlockChain())
+	assert.Equal(t, 13, restarted.Height())
+	node3 := NewNode(restarted)
+	defer node3.Close()
+	assert.NoError(t, node3.Connect(node1.Address()))
+	assert.True(t, eventually(func() bool { return restarted.Height() == 20 }))
+	assert.Equal(t, bc1.Blocks(), restarted.Blocks())
+}
+
+//startFakePeer starts a peer that completes the handshake claiming a longer chain, and then gives each message
+//it receives to the given handler. a nil handler never answers anything
+func startFakePeer(t *testing.T, genesisHash string, handler func(*json.Encoder, Message)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			version, _ := json.Marshal(encodeVersion(VersionPayload{PROTOCOL_VERSION, genesisHash, 1000, "", time.Now().UnixNano()}))
+			encoder := json.NewEncoder(conn)
+			encoder.Encode(Message{MSG_VERSION, version})
+			if handler == nil {
+				go io.Copy(ioutil.Discard, conn)
+				continue
+			}
+			go func() {
+				decoder := json.NewDecoder(conn)
+				for {
+					var msg Message
+					if decoder.Decode(&msg) != nil {
+						return
+					}
+					handler(encoder, msg)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+//startStallingPeer starts a peer that completes the handshake claiming a longer chain, but never answers anything after that
+func startStallingPeer(t *testing.T, genesisHash string) (string, func()) {
+	return startFakePeer(t, genesisHash, nil)
+}
+
+//the sync from a peer that stops answering times out, and continues from another peer that is ahead
+func TestSyncTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { SYNC_TIMEOUT = timeout }(SYNC_TIMEOUT)
+	SYNC_TIMEOUT = 200 * time.Millisecond
+
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	for i := 0; i < 5; i++ {
+		_, err := bc1.CreateBlock("miner1", nil, "to sync")
+		assert.NoError(t, err)
+	}
+	bc2, node2 := startTestNode(t, chain.DefaultGenesis)
+	defer node2.Close()
+	stalling, stop := startStallingPeer(t, bc2.Tip().Hash)
+	defer stop()
+
+	assert.NoError(t, node2.Connect(stalling))
+	syncingFrom := func() string {
+		node2.lock.Lock()
+		defer node2.lock.Unlock()
+		if node2.sync == nil {
+			return ""
+		}
+		return node2.sync.peer.address
+	}
+	assert.True(t, eventually(func() bool { return syncingFrom() == stalling }))
+	//node1 is ahead too, but the sync from the stalling peer is still waiting
+	assert.NoError(t, node2.Connect(node1.Address()))
+	assert.True(t, eventually(func() bool { return len(node2.Peers()) == 2 }))
+	assert.Equal(t, stalling, syncingFrom())
+	assert.Equal(t, 1, bc2.Height())
+
+	assert.True(t, eventually(func() bool { return bc2.Height() == 6 }))
+	assert.Equal(t, bc1.Blocks(), bc2.Blocks())
+	assert.True(t, eventually(func() bool { return syncingFrom() == "" }))
+}
+
+//a peer that sends the headers of a longer chain but no blocks for them is left, and the sync continues from another peer
+func TestSyncNoBlocks(t *testing.T) {
+	bc1, node1 := startTestNode(t, chain.DefaultGenesis)
+	defer node1.Close()
+	for i := 0; i < 5; i++ {
+		_, err := bc1.CreateBlock("miner1", nil, "to sync")
+		assert.NoError(t, err)
+	}
+	var requests int32
+	empty, stop := startFakePeer(t, bc1.GenesisHash(), func(encoder *json.Encoder, msg Message) {
+		request, _ := decodeRange(msg.Payload)
+		switch msg.Type {
+		case MSG_GETHEADERS:
+			headers, _ := json.Marshal(encodeHeaders(bc1.Headers(request.From, request.Count)))
+			encoder.Encode(Message{MSG_HEADERS, headers})
+		case MSG_GETBLOCKS:
+			atomic.AddInt32(&requests, 1)
+			encoder.Encode(Message{MSG_BLOCKS, json.RawMessage("[]")})
+		}
+	})
+	defer stop()
+	bc2, node2 := startTestNode(t, chain.DefaultGenesis)
+	defer node2.Close()
+	//node2 is syncing from the fake peer when node1 connects, so only switches to node1 after the empty blocks
+	assert.NoError(t, node2.Connect(empty))
+	assert.True(t, eventually(func() bool { return len(node2.Peers()) == 1 }))
+	assert.NoError(t, node1.Connect(node2.Address()))
+	assert.True(t, eventually(func() bool { return bc2.Height() == 6 }))
+	assert.Equal(t, bc1.Blocks(), bc2.Blocks())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
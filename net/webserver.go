@@ -1,15 +1,54 @@
 package net
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/mukatee/go-naive/chain"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+//Server serves the RPC interface for a single node, i.e. a single chain and its peers
+type Server struct {
+	chain     *chain.Blockchain    //the chain this node is on
+	peersLock sync.RWMutex         //guards the peers list, since handlers are run in parallel
+	peers     []Peer               //peers this node knows about
+	mining    *chain.MiningService //background miner for this node, shared with the console
+	node      *Node                //p2p node to connect added peers to, nil if not set
+}
+
+//NewServer creates a server for the given chain and its background mining service.
+//Start() has to be called to start serving requests
+func NewServer(bc *chain.Blockchain, mining *chain.MiningService) *Server {
+	return &Server{chain: bc, mining: mining}
+}
+
+//SetNode sets the p2p node that peers added with /addPeer are connected to
+func (s *Server) SetNode(node *Node) {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	s.node = node
+}
+
+//connectPeer opens a p2p connection to the added peer, if a node is set
+func (s *Server) connectPeer(address string) {
+	s.peersLock.RLock()
+	node := s.node
+	s.peersLock.RUnlock()
+	if node == nil {
+		return
+	}
+	err := node.Connect(address)
+	if err != nil {
+		log.Println("Failed to connect to peer", address, ":", err)
+	}
+}
+
 //https://tutorialedge.net/golang/creating-simple-web-server-with-golang/
 //https://astaxie.gitbooks.io/build-web-application-with-golang/en/03.2.html
 func sayhelloName(w http.ResponseWriter, r *http.Request) {
@@ -25,50 +64,145 @@ func sayhelloName(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello astaxie!") // send data to client side
 }
 
-func rpcBlocks(w http.ResponseWriter, r *http.Request) {
-	response := chain.JsonChain(chain.GlobalChain)
+func (s *Server) rpcBlocks(w http.ResponseWriter, r *http.Request) {
+	response := chain.JsonChain(s.chain.Blocks())
 	fmt.Fprintf(w, response) // send data to client side
 }
 
-func rpcMineBlock(w http.ResponseWriter, r *http.Request) {
-	block := chain.CreateBlock(chain.GenesisAddress, nil, "RPC test block", 0)
+//rpcMineBlock mines a single block from the mempool, paying to the "address" parameter if given, or the mining payout address otherwise
+func (s *Server) rpcMineBlock(w http.ResponseWriter, r *http.Request) {
+	address := r.FormValue("address")
+	if address == "" {
+		address = s.mining.PayoutAddress()
+	}
+	block, err := s.chain.MinePending(address, "RPC test block")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	response := chain.JsonBlock(block)
 	fmt.Fprintf(w, response) // send data to client side
 }
 
-func rpcListPeers(w http.ResponseWriter, r *http.Request) {
-	response := jsonPeers(peers)
+//rpcMiningStart starts background mining. the "address" parameter, if given, sets the payout address first
+func (s *Server) rpcMiningStart(w http.ResponseWriter, r *http.Request) {
+	address := r.FormValue("address")
+	if address != "" {
+		s.mining.SetPayoutAddress(address)
+	}
+	err := s.mining.Start()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.rpcMiningStatus(w, r)
+}
+
+func (s *Server) rpcMiningStop(w http.ResponseWriter, r *http.Request) {
+	s.mining.Stop()
+	s.rpcMiningStatus(w, r)
+}
+
+func (s *Server) rpcMiningStatus(w http.ResponseWriter, r *http.Request) {
+	bytes, _ := json.Marshal(s.mining.Status())
+	fmt.Fprint(w, string(bytes)) // send data to client side
+}
+
+func (s *Server) rpcMempool(w http.ResponseWriter, r *http.Request) {
+	bytes, _ := json.Marshal(s.chain.Mempool())
+	fmt.Fprint(w, string(bytes)) // send data to client side
+}
+
+//rpcTxProof gives the merkle proof for the transaction with the "txid" parameter, so a client with only the block
+//headers can check the transaction is in a block
+func (s *Server) rpcTxProof(w http.ResponseWriter, r *http.Request) {
+	txId := r.FormValue("txid")
+	proof, found := s.chain.TxProof(txId)
+	if !found {
+		http.Error(w, "transaction not found: "+txId, http.StatusNotFound)
+		return
+	}
+	bytes, _ := json.Marshal(proof)
+	fmt.Fprint(w, string(bytes)) // send data to client side
+}
+
+//rpcSupply gives the coin supply at the "height" parameter, or at the chain tip if not given
+func (s *Server) rpcSupply(w http.ResponseWriter, r *http.Request) {
+	height := s.chain.Height()
+	if heightStr := r.FormValue("height"); heightStr != "" {
+		var err error
+		height, err = strconv.Atoi(heightStr)
+		if err != nil {
+			http.Error(w, "invalid height: "+heightStr, http.StatusBadRequest)
+			return
+		}
+	}
+	supply, found := s.chain.Supply(height)
+	if !found {
+		http.Error(w, "no block at height "+strconv.Itoa(height), http.StatusNotFound)
+		return
+	}
+	bytes, _ := json.Marshal(supply)
+	fmt.Fprint(w, string(bytes)) // send data to client side
+}
+
+//rpcStatus gives the status of the chain and the time offsets of the connected peers, see NodeStatus
+func (s *Server) rpcStatus(w http.ResponseWriter, r *http.Request) {
+	s.peersLock.RLock()
+	node := s.node
+	s.peersLock.RUnlock()
+	status := chainStatus(s.chain)
+	if node != nil {
+		status = node.Status()
+	}
+	bytes, _ := json.Marshal(status)
+	fmt.Fprint(w, string(bytes)) // send data to client side
+}
+
+func (s *Server) rpcListPeers(w http.ResponseWriter, r *http.Request) {
+	response := jsonPeers(s.listPeers())
 	fmt.Fprintf(w, response) // send data to client side
 }
 
-func rpcAddPeer(w http.ResponseWriter, r *http.Request) {
+func (s *Server) rpcAddPeer(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm() // parse arguments, you have to call this by yourself
 	for k, v := range r.Form {
 		if k == "ip" {
 			if len(v) > 1 {
 				str := strings.Join(v, " ")
-				fmt.Println("Too many values (was len " + string(len(v)) + " expected 1): " + str)
+				fmt.Println("Too many values (was len " + strconv.Itoa(len(v)) + " expected 1): " + str)
 				return
 			}
-			addPeer(Peer{v[0]})
+			s.addPeer(Peer{v[0]})
+			s.connectPeer(v[0])
 		}
 		fmt.Println("key:", k)
 		fmt.Println("val:", strings.Join(v, ""))
 	}
 }
 
-func StartServer() {
-	http.HandleFunc("/hello", sayhelloName)     // set router
-	http.HandleFunc("/blocks", rpcBlocks)       // set router
-	http.HandleFunc("/mineblock", rpcMineBlock) // set router
-	http.HandleFunc("/peers", rpcListPeers)     // set router
-	http.HandleFunc("/addPeer", rpcAddPeer)     // set router
+//Start starts serving requests on the given address (e.g., ":9090")
+//each server has its own handlers, so several nodes can be started in the same process on different ports
+func (s *Server) Start(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", sayhelloName)              // set router
+	mux.HandleFunc("/blocks", s.rpcBlocks)              // set router
+	mux.HandleFunc("/mineblock", s.rpcMineBlock)        // set router
+	mux.HandleFunc("/mempool", s.rpcMempool)            // set router
+	mux.HandleFunc("/mining/start", s.rpcMiningStart)   // set router
+	mux.HandleFunc("/mining/stop", s.rpcMiningStop)     // set router
+	mux.HandleFunc("/mining/status", s.rpcMiningStatus) // set router
+	mux.HandleFunc("/proof", s.rpcTxProof)              // set router
+	mux.HandleFunc("/supply", s.rpcSupply)              // set router
+	mux.HandleFunc("/peers", s.rpcListPeers)            // set router
+	mux.HandleFunc("/addPeer", s.rpcAddPeer)            // set router
+	mux.HandleFunc("/status", s.rpcStatus)              // set router
 	//https://stackoverflow.com/questions/49067160/what-is-the-difference-in-listening-on-0-0-0-080-and-80
 	//https://grokbase.com/t/gg/golang-nuts/141ee4dqyg/go-nuts-how-to-know-when-listenandserve-is-ready-to-handle-connections
-	listener, err := net.Listen("tcp", ":9090")
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 		os.Exit(1)
 	}
-	go http.Serve(listener, nil)
+	go http.Serve(listener, mux)
 }
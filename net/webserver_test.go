@@ -4,17 +4,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/mukatee/go-naive/chain"
+	"github.com/mukatee/go-naive/cryptoff"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+//the tests spend coinbases right after mining them
+func TestMain(m *testing.M) {
+	chain.COINBASE_MATURITY = 0
+	os.Exit(m.Run())
+}
+
 func TestGetBlocks(t *testing.T) {
-	chain.CreateTestChain(chain.GenesisAddress, 1)
-	StartServer()
+	bc := chain.NewBlockchain(chain.DefaultGenesis, chain.NewMemoryStorage())
+	bc.CreateTestChain(chain.GenesisAddress, 1)
+	NewServer(bc, chain.NewMiningService(bc, 0, chain.GenesisAddress)).Start(":9090")
 	time.Sleep(1)
 	resp, err := http.Get("http://127.0.0.1:9090/blocks")
 	if err != nil {
@@ -32,13 +43,198 @@ func TestGetBlocks(t *testing.T) {
 	AssertTestBlock(t, 2, testBlock, genesisBlock)
 }
 
+//mine blocks from "console" and rpc while querying blocks and peers, to check with "go test -race" that access is guarded
+func TestParallelMineAndQuery(t *testing.T) {
+	bc := chain.NewBlockchain(chain.DefaultGenesis, chain.NewMemoryStorage())
+	bc.CreateTestChain(chain.GenesisAddress, 1)
+	NewServer(bc, chain.NewMiningService(bc, 0, chain.GenesisAddress)).Start("127.0.0.1:9091")
+	time.Sleep(1)
+
+	var wg sync.WaitGroup
+	var mined int32
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			_, err := bc.CreateBlock(chain.GenesisAddress, nil, "console block")
+			if err == nil {
+				atomic.AddInt32(&mined, 1)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			resp, err := http.Get("http://127.0.0.1:9091/mineblock")
+			if assert.NoError(t, err) {
+				if resp.StatusCode == http.StatusOK {
+					atomic.AddInt32(&mined, 1)
+				}
+				resp.Body.Close()
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			resp, err := http.Get("http://127.0.0.1:9091/blocks")
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			rpcChain := []chain.Block{}
+			assert.NoError(t, json.Unmarshal(body, &rpcChain))
+			for idx := 1; idx < len(rpcChain); idx++ {
+				assert.Equal(t, rpcChain[idx-1].Hash, rpcChain[idx].PreviousHash)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:9091/addPeer?ip=127.0.0.1:%d", 9100+i))
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+			resp, err = http.Get("http://127.0.0.1:9091/peers")
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, 2+int(atomic.LoadInt32(&mined)), bc.Height())
+}
+
+func TestGetMempool(t *testing.T) {
+	bc := chain.NewBlockchain(chain.DefaultGenesis, chain.NewMemoryStorage())
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 1)
+	tx, err := bc.SendCoins(privKey, chain.GenesisAddress, 10, 0)
+	assert.NoError(t, err)
+	NewServer(bc, chain.NewMiningService(bc, 0, chain.GenesisAddress)).Start("127.0.0.1:9092")
+	time.Sleep(1)
+
+	resp, err := http.Get("http://127.0.0.1:9092/mempool")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	pool := []chain.Transaction{}
+	json.Unmarshal(body, &pool)
+	assert.Equal(t, []chain.Transaction{tx}, pool)
+}
+
+//get the merkle proof of a mined transaction, and check it against the header of its block
+func TestGetTxProof(t *testing.T) {
+	bc := chain.NewBlockchain(chain.DefaultGenesis, chain.NewMemoryStorage())
+	privKey, _, address := cryptoff.CreateAddress()
+	bc.CreateTestChain(address, 1)
+	tx, err := bc.SendCoins(privKey, chain.GenesisAddress, 10, 0)
+	assert.NoError(t, err)
+	block, err := bc.MinePending(address, "proof block")
+	assert.NoError(t, err)
+	NewServer(bc, chain.NewMiningService(bc, 0, chain.GenesisAddress)).Start("127.0.0.1:9094")
+	time.Sleep(1)
+
+	resp, err := http.Get("http://127.0.0.1:9094/proof?txid=" + tx.Id)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	proof := chain.MerkleProof{}
+	assert.NoError(t, json.Unmarshal(body, &proof))
+	assert.Equal(t, tx.Id, proof.TxId)
+	assert.Equal(t, block.Hash, proof.Header.Hash)
+	assert.True(t, proof.Verify())
+
+	resp, err = http.Get("http://127.0.0.1:9094/proof?txid=unknown")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGetSupply(t *testing.T) {
+	bc := chain.NewBlockchain(chain.DefaultGenesis, chain.NewMemoryStorage())
+	bc.CreateTestChain(chain.GenesisAddress, 2)
+	NewServer(bc, chain.NewMiningService(bc, 0, chain.GenesisAddress)).Start("127.0.0.1:9095")
+	time.Sleep(1)
+
+	for url, height := range map[string]int{"http://127.0.0.1:9095/supply": 3, "http://127.0.0.1:9095/supply?height=2": 2} {
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		supply := chain.SupplyInfo{}
+		assert.NoError(t, json.Unmarshal(body, &supply))
+		assert.Equal(t, height, supply.Height)
+		assert.Equal(t, height*chain.INITIAL_SUBSIDY, supply.Issued)
+		assert.Equal(t, supply.Issued, supply.Scheduled)
+	}
+	resp, err := http.Get("http://127.0.0.1:9095/supply?height=4")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+//getMiningStatus calls the given mining endpoint and parses the returned status
+func getMiningStatus(t *testing.T, url string) chain.MiningStatus {
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	status := chain.MiningStatus{}
+	json.Unmarshal(body, &status)
+	return status
+}
+
+//start and stop background mining over rpc, and mine a single block to a given address.
+//the mining service is the one given to the server, so the console sees the same miner
+func TestMiningRPC(t *testing.T) {
+	bc := chain.NewBlockchain(chain.DefaultGenesis, chain.NewMemoryStorage())
+	bc.CreateTestChain(chain.GenesisAddress, 1)
+	mining := chain.NewMiningService(bc, 0, "console")
+	NewServer(bc, mining).Start("127.0.0.1:9093")
+	time.Sleep(1)
+
+	resp, err := http.Get("http://127.0.0.1:9093/mineblock?address=rpcminer")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, chain.INITIAL_SUBSIDY, bc.BalanceFor("rpcminer"))
+	assert.Equal(t, "console", getMiningStatus(t, "http://127.0.0.1:9093/mining/status").PayoutAddress)
+
+	status := getMiningStatus(t, "http://127.0.0.1:9093/mining/start?address=background")
+	assert.True(t, status.Running)
+	assert.Equal(t, "background", status.PayoutAddress)
+	assert.True(t, mining.Status().Running)
+	assert.Equal(t, "background", mining.PayoutAddress())
+	resp, err = http.Get("http://127.0.0.1:9093/mining/start")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	for i := 0; i < 500 && bc.BalanceFor("background") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status = getMiningStatus(t, "http://127.0.0.1:9093/mining/stop")
+	assert.False(t, status.Running)
+	assert.False(t, mining.Status().Running)
+	assert.True(t, status.Stats.BlocksFound > 0)
+	assert.Equal(t, status.Stats.BlocksFound*chain.INITIAL_SUBSIDY, bc.BalanceFor("background"))
+	assert.Equal(t, bc.Height(), getMiningStatus(t, "http://127.0.0.1:9093/mining/status").Height)
+}
+
 func AssertTestBlock(t *testing.T, idx int, block, prevBlock chain.Block) {
 	testBlock := block
-	assert.Equal(t, 0, testBlock.Difficulty)
-	assert.Equal(t, 0, testBlock.Nonce)
+	//the only test block is not after an adjustment, so it has the same target as genesis
+	assert.Equal(t, chain.MAX_TARGET_BITS, testBlock.Bits)
 	assert.Equal(t, 1, len(testBlock.Transactions))
 	cbTx := testBlock.Transactions[0]
-	assertCoinbaseTx(t, cbTx)
+	assertCoinbaseTx(t, cbTx, idx)
 	assert.Equal(t, idx, testBlock.Index)
 	data := fmt.Sprintf("Test%d", idx)
 	assert.Equal(t, data, testBlock.Data)
@@ -51,22 +247,21 @@ func AssertGenesisBlock(t *testing.T, block chain.Block) {
 	genesisBlock := block
 	assert.Equal(t, 1, genesisBlock.Index)
 	assert.Equal(t, "Teemu oli täällä", genesisBlock.Data)
-	assert.Equal(t, "2c0bb21918368e747a9f0a1dbd6f059291c2d20c0e3a75954088210b77d76ad5", genesisBlock.Hash)
+	assert.Equal(t, "ef315c64ccb266df26acad7d8014307342d0f303611c658d646532fce34f176c", genesisBlock.Hash)
 	assert.Equal(t, "0", genesisBlock.PreviousHash)
 	assert.Equal(t, chain.GenesisTime, genesisBlock.Timestamp)
-	assert.Equal(t, 1, genesisBlock.Difficulty)
+	assert.Equal(t, chain.MAX_TARGET_BITS, genesisBlock.Bits)
 	assert.Equal(t, 1, genesisBlock.Nonce)
 	assert.Equal(t, 1, len(genesisBlock.Transactions))
 	coinbase := genesisBlock.Transactions[0]
-	assertCoinbaseTx(t, coinbase)
+	assertCoinbaseTx(t, coinbase, 1)
 }
 
-func assertCoinbaseTx(t *testing.T, cbTx chain.Transaction) {
-	assert.Equal(t, 0, len(cbTx.TxIns))
+func assertCoinbaseTx(t *testing.T, cbTx chain.Transaction, idx int) {
+	//the only txin has the block index
+	assert.Equal(t, []chain.TxIn{{TxId: "", TxIdx: idx}}, cbTx.TxIns)
 	assert.Equal(t, 1, len(cbTx.TxOuts))
 	txOut := cbTx.TxOuts[0]
 	assert.Equal(t, chain.GenesisAddress, txOut.Address)
-	assert.Equal(t, chain.COINBASE_AMOUNT, txOut.Amount)
-	assert.Equal(t, "coinbase", cbTx.Signature)
-	assert.Equal(t, "", cbTx.Sender)
+	assert.Equal(t, chain.INITIAL_SUBSIDY, txOut.Amount)
 }
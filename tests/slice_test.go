@@ -44,7 +44,7 @@ func TestSliceAssignment(t *testing.T) {
 func createTestBlocks(count int) []chain.Block {
 	var blocks []chain.Block
 	for i := 0 ; i < count ; i++ {
-		block := chain.Block{0, "", "", time.Now(), "", nil, 0, 0}
+		block := chain.Block{0, "", "", time.Now(), "", nil, "", 0, 0}
 		blocks = append(blocks, block)
 	}
 	return blocks
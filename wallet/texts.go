@@ -1,3 +1,31 @@
 package wallet
 
-var HelpText = `abc`
+var HelpText = `
+wallet commands:
+  balance            spendable and immature coins of the wallet address
+  address            the wallet address
+  show address       the wallet address with its public and private keys
+  create address     create a new address, printing its keys
+  private key        the private key of the wallet address
+  send               send coins from the wallet address, asks for the receiver, amount and fee
+  send --after       send coins locked until a later block index, or unix time, asks for the lock time as well
+  create multisig    create an address needing signatures from m of the given public keys to spend
+  multisig send      create a transaction spending from a multisig address, written to a file for the owners to sign
+  multisig sign      sign a transaction file from "multisig send" with the wallet key
+  multisig finalize  finish a transaction file with enough signatures, and add it to the mempool
+
+chain commands:
+  blocks             print the chain
+  mempool            transactions waiting to be mined
+  supply             block subsidy and coins issued so far
+  mine block         mine a single block with the mempool transactions, paying to the wallet address
+  mine start         start mining in the background
+  mine stop          stop background mining
+  mine status        state of background mining
+  mine payout        change the address background mining pays to
+  check utxos        check the stored unspent txouts against the blocks
+  rebuild utxos      rebuild the unspent txouts from the blocks
+  save               write the wallet and the chain to disk
+  exit               save and exit
+
+`
@@ -11,6 +11,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 var walletPath = "node/wallet/"
@@ -19,7 +20,8 @@ var walletKey *ecdsa.PrivateKey
 var publicAddr string
 var walletBalance int64
 
-func ReadConsole() {
+//ReadConsole reads and executes wallet commands from the console, using the given chain and background mining service
+func ReadConsole(bc *chain.Blockchain, mining *chain.MiningService) {
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Println("Welcome, sir!")
 	fmt.Print("wallet> ")
@@ -28,18 +30,32 @@ func ReadConsole() {
 		input := scanner.Text()
 		switch input {
 		case "balance":
-			balance := chain.BalanceFor(publicAddr)
-			fmt.Println(balance)
+			balance := bc.BalanceFor(publicAddr)
+			immature := bc.ImmatureBalanceFor(publicAddr)
+			fmt.Println(balance-immature, "spendable")
+			fmt.Println(immature, "immature, from mined blocks not deep enough in the chain yet")
 		case "exit":
+			mining.Stop()
 			writeWallet()
-			chain.WriteBlockChain()
+			bc.WriteBlockChain()
+			bc.Close()
 			os.Exit(1)
 			//break readloop
 		case "save":
 			writeWallet()
-			chain.WriteBlockChain()
+			bc.WriteBlockChain()
 		case "send":
-			walletSend()
+			walletSend(bc, false)
+		case "send --after":
+			walletSend(bc, true)
+		case "create multisig":
+			walletCreateMultisig()
+		case "multisig send":
+			walletMultisigSend(bc)
+		case "multisig sign":
+			walletMultisigSign()
+		case "multisig finalize":
+			walletMultisigFinalize(bc)
 		case "show address":
 			log.Print("Wallet address: ")
 			log.Print("        pubkey: ", cryptoff.EncodePublicKey(&walletKey.PublicKey))
@@ -55,10 +71,40 @@ func ReadConsole() {
 			println(publicAddr)
 		case "private key":
 			print(cryptoff.EncodePrivateKey(walletKey))
+		case "mempool":
+			for _, tx := range bc.Mempool() {
+				fmt.Println(tx.Id, tx.TxOuts)
+			}
 		case "blocks":
-			chain.PrintChain(chain.GlobalChain)
+			bc.PrintChain()
 		case "mine block":
-			chain.CreateBlock(publicAddr, nil, "Hello", 0)
+			_, err := bc.MinePending(publicAddr, "Hello")
+			if err != nil {
+				fmt.Println("error", err)
+			}
+		case "mine start":
+			err := mining.Start()
+			if err != nil {
+				fmt.Println("error", err)
+			}
+		case "mine stop":
+			mining.Stop()
+		case "mine status":
+			printMiningStatus(mining.Status())
+		case "mine payout":
+			walletMinePayout(mining)
+		case "supply":
+			supply, _ := bc.Supply(bc.Height())
+			fmt.Println("height:", supply.Height)
+			fmt.Println("block subsidy:", supply.Subsidy)
+			fmt.Println("issued:", supply.Issued, "of scheduled", supply.Scheduled)
+		case "check utxos":
+			checkUtxos(bc)
+		case "rebuild utxos":
+			err := bc.RebuildUtxos()
+			if err != nil {
+				fmt.Println("error", err)
+			}
 		default:
 			println("Unknown command: ", input)
 		}
@@ -132,7 +178,9 @@ func writeWallet() {
 	f.WriteString(string(contentB))
 }
 
-func walletSend() {
+//walletSend asks for the receiver and amount, and sends the coins from the wallet address and any other addresses given.
+//with after set, also asks for the block index or unix time before which the transaction is not valid in a block
+func walletSend(bc *chain.Blockchain, after bool) {
 	scanner := bufio.NewScanner(os.Stdin)
 	print("Receiver address:")
 	scanner.Scan()
@@ -145,6 +193,227 @@ func walletSend() {
 		println("oh no, error occurred, no coins sent:", err)
 		return
 	}
-	println("sending ", amount, "coins to", receiver)
-	chain.SendCoins(walletKey, receiver, amount)
+	print("Fee for the miner (empty for none):")
+	scanner.Scan()
+	fee := 0
+	if feeStr := scanner.Text(); feeStr != "" {
+		fee, err = strconv.Atoi(feeStr)
+		if err != nil {
+			println("oh no, error occurred, no coins sent:", err)
+			return
+		}
+	}
+	//coins of other addresses can be combined with the wallet coins, each txin is signed by its own key
+	print("Private keys of other addresses to also spend from (comma separated, empty for none):")
+	scanner.Scan()
+	privKeys := []*ecdsa.PrivateKey{walletKey}
+	if keysStr := scanner.Text(); keysStr != "" {
+		for _, keyStr := range strings.Split(keysStr, ",") {
+			privKeys = append(privKeys, cryptoff.DecodePrivateKey(strings.TrimSpace(keyStr)))
+		}
+	}
+	lockTime := 0
+	if after {
+		fmt.Println("current block index:", bc.Height(), ", median time:", bc.MedianTimePast().Unix())
+		print("Send after block index, or unix time (from ", chain.LOCKTIME_THRESHOLD, " up):")
+		scanner.Scan()
+		lockTime, err = strconv.Atoi(scanner.Text())
+		if err != nil {
+			println("oh no, error occurred, no coins sent:", err)
+			return
+		}
+	}
+	println("sending ", amount, "coins to", receiver, "with fee", fee, "from", len(privKeys), "addresses")
+	tx, err := bc.SendCoinsAfter(privKeys, receiver, amount, fee, lockTime)
+	if err != nil {
+		fmt.Println("error, no coins sent:", err)
+		return
+	}
+	fmt.Println("transaction added to mempool:", tx.Id)
+}
+
+//walletCreateMultisig asks for the public keys of the owners and the signatures needed, and prints the shared address
+func walletCreateMultisig() {
+	scanner := bufio.NewScanner(os.Stdin)
+	print("Public keys of the owners (comma separated, empty for only the wallet key):")
+	scanner.Scan()
+	var pubKeys []string
+	for _, pubKey := range strings.Split(scanner.Text(), ",") {
+		if pubKey = strings.TrimSpace(pubKey); pubKey != "" {
+			pubKeys = append(pubKeys, pubKey)
+		}
+	}
+	if len(pubKeys) == 0 {
+		pubKeys = []string{publicAddr}
+	}
+	print("Signatures needed to spend:")
+	scanner.Scan()
+	m, err := strconv.Atoi(scanner.Text())
+	if err != nil {
+		println("oh no, error occurred, no address created:", err)
+		return
+	}
+	address, err := chain.MultisigAddress(m, pubKeys)
+	if err != nil {
+		fmt.Println("error, no address created:", err)
+		return
+	}
+	fmt.Println("multisig address for", m, "of", len(pubKeys), "keys:", address)
+}
+
+//walletMultisigSend creates a transaction spending from a multisig address, and writes it to a file for the owners to sign
+func walletMultisigSend(bc *chain.Blockchain) {
+	scanner := bufio.NewScanner(os.Stdin)
+	print("Multisig address to send from:")
+	scanner.Scan()
+	from := scanner.Text()
+	print("Receiver address:")
+	scanner.Scan()
+	receiver := scanner.Text()
+	print("Amount to send:")
+	scanner.Scan()
+	amount, err := strconv.Atoi(scanner.Text())
+	if err != nil {
+		println("oh no, error occurred, no transaction created:", err)
+		return
+	}
+	print("Fee for the miner (empty for none):")
+	scanner.Scan()
+	fee := 0
+	if feeStr := scanner.Text(); feeStr != "" {
+		fee, err = strconv.Atoi(feeStr)
+		if err != nil {
+			println("oh no, error occurred, no transaction created:", err)
+			return
+		}
+	}
+	print("File to write the transaction to:")
+	scanner.Scan()
+	fileName := scanner.Text()
+	ptx, err := bc.CreatePartialTx(from, receiver, amount, fee)
+	if err != nil {
+		fmt.Println("error, no transaction created:", err)
+		return
+	}
+	if writePartialTx(fileName, ptx) {
+		fmt.Println("transaction written to", fileName, ", pass it to the owners to sign with \"multisig sign\"")
+	}
+}
+
+//walletMultisigSign adds the signatures of the wallet key to a transaction in a file, and writes it back
+func walletMultisigSign() {
+	fileName, ptx, ok := readPartialTx()
+	if !ok {
+		return
+	}
+	signed, err := ptx.Sign(walletKey)
+	if err != nil {
+		fmt.Println("error, transaction not signed:", err)
+		return
+	}
+	if writePartialTx(fileName, ptx) {
+		fmt.Println("signed", signed, "txins, signatures still missing for each txin:", ptx.Missing())
+	}
+}
+
+//walletMultisigFinalize builds the signed transaction from a file with enough signatures, and submits it to the mempool
+func walletMultisigFinalize(bc *chain.Blockchain) {
+	_, ptx, ok := readPartialTx()
+	if !ok {
+		return
+	}
+	tx, err := ptx.Finalize()
+	if err != nil {
+		fmt.Println("error, transaction not finalized:", err)
+		return
+	}
+	err = bc.SubmitTransaction(tx)
+	if err != nil {
+		fmt.Println("error, transaction not submitted:", err)
+		return
+	}
+	fmt.Println("transaction added to mempool:", tx.Id)
+}
+
+//readPartialTx asks for a file name and reads the partially signed transaction in it
+func readPartialTx() (string, chain.PartialTx, bool) {
+	scanner := bufio.NewScanner(os.Stdin)
+	print("Transaction file:")
+	scanner.Scan()
+	fileName := scanner.Text()
+	var ptx chain.PartialTx
+	bytes, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		err = json.Unmarshal(bytes, &ptx)
+	}
+	if err != nil {
+		fmt.Println("error reading transaction file:", err)
+		return fileName, ptx, false
+	}
+	fmt.Println("sending", ptx.Tx.TxOuts, "with", len(ptx.Tx.TxIns), "txins")
+	return fileName, ptx, true
+}
+
+//writePartialTx writes the partially signed transaction to the given file as JSON
+func writePartialTx(fileName string, ptx chain.PartialTx) bool {
+	bytes, err := json.MarshalIndent(ptx, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(fileName, bytes, 0644)
+	}
+	if err != nil {
+		fmt.Println("error writing transaction file:", err)
+		return false
+	}
+	return true
+}
+
+//walletMinePayout asks for the address background mining pays to, empty for the wallet address
+func walletMinePayout(mining *chain.MiningService) {
+	scanner := bufio.NewScanner(os.Stdin)
+	print("Payout address (empty for wallet address):")
+	scanner.Scan()
+	address := scanner.Text()
+	if address == "" {
+		address = publicAddr
+	}
+	mining.SetPayoutAddress(address)
+}
+
+func printMiningStatus(status chain.MiningStatus) {
+	fmt.Println("mining:", status.Running)
+	fmt.Println("payout address:", status.PayoutAddress)
+	fmt.Println("chain height:", status.Height)
+	fmt.Println("blocks found:", status.Stats.BlocksFound)
+	fmt.Println("transactions in block being mined:", status.Transactions)
+	fmt.Printf("hash rate: %.0f hashes/s with %d workers\n", status.Stats.HashRate, status.Stats.Workers)
+	if status.LastError != "" {
+		fmt.Println("last error:", status.LastError)
+	}
+}
+
+//checkUtxos compares the stored unspent txouts to ones rebuilt from the blocks, and prints the differences
+func checkUtxos(bc *chain.Blockchain) {
+	check, err := bc.CheckUtxos()
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	fmt.Println("unspent txouts rebuilt from blocks:", check.Rebuilt)
+	if check.StoredTip != check.Tip {
+		fmt.Println("stored unspent txouts are for block", check.StoredTip, ", chain tip is", check.Tip)
+	}
+	for _, utxo := range check.Missing {
+		fmt.Println("missing:", utxo)
+	}
+	for _, utxo := range check.Extra {
+		fmt.Println("extra:", utxo)
+	}
+	for _, address := range check.BadAddress {
+		fmt.Println("address index does not match for:", address)
+	}
+	if check.Ok() {
+		fmt.Println("unspent txouts ok")
+	} else {
+		fmt.Println("unspent txouts do not match the blocks, use \"rebuild utxos\" to fix")
+	}
 }